@@ -0,0 +1,590 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Analytics read from two places. Orders hold the current state of live
+// orders; the outbox holds every event, including for orders that were
+// cancelled and deleted, so funnels and timelines are built from it. Outbox
+// entries are kept forever for this reason, and backfillOutbox recreates
+// the events of orders placed before the outbox existed.
+
+var analyticsCacheTTL = time.Duration(envInt("ANALYTICS_CACHE_SECONDS", 300)) * time.Second
+
+// analyticsCache keeps computed results per endpoint and query for
+// analyticsCacheTTL. Each process has its own copy.
+var analyticsCache = struct {
+	sync.Mutex
+	entries map[string]analyticsCacheEntry
+}{entries: map[string]analyticsCacheEntry{}}
+
+type analyticsCacheEntry struct {
+	Value      interface{}
+	ComputedAt time.Time
+}
+
+// analyticsRange is the period and bucketing an analytics request asked
+// for. From is inclusive and To exclusive.
+type analyticsRange struct {
+	From        time.Time
+	To          time.Time
+	Location    *time.Location
+	Granularity string
+}
+
+// parseAnalyticsRange defaults to the last 30 days bucketed by day in UTC.
+func parseAnalyticsRange(r *http.Request) (analyticsRange, error) {
+	q := r.URL.Query()
+	ar := analyticsRange{To: time.Now().UTC(), Location: time.UTC, Granularity: "day"}
+
+	if s := q.Get("to"); s != "" {
+		t, err := parseDay(s, true)
+		if err != nil {
+			return ar, fmt.Errorf("invalid to")
+		}
+		ar.To = t
+	}
+	ar.From = ar.To.AddDate(0, 0, -30)
+	if s := q.Get("from"); s != "" {
+		t, err := parseDay(s, false)
+		if err != nil {
+			return ar, fmt.Errorf("invalid from")
+		}
+		ar.From = t
+	}
+	if !ar.From.Before(ar.To) {
+		return ar, fmt.Errorf("from must be before to")
+	}
+
+	if s := q.Get("tz"); s != "" {
+		loc, err := time.LoadLocation(s)
+		if err != nil {
+			return ar, fmt.Errorf("unknown time zone")
+		}
+		ar.Location = loc
+	}
+	if s := q.Get("granularity"); s != "" {
+		if s != "day" && s != "hour" {
+			return ar, fmt.Errorf("granularity must be day or hour")
+		}
+		ar.Granularity = s
+	}
+	return ar, nil
+}
+
+// idRange matches documents whose ObjectID was generated in the range,
+// which for orders is their creation time.
+func (ar analyticsRange) idRange() bson.M {
+	return bson.M{
+		"$gte": primitive.NewObjectIDFromTimestamp(ar.From),
+		"$lt":  primitive.NewObjectIDFromTimestamp(ar.To),
+	}
+}
+
+func (ar analyticsRange) timeRange() bson.M {
+	return bson.M{"$gte": ar.From, "$lt": ar.To}
+}
+
+// bucket groups a date field by the requested granularity in the
+// requested time zone.
+func (ar analyticsRange) bucket(field string) bson.M {
+	format := "%Y-%m-%d"
+	if ar.Granularity == "hour" {
+		format = "%Y-%m-%dT%H:00"
+	}
+	return bson.M{"$dateToString": bson.M{"format": format, "date": field, "timezone": ar.Location.String()}}
+}
+
+// serveAnalytics answers from the cache when it can and computes and
+// caches the result otherwise.
+func serveAnalytics(w http.ResponseWriter, r *http.Request, compute func(ctx context.Context, ar analyticsRange) (interface{}, error)) {
+	ar, err := parseAnalyticsRange(r)
+	if err != nil {
+		http.Error(w, "Invalid range: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	key := r.URL.Path + "?" + r.URL.Query().Encode()
+	now := time.Now().UTC()
+
+	analyticsCache.Lock()
+	entry, ok := analyticsCache.entries[key]
+	analyticsCache.Unlock()
+
+	if !ok || now.Sub(entry.ComputedAt) >= analyticsCacheTTL {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Minute)
+		defer cancel()
+
+		value, err := compute(ctx, ar)
+		if err != nil {
+			http.Error(w, "Failed to compute analytics", http.StatusInternalServerError)
+			return
+		}
+		entry = analyticsCacheEntry{Value: value, ComputedAt: now}
+
+		analyticsCache.Lock()
+		for k, e := range analyticsCache.entries {
+			if now.Sub(e.ComputedAt) >= analyticsCacheTTL {
+				delete(analyticsCache.entries, k)
+			}
+		}
+		analyticsCache.entries[key] = entry
+		analyticsCache.Unlock()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"from":       ar.From,
+		"to":         ar.To,
+		"computedAt": entry.ComputedAt,
+		"data":       entry.Value,
+	})
+}
+
+func aggregate(ctx context.Context, collection string, pipeline []bson.M, results interface{}) error {
+	cursor, err := client.Database("myapp").Collection(collection).Aggregate(ctx, pipeline)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	return cursor.All(ctx, results)
+}
+
+type VolumeBucket struct {
+	Bucket string `json:"bucket" bson:"_id"`
+	Orders int64  `json:"orders" bson:"orders"`
+}
+
+// GetOrderVolume counts orders placed per day or hour, cancelled ones
+// included.
+func GetOrderVolume(w http.ResponseWriter, r *http.Request) {
+	serveAnalytics(w, r, func(ctx context.Context, ar analyticsRange) (interface{}, error) {
+		buckets := []VolumeBucket{}
+		err := aggregate(ctx, "outbox", []bson.M{
+			{"$match": bson.M{"event": eventOrderCreated, "orderId": ar.idRange()}},
+			{"$group": bson.M{"_id": ar.bucket("$createdAt"), "orders": bson.M{"$sum": 1}}},
+			{"$sort": bson.M{"_id": 1}},
+		}, &buckets)
+		return buckets, err
+	})
+}
+
+// funnelStages lists, for each stage, the events that show an order got
+// that far.
+var funnelStages = []struct {
+	Name   string
+	Events []string
+}{
+	{"created", []string{eventOrderCreated}},
+	{"assigned", []string{statusEvent("Pending Acceptance")}},
+	{"accepted", []string{statusEvent("Accepted")}},
+	{"pickedUp", []string{statusEvent("Picked up"), statusEvent("In transit")}},
+	{"delivered", []string{statusEvent("Delivered"), statusEvent("Partially delivered")}},
+	{"cancelled", []string{eventOrderCancelled}},
+}
+
+type FunnelStage struct {
+	Stage  string `json:"stage"`
+	Orders int64  `json:"orders"`
+}
+
+type StatusFunnel struct {
+	Stages           []FunnelStage `json:"stages"`
+	CancellationRate float64       `json:"cancellationRate"`
+}
+
+// GetStatusFunnel follows the orders placed in the range and counts how
+// many reached each stage.
+func GetStatusFunnel(w http.ResponseWriter, r *http.Request) {
+	serveAnalytics(w, r, func(ctx context.Context, ar analyticsRange) (interface{}, error) {
+		var events bson.A
+		counts := bson.M{"_id": nil}
+		for _, stage := range funnelStages {
+			reached := bson.A{}
+			for _, e := range stage.Events {
+				events = append(events, e)
+				reached = append(reached, bson.M{"$in": bson.A{e, "$events"}})
+			}
+			counts[stage.Name] = bson.M{"$sum": bson.M{"$cond": bson.A{bson.M{"$or": reached}, 1, 0}}}
+		}
+
+		var result []bson.M
+		err := aggregate(ctx, "outbox", []bson.M{
+			{"$match": bson.M{"orderId": ar.idRange(), "event": bson.M{"$in": events}}},
+			{"$group": bson.M{"_id": "$orderId", "events": bson.M{"$addToSet": "$event"}}},
+			{"$group": counts},
+		}, &result)
+		if err != nil {
+			return nil, err
+		}
+
+		funnel := StatusFunnel{Stages: []FunnelStage{}}
+		for _, stage := range funnelStages {
+			var n int64
+			if len(result) > 0 {
+				n = toInt64(result[0][stage.Name])
+			}
+			funnel.Stages = append(funnel.Stages, FunnelStage{Stage: stage.Name, Orders: n})
+		}
+		if created := funnel.Stages[0].Orders; created > 0 {
+			funnel.CancellationRate = float64(funnel.Stages[len(funnel.Stages)-1].Orders) / float64(created)
+		}
+		return funnel, nil
+	})
+}
+
+func toInt64(v interface{}) int64 {
+	switch n := v.(type) {
+	case int32:
+		return int64(n)
+	case int64:
+		return n
+	case float64:
+		return int64(n)
+	}
+	return 0
+}
+
+type Transition struct {
+	From           string  `json:"from"`
+	To             string  `json:"to"`
+	Orders         int64   `json:"orders"`
+	AverageMinutes float64 `json:"averageMinutes"`
+}
+
+// GetTimelineTransitions reports the average time between consecutive
+// timeline events of the orders placed in the range. Only the first time
+// an order reaches a status counts, so reassignments do not skew it.
+func GetTimelineTransitions(w http.ResponseWriter, r *http.Request) {
+	serveAnalytics(w, r, func(ctx context.Context, ar analyticsRange) (interface{}, error) {
+		cursor, err := client.Database("myapp").Collection("outbox").Aggregate(ctx, []bson.M{
+			{"$match": bson.M{"orderId": ar.idRange(), "event": bson.M{"$nin": bson.A{eventOrderDeleted}}}},
+			// Backfilled events have later sequence numbers than the
+			// events they precede, so time orders them first.
+			{"$sort": bson.D{{Key: "createdAt", Value: 1}, {Key: "seq", Value: 1}}},
+			{"$group": bson.M{
+				"_id":    "$orderId",
+				"events": bson.M{"$push": bson.M{"event": "$event", "at": "$createdAt"}},
+			}},
+		})
+		if err != nil {
+			return nil, err
+		}
+		defer cursor.Close(ctx)
+
+		type total struct {
+			orders  int64
+			minutes float64
+		}
+		totals := map[[2]string]*total{}
+		for cursor.Next(ctx) {
+			var order struct {
+				Events []struct {
+					Event string    `bson:"event"`
+					At    time.Time `bson:"at"`
+				} `bson:"events"`
+			}
+			if err := cursor.Decode(&order); err != nil {
+				return nil, err
+			}
+
+			seen := map[string]bool{}
+			prev := -1
+			for i, e := range order.Events {
+				if seen[e.Event] {
+					continue
+				}
+				seen[e.Event] = true
+				if prev >= 0 {
+					from := order.Events[prev]
+					key := [2]string{from.Event, e.Event}
+					if totals[key] == nil {
+						totals[key] = &total{}
+					}
+					totals[key].orders++
+					totals[key].minutes += e.At.Sub(from.At).Minutes()
+				}
+				prev = i
+			}
+		}
+		if err := cursor.Err(); err != nil {
+			return nil, err
+		}
+
+		transitions := []Transition{}
+		for key, t := range totals {
+			transitions = append(transitions, Transition{
+				From:           key[0],
+				To:             key[1],
+				Orders:         t.orders,
+				AverageMinutes: t.minutes / float64(t.orders),
+			})
+		}
+		sort.Slice(transitions, func(i, j int) bool { return transitions[i].Orders > transitions[j].Orders })
+		return transitions, nil
+	})
+}
+
+type CourierStats struct {
+	CourierEmail   string  `json:"courierEmail"`
+	Deliveries     int64   `json:"deliveries"`
+	Accepted       int64   `json:"accepted"`
+	Declined       int64   `json:"declined"`
+	AcceptanceRate float64 `json:"acceptanceRate"`
+}
+
+type courierCount struct {
+	CourierEmail string `bson:"_id"`
+	N            int64  `bson:"n"`
+}
+
+// GetCourierStats counts deliveries, accepted and declined assignments per
+// courier for events in the range.
+func GetCourierStats(w http.ResponseWriter, r *http.Request) {
+	serveAnalytics(w, r, func(ctx context.Context, ar analyticsRange) (interface{}, error) {
+		var deliveries, accepted, declined []courierCount
+		err := aggregate(ctx, "orders", []bson.M{
+			{"$match": bson.M{"deliveredAt": ar.timeRange(), "courierEmail": bson.M{"$exists": true}}},
+			{"$group": bson.M{"_id": "$courierEmail", "n": bson.M{"$sum": 1}}},
+		}, &deliveries)
+		if err != nil {
+			return nil, err
+		}
+		err = aggregate(ctx, "outbox", []bson.M{
+			{"$match": bson.M{"event": statusEvent("Accepted"), "createdAt": ar.timeRange()}},
+			{"$group": bson.M{"_id": "$order.courierEmail", "n": bson.M{"$sum": 1}}},
+		}, &accepted)
+		if err != nil {
+			return nil, err
+		}
+		err = aggregate(ctx, "orders", []bson.M{
+			{"$match": bson.M{"declines.at": ar.timeRange()}},
+			{"$unwind": "$declines"},
+			{"$match": bson.M{"declines.at": ar.timeRange()}},
+			{"$group": bson.M{"_id": "$declines.courierEmail", "n": bson.M{"$sum": 1}}},
+		}, &declined)
+		if err != nil {
+			return nil, err
+		}
+
+		byCourier := map[string]*CourierStats{}
+		stats := func(email string) *CourierStats {
+			if byCourier[email] == nil {
+				byCourier[email] = &CourierStats{CourierEmail: email}
+			}
+			return byCourier[email]
+		}
+		for _, c := range deliveries {
+			stats(c.CourierEmail).Deliveries = c.N
+		}
+		for _, c := range accepted {
+			stats(c.CourierEmail).Accepted = c.N
+		}
+		for _, c := range declined {
+			stats(c.CourierEmail).Declined = c.N
+		}
+
+		result := []CourierStats{}
+		for _, s := range byCourier {
+			if answered := s.Accepted + s.Declined; answered > 0 {
+				s.AcceptanceRate = float64(s.Accepted) / float64(answered)
+			}
+			result = append(result, *s)
+		}
+		sort.Slice(result, func(i, j int) bool { return result[i].Deliveries > result[j].Deliveries })
+		return result, nil
+	})
+}
+
+type RevenueBucket struct {
+	Bucket     string `json:"bucket" bson:"_id"`
+	Orders     int64  `json:"orders" bson:"orders"`
+	Price      int64  `json:"price" bson:"price"`
+	Tips       int64  `json:"tips" bson:"tips"`
+	Refunds    int64  `json:"refunds" bson:"refunds"`
+	CourierPay int64  `json:"courierPay" bson:"courierPay"`
+	Net        int64  `json:"net" bson:"net"`
+}
+
+// GetRevenue reports, by delivery date, what delivered orders were charged
+// and the net revenue the platform kept: the price less refunds and the
+// courier's pay before tips. Tips are passed on to couriers, so they are
+// shown but not counted.
+func GetRevenue(w http.ResponseWriter, r *http.Request) {
+	serveAnalytics(w, r, func(ctx context.Context, ar analyticsRange) (interface{}, error) {
+		buckets := []RevenueBucket{}
+		err := aggregate(ctx, "orders", []bson.M{
+			{"$match": bson.M{"deliveredAt": ar.timeRange(), "status": bson.M{"$in": bson.A{"Delivered", "Partially delivered"}}}},
+			{"$lookup": bson.M{
+				"from":         "courier_earnings",
+				"localField":   "_id",
+				"foreignField": "orderId",
+				"as":           "earnings",
+			}},
+			{"$lookup": bson.M{
+				"from": "ledger",
+				"let":  bson.M{"id": "$_id"},
+				"pipeline": bson.A{
+					bson.M{"$match": bson.M{"$expr": bson.M{"$and": bson.A{
+						bson.M{"$eq": bson.A{"$orderId", "$$id"}},
+						bson.M{"$eq": bson.A{"$type", ledgerRefund}},
+					}}}},
+					bson.M{"$unwind": "$postings"},
+					bson.M{"$match": bson.M{"postings.account": accountRevenue}},
+					bson.M{"$project": bson.M{"amount": bson.M{"$multiply": bson.A{"$postings.amount", -1}}}},
+				},
+				"as": "refunds",
+			}},
+			{"$group": bson.M{
+				"_id":     ar.bucket("$deliveredAt"),
+				"orders":  bson.M{"$sum": 1},
+				"price":   bson.M{"$sum": "$price"},
+				"tips":    bson.M{"$sum": "$tip"},
+				"refunds": bson.M{"$sum": bson.M{"$sum": "$refunds.amount"}},
+				"courierPay": bson.M{"$sum": bson.M{"$sum": bson.M{"$map": bson.M{
+					"input": "$earnings",
+					"as":    "e",
+					"in":    bson.M{"$subtract": bson.A{"$$e.total", "$$e.tip"}},
+				}}}},
+			}},
+			{"$addFields": bson.M{"net": bson.M{"$subtract": bson.A{"$price", bson.M{"$add": bson.A{"$refunds", "$courierPay"}}}}}},
+			{"$sort": bson.M{"_id": 1}},
+		}, &buckets)
+		return buckets, err
+	})
+}
+
+type HeatmapCell struct {
+	Lat    float64 `json:"lat"`
+	Lng    float64 `json:"lng"`
+	Orders int64   `json:"orders"`
+}
+
+type ZoneActivity struct {
+	ZoneID    *primitive.ObjectID `json:"zoneId"`
+	Name      string              `json:"name"`
+	Orders    int64               `json:"orders"`
+	Delivered int64               `json:"delivered"`
+	Revenue   int64               `json:"revenue"`
+	Cells     []HeatmapCell       `json:"cells"`
+}
+
+// GetZoneHeatmap groups the orders placed in the range by zone and, within
+// each zone, by pickup position rounded to precision decimal places (2 by
+// default, about a kilometre).
+func GetZoneHeatmap(w http.ResponseWriter, r *http.Request) {
+	precision := 2
+	if s := r.URL.Query().Get("precision"); s != "" {
+		p, err := strconv.Atoi(s)
+		if err != nil || p < 0 || p > 4 {
+			http.Error(w, "Precision must be between 0 and 4", http.StatusBadRequest)
+			return
+		}
+		precision = p
+	}
+
+	serveAnalytics(w, r, func(ctx context.Context, ar analyticsRange) (interface{}, error) {
+		var zones []struct {
+			ZoneID    *primitive.ObjectID `bson:"_id"`
+			Orders    int64               `bson:"orders"`
+			Delivered int64               `bson:"delivered"`
+			Revenue   int64               `bson:"revenue"`
+		}
+		err := aggregate(ctx, "orders", []bson.M{
+			{"$match": bson.M{"_id": ar.idRange()}},
+			{"$group": bson.M{
+				"_id":       "$zoneId",
+				"orders":    bson.M{"$sum": 1},
+				"delivered": bson.M{"$sum": bson.M{"$cond": bson.A{bson.M{"$ifNull": bson.A{"$deliveredAt", false}}, 1, 0}}},
+				"revenue":   bson.M{"$sum": bson.M{"$cond": bson.A{bson.M{"$ifNull": bson.A{"$deliveredAt", false}}, "$price", 0}}},
+			}},
+			{"$sort": bson.M{"orders": -1}},
+		}, &zones)
+		if err != nil {
+			return nil, err
+		}
+
+		var cells []struct {
+			ID struct {
+				ZoneID *primitive.ObjectID `bson:"zone"`
+				Lat    float64             `bson:"lat"`
+				Lng    float64             `bson:"lng"`
+			} `bson:"_id"`
+			Orders int64 `bson:"orders"`
+		}
+		err = aggregate(ctx, "orders", []bson.M{
+			{"$match": bson.M{"_id": ar.idRange(), "pickupCoordinates": bson.M{"$exists": true}}},
+			{"$group": bson.M{
+				"_id": bson.M{
+					"zone": "$zoneId",
+					"lat":  bson.M{"$round": bson.A{"$pickupCoordinates.lat", precision}},
+					"lng":  bson.M{"$round": bson.A{"$pickupCoordinates.lng", precision}},
+				},
+				"orders": bson.M{"$sum": 1},
+			}},
+			{"$sort": bson.M{"orders": -1}},
+		}, &cells)
+		if err != nil {
+			return nil, err
+		}
+
+		names, err := zoneNames(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		result := []ZoneActivity{}
+		index := map[primitive.ObjectID]int{}
+		for _, z := range zones {
+			activity := ZoneActivity{ZoneID: z.ZoneID, Orders: z.Orders, Delivered: z.Delivered, Revenue: z.Revenue, Cells: []HeatmapCell{}}
+			var key primitive.ObjectID
+			if z.ZoneID != nil {
+				key = *z.ZoneID
+				activity.Name = names[key]
+			} else {
+				activity.Name = "Outside any zone"
+			}
+			index[key] = len(result)
+			result = append(result, activity)
+		}
+		for _, c := range cells {
+			var key primitive.ObjectID
+			if c.ID.ZoneID != nil {
+				key = *c.ID.ZoneID
+			}
+			if i, ok := index[key]; ok {
+				result[i].Cells = append(result[i].Cells, HeatmapCell{Lat: c.ID.Lat, Lng: c.ID.Lng, Orders: c.Orders})
+			}
+		}
+		return result, nil
+	})
+}
+
+func zoneNames(ctx context.Context) (map[primitive.ObjectID]string, error) {
+	cursor, err := client.Database("myapp").Collection("service_zones").Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var zones []ServiceZone
+	if err := cursor.All(ctx, &zones); err != nil {
+		return nil, err
+	}
+	names := map[primitive.ObjectID]string{}
+	for _, z := range zones {
+		names[z.ID] = z.Name
+	}
+	return names, nil
+}
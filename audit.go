@@ -0,0 +1,490 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	auditSuccess = "success"
+	auditFailure = "failure"
+
+	maxAuditBodyPeek = 1 << 20
+)
+
+// auditRedacted fields never make it into a diff.
+var auditRedacted = map[string]bool{"password": true, "keyHash": true, "secret": true, "pin": true}
+
+// AuditChange is one top-level field that an action changed. Before and
+// After hold the JSON of the value, so the entry hashes the same after a
+// round trip through the database.
+type AuditChange struct {
+	Field  string `json:"field" bson:"field"`
+	Before string `json:"before,omitempty" bson:"before,omitempty"`
+	After  string `json:"after,omitempty" bson:"after,omitempty"`
+}
+
+// AuditEntry is written once and never updated. Hash covers every other
+// field including PrevHash, the hash of the entry before it, so editing or
+// removing an entry breaks the chain from there on.
+type AuditEntry struct {
+	Seq          int64         `json:"seq" bson:"_id"`
+	Actor        string        `json:"actor" bson:"actor"`
+	ActorRole    string        `json:"actorRole" bson:"actorRole"`
+	Action       string        `json:"action" bson:"action"`
+	ResourceType string        `json:"resourceType,omitempty" bson:"resourceType,omitempty"`
+	ResourceID   string        `json:"resourceId,omitempty" bson:"resourceId,omitempty"`
+	Changes      []AuditChange `json:"changes,omitempty" bson:"changes,omitempty"`
+	Outcome      string        `json:"outcome" bson:"outcome"`
+	Status       int           `json:"status,omitempty" bson:"status,omitempty"`
+	IP           string        `json:"ip" bson:"ip"`
+	UserAgent    string        `json:"userAgent" bson:"userAgent"`
+	CreatedAt    time.Time     `json:"createdAt" bson:"createdAt"`
+	PrevHash     string        `json:"prevHash" bson:"prevHash"`
+	Hash         string        `json:"hash" bson:"hash"`
+}
+
+func (e AuditEntry) computeHash() string {
+	e.Hash = ""
+	data, _ := json.Marshal(e)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// auditHead records the end of the chain, so entries cut off the end still
+// show up in verification. It is moved forward after each append and may
+// briefly lag behind the log, never run ahead of it.
+type auditHead struct {
+	Seq  int64  `bson:"seq"`
+	Hash string `bson:"hash"`
+}
+
+const maxAuditAppendAttempts = 5
+
+var auditMu sync.Mutex
+
+// appendAudit adds entry to the end of the chain. The entry's sequence
+// number is its _id, so of two appends racing for the same position one
+// fails with a duplicate key and retries on the new tail. Every step is a
+// single-document write, so no transaction is needed.
+func appendAudit(ctx context.Context, entry AuditEntry) error {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+
+	// Mongo keeps milliseconds; hashing more would not survive a read back.
+	entry.CreatedAt = time.Now().UTC().Truncate(time.Millisecond)
+
+	db := client.Database("myapp")
+	auditLog := db.Collection("audit_log")
+	for attempt := 1; ; attempt++ {
+		var tail AuditEntry
+		err := auditLog.FindOne(ctx, bson.M{}, options.FindOne().SetSort(bson.M{"_id": -1})).Decode(&tail)
+		if err != nil && err != mongo.ErrNoDocuments {
+			return err
+		}
+
+		entry.Seq = tail.Seq + 1
+		entry.PrevHash = tail.Hash
+		entry.Hash = entry.computeHash()
+		_, err = auditLog.InsertOne(ctx, entry)
+		if err == nil {
+			break
+		}
+		if !mongo.IsDuplicateKeyError(err) || attempt == maxAuditAppendAttempts {
+			return err
+		}
+	}
+
+	_, err := db.Collection("audit_head").UpdateOne(ctx,
+		bson.M{"_id": "audit", "seq": bson.M{"$lt": entry.Seq}},
+		bson.M{"$set": bson.M{"seq": entry.Seq, "hash": entry.Hash}},
+		options.Update().SetUpsert(true),
+	)
+	if mongo.IsDuplicateKeyError(err) {
+		// A later entry has already moved the head past this one.
+		return nil
+	}
+	return err
+}
+
+// trustedProxies are the TRUSTED_PROXIES addresses or CIDR ranges, comma
+// separated, of the proxies in front of the API.
+var trustedProxies = parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+
+func parseTrustedProxies(list string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			if strings.Contains(s, ":") {
+				s += "/128"
+			} else {
+				s += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			log.Fatalf("Invalid TRUSTED_PROXIES entry %q: %v", s, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+func trustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	for _, n := range trustedProxies {
+		if parsed != nil && n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP is the address the request came from. X-Forwarded-For is only
+// believed when the request arrives through a trusted proxy, and then read
+// from the right, up to the first address that is not a trusted proxy, since
+// anything further left is whatever the client chose to send.
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !trustedProxy(ip) {
+		return ip
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		ip = hop
+		if !trustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// auditDiff lists the top-level fields that differ between the JSON forms
+// of before and after. Either may be nil for a create or a delete.
+func auditDiff(before, after interface{}) []AuditChange {
+	toMap := func(v interface{}) map[string]json.RawMessage {
+		m := map[string]json.RawMessage{}
+		if v == nil {
+			return m
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return m
+		}
+		json.Unmarshal(data, &m)
+		return m
+	}
+	b, a := toMap(before), toMap(after)
+
+	fields := []string{}
+	for k := range b {
+		fields = append(fields, k)
+	}
+	for k := range a {
+		if _, ok := b[k]; !ok {
+			fields = append(fields, k)
+		}
+	}
+	sort.Strings(fields)
+
+	changes := []AuditChange{}
+	for _, f := range fields {
+		if auditRedacted[f] || bytes.Equal(b[f], a[f]) {
+			continue
+		}
+		changes = append(changes, AuditChange{Field: f, Before: string(b[f]), After: string(a[f])})
+	}
+	return changes
+}
+
+// auditRequest is what the middleware knows about the admin request it is
+// wrapping. Handlers that record their own entry set recorded so the
+// generic one is skipped.
+type auditRequest struct {
+	actor    string
+	recorded bool
+}
+
+type auditContextKey struct{}
+
+// recordAudit appends entry with the caller's IP and user agent. A failure
+// is logged rather than failing the request that was audited.
+func recordAudit(r *http.Request, entry AuditEntry) {
+	entry.IP = clientIP(r)
+	entry.UserAgent = r.UserAgent()
+	if err := appendAudit(context.Background(), entry); err != nil {
+		log.Println("Failed to write audit entry:", err)
+	}
+}
+
+// auditAction records action on a resource by the admin making request r,
+// with the diff between before and after.
+func auditAction(r *http.Request, action, resourceType, resourceID string, before, after interface{}) {
+	actor := ""
+	if state, ok := r.Context().Value(auditContextKey{}).(*auditRequest); ok {
+		actor = state.actor
+		state.recorded = true
+	}
+	recordAudit(r, AuditEntry{
+		Actor:        actor,
+		ActorRole:    "admin",
+		Action:       action,
+		ResourceType: resourceType,
+		ResourceID:   resourceID,
+		Changes:      auditDiff(before, after),
+		Outcome:      auditSuccess,
+	})
+}
+
+// auditAuth records an authentication event. actor is whatever identifies
+// the account, usually the email that was tried.
+func auditAuth(r *http.Request, action, actorRole, actor, outcome string) {
+	recordAudit(r, AuditEntry{
+		Actor:     actor,
+		ActorRole: actorRole,
+		Action:    action,
+		Outcome:   outcome,
+	})
+}
+
+type auditResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *auditResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// auditMiddleware makes sure every admin mutation leaves an entry. The
+// actor is the adminId of the JSON body or query string; handlers with a
+// meaningful before and after record their own entry instead.
+func auditMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodOptions ||
+			!strings.HasPrefix(r.URL.Path, "/api/admin/") || r.URL.Path == "/api/admin/login" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		state := &auditRequest{actor: r.URL.Query().Get("adminId")}
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") && r.Body != nil {
+			body, err := io.ReadAll(io.LimitReader(r.Body, maxAuditBodyPeek))
+			if err == nil {
+				var peek struct {
+					AdminID string `json:"adminId"`
+				}
+				if json.Unmarshal(body, &peek) == nil && peek.AdminID != "" {
+					state.actor = peek.AdminID
+				}
+			}
+			r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+		}
+
+		rw := &auditResponseWriter{ResponseWriter: w}
+		r = r.WithContext(context.WithValue(r.Context(), auditContextKey{}, state))
+		next.ServeHTTP(rw, r)
+		if state.recorded {
+			return
+		}
+
+		action := r.Method + " " + r.URL.Path
+		if route := mux.CurrentRoute(r); route != nil {
+			if tpl, err := route.GetPathTemplate(); err == nil {
+				action = r.Method + " " + tpl
+			}
+		}
+		var resourceIDs []string
+		for _, v := range mux.Vars(r) {
+			resourceIDs = append(resourceIDs, v)
+		}
+		sort.Strings(resourceIDs)
+
+		outcome := auditSuccess
+		if rw.status >= 400 {
+			outcome = auditFailure
+		}
+		recordAudit(r, AuditEntry{
+			Actor:      state.actor,
+			ActorRole:  "admin",
+			Action:     action,
+			ResourceID: strings.Join(resourceIDs, "/"),
+			Outcome:    outcome,
+			Status:     rw.status,
+		})
+	})
+}
+
+// GetAuditLog lists entries newest first. It filters on actor, actorRole,
+// action, resourceType, resourceId, outcome and from/to, and pages with
+// before, the lowest seq of the previous page.
+func GetAuditLog(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := bson.M{}
+	for _, field := range []string{"actor", "actorRole", "action", "resourceType", "resourceId", "outcome"} {
+		if v := q.Get(field); v != "" {
+			filter[field] = v
+		}
+	}
+
+	from, to, err := parseDateRange(r)
+	if err != nil {
+		http.Error(w, "Invalid date range", http.StatusBadRequest)
+		return
+	}
+	createdAt := bson.M{}
+	if !from.IsZero() {
+		createdAt["$gte"] = from
+	}
+	if !to.IsZero() {
+		createdAt["$lt"] = to
+	}
+	if len(createdAt) > 0 {
+		filter["createdAt"] = createdAt
+	}
+
+	if s := q.Get("before"); s != "" {
+		before, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid before", http.StatusBadRequest)
+			return
+		}
+		filter["_id"] = bson.M{"$lt": before}
+	}
+
+	limit := int64(100)
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n <= 0 || n > 1000 {
+			http.Error(w, "Limit must be between 1 and 1000", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	ctx := r.Context()
+	cursor, err := client.Database("myapp").Collection("audit_log").Find(ctx, filter,
+		options.Find().SetSort(bson.M{"_id": -1}).SetLimit(limit))
+	if err != nil {
+		http.Error(w, "Failed to fetch audit log", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	entries := []AuditEntry{}
+	if err := cursor.All(ctx, &entries); err != nil {
+		http.Error(w, "Failed to fetch audit log", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// VerifyAuditLog walks the whole chain and reports the first entry whose
+// hash, link or sequence number does not check out.
+func VerifyAuditLog(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	db := client.Database("myapp")
+	var head auditHead
+	err := db.Collection("audit_head").FindOne(ctx, bson.M{"_id": "audit"}).Decode(&head)
+	if err != nil && err != mongo.ErrNoDocuments {
+		http.Error(w, "Failed to read audit log", http.StatusInternalServerError)
+		return
+	}
+
+	cursor, err := db.Collection("audit_log").Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		http.Error(w, "Failed to read audit log", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	result := map[string]interface{}{"valid": true}
+	var checked int64
+	prevHash := ""
+	for cursor.Next(ctx) {
+		var entry AuditEntry
+		if err := cursor.Decode(&entry); err != nil {
+			http.Error(w, "Failed to read audit log", http.StatusInternalServerError)
+			return
+		}
+		problem := ""
+		switch {
+		case entry.Seq != checked+1:
+			problem = "missing entry before this one"
+		case entry.PrevHash != prevHash:
+			problem = "link to the previous entry does not match"
+		case entry.computeHash() != entry.Hash:
+			problem = "entry was modified"
+		case entry.Seq == head.Seq && entry.Hash != head.Hash:
+			problem = "entry does not match the recorded end of the log"
+		}
+		if problem != "" {
+			result["valid"] = false
+			result["brokenAt"] = entry.Seq
+			result["problem"] = problem
+			break
+		}
+		checked = entry.Seq
+		prevHash = entry.Hash
+	}
+	if err := cursor.Err(); err != nil {
+		http.Error(w, "Failed to read audit log", http.StatusInternalServerError)
+		return
+	}
+
+	// Entries cut off the end of the chain still show against the head. The
+	// head may lag behind entries appended since, but never run ahead.
+	if result["valid"] == true {
+		if head.Seq > checked {
+			result["valid"] = false
+			result["brokenAt"] = checked + 1
+			result["problem"] = "entries missing from the end of the log"
+		}
+	}
+	result["checked"] = checked
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
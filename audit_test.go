@@ -0,0 +1,130 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestAuditDiff(t *testing.T) {
+	type account struct {
+		Name     string            `json:"name"`
+		Email    string            `json:"email,omitempty"`
+		Password string            `json:"password"`
+		Tags     map[string]string `json:"tags,omitempty"`
+	}
+
+	tests := []struct {
+		name          string
+		before, after interface{}
+		want          []AuditChange
+	}{
+		{"nothing", nil, nil, []AuditChange{}},
+		{
+			"create",
+			nil,
+			account{Name: "Ada", Email: "ada@example.com", Password: "secret"},
+			[]AuditChange{
+				{Field: "email", After: `"ada@example.com"`},
+				{Field: "name", After: `"Ada"`},
+			},
+		},
+		{
+			"delete",
+			account{Name: "Ada", Password: "secret"},
+			nil,
+			[]AuditChange{{Field: "name", Before: `"Ada"`}},
+		},
+		{
+			"unchanged fields are left out",
+			account{Name: "Ada", Email: "ada@example.com"},
+			account{Name: "Ada", Email: "ada@example.org"},
+			[]AuditChange{{Field: "email", Before: `"ada@example.com"`, After: `"ada@example.org"`}},
+		},
+		{
+			"redacted fields are left out",
+			account{Name: "Ada", Password: "old"},
+			account{Name: "Ada", Password: "new"},
+			[]AuditChange{},
+		},
+		{
+			"nested values are compared whole",
+			account{Name: "Ada", Tags: map[string]string{"tier": "gold"}},
+			account{Name: "Ada", Tags: map[string]string{"tier": "silver"}},
+			[]AuditChange{{Field: "tags", Before: `{"tier":"gold"}`, After: `{"tier":"silver"}`}},
+		},
+		{
+			"fields from both sides, sorted",
+			map[string]interface{}{"b": 1, "c": 1},
+			map[string]interface{}{"a": 1, "b": 2},
+			[]AuditChange{
+				{Field: "a", After: "1"},
+				{Field: "b", Before: "1", After: "2"},
+				{Field: "c", Before: "1"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		if got := auditDiff(tt.before, tt.after); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: auditDiff = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAuditEntryComputeHash(t *testing.T) {
+	entry := AuditEntry{
+		Seq:          7,
+		Actor:        "admin@example.com",
+		ActorRole:    "admin",
+		Action:       "order.deleted",
+		ResourceType: "order",
+		ResourceID:   "64b7f0000000000000000000",
+		Changes:      []AuditChange{{Field: "status", Before: `"Pending"`}},
+		Outcome:      auditSuccess,
+		Status:       200,
+		IP:           "203.0.113.5",
+		UserAgent:    "curl/8.0",
+		CreatedAt:    time.Date(2026, 3, 2, 9, 30, 0, 123000000, time.UTC),
+		PrevHash:     "abc",
+	}
+	hash := entry.computeHash()
+	if len(hash) != 64 {
+		t.Fatalf("hash %q is not a hex SHA-256", hash)
+	}
+
+	entry.Hash = hash
+	if got := entry.computeHash(); got != hash {
+		t.Errorf("hash depends on the Hash field: %s, want %s", got, hash)
+	}
+
+	// The hash is checked against entries read back from the database.
+	data, err := bson.Marshal(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored AuditEntry
+	if err := bson.Unmarshal(data, &stored); err != nil {
+		t.Fatal(err)
+	}
+	if got := stored.computeHash(); got != hash {
+		t.Errorf("hash changed after a round trip: %s, want %s", got, hash)
+	}
+
+	tampered := []func(e *AuditEntry){
+		func(e *AuditEntry) { e.Seq++ },
+		func(e *AuditEntry) { e.Actor = "someone@example.com" },
+		func(e *AuditEntry) { e.Outcome = auditFailure },
+		func(e *AuditEntry) { e.Changes = nil },
+		func(e *AuditEntry) { e.CreatedAt = e.CreatedAt.Add(time.Millisecond) },
+		func(e *AuditEntry) { e.PrevHash = "abd" },
+	}
+	for i, tamper := range tampered {
+		e := entry
+		tamper(&e)
+		if e.computeHash() == hash {
+			t.Errorf("change %d left the hash unchanged", i)
+		}
+	}
+}
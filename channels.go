@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	channelEmail = "email"
+	channelSMS   = "sms"
+	channelPush  = "push"
+)
+
+// Message is one rendered notification addressed to a channel-specific
+// recipient: an email address, a phone number or a push token.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Sender delivers messages over one channel. Errors are retried by the
+// notification worker.
+type Sender interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+var senders map[string]Sender
+
+// newSendersFromEnv picks a real adapter for each channel that is
+// configured and a logging stand-in for the rest, so development needs no
+// mail server or gateway.
+func newSendersFromEnv() map[string]Sender {
+	s := map[string]Sender{
+		channelEmail: &LogSender{Channel: channelEmail},
+		channelSMS:   &LogSender{Channel: channelSMS},
+		channelPush:  &LogSender{Channel: channelPush},
+	}
+	if addr := os.Getenv("SMTP_ADDR"); addr != "" {
+		s[channelEmail] = &SMTPSender{
+			Addr:     addr,
+			From:     os.Getenv("SMTP_FROM"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+		}
+	}
+	if url := os.Getenv("SMS_GATEWAY_URL"); url != "" {
+		s[channelSMS] = &WebhookSender{URL: url, APIKey: os.Getenv("SMS_GATEWAY_KEY"), Sender: os.Getenv("SMS_SENDER_ID")}
+	}
+	if url := os.Getenv("PUSH_GATEWAY_URL"); url != "" {
+		s[channelPush] = &WebhookSender{URL: url, APIKey: os.Getenv("PUSH_GATEWAY_KEY")}
+	}
+	return s
+}
+
+type LogSender struct {
+	Channel string
+}
+
+func (s *LogSender) Send(ctx context.Context, msg Message) error {
+	log.Printf("[%s] to=%s subject=%q body=%q", s.Channel, msg.To, msg.Subject, msg.Body)
+	return nil
+}
+
+type SMTPSender struct {
+	Addr     string
+	From     string
+	Username string
+	Password string
+}
+
+func (s *SMTPSender) Send(ctx context.Context, msg Message) error {
+	// A line break in a header value would let it add headers or
+	// recipients of its own.
+	if strings.ContainsAny(msg.To, "\r\n") {
+		return fmt.Errorf("invalid email recipient %q", msg.To)
+	}
+	subject := strings.Join(strings.Fields(msg.Subject), " ")
+
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, err := net.SplitHostPort(s.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", s.From)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+
+	return smtp.SendMail(s.Addr, auth, s.From, []string{msg.To}, []byte(b.String()))
+}
+
+// WebhookSender posts the message as JSON to an SMS or push gateway, which
+// is expected to answer 2xx once it has accepted it.
+type WebhookSender struct {
+	URL    string
+	APIKey string
+	Sender string
+}
+
+var gatewayClient = &http.Client{Timeout: 10 * time.Second}
+
+func (s *WebhookSender) Send(ctx context.Context, msg Message) error {
+	payload, err := json.Marshal(map[string]string{
+		"to":      msg.To,
+		"from":    s.Sender,
+		"title":   msg.Subject,
+		"message": msg.Body,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+s.APIKey)
+	}
+
+	resp, err := gatewayClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("gateway answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	chatCustomer = "customer"
+	chatCourier  = "courier"
+	chatAdmin    = "admin"
+
+	maxChatMessage = 2000
+)
+
+// chatCloseAfter is how long after the order ends the thread stays open for
+// follow-up questions.
+var chatCloseAfter = time.Duration(envInt("CHAT_CLOSE_AFTER_HOURS", 24)) * time.Hour
+
+// ChatMessage is one message in an order's thread. ReadBy holds, per
+// role, when the message was first read.
+type ChatMessage struct {
+	ID         primitive.ObjectID   `json:"id" bson:"_id"`
+	OrderID    primitive.ObjectID   `json:"orderId" bson:"orderId"`
+	SenderRole string               `json:"senderRole" bson:"senderRole"`
+	SenderName string               `json:"senderName" bson:"senderName"`
+	Body       string               `json:"body" bson:"body"`
+	CreatedAt  time.Time            `json:"createdAt" bson:"createdAt"`
+	ReadBy     map[string]time.Time `json:"readBy" bson:"readBy"`
+}
+
+// ChatEvent is pushed to every open stream of a thread.
+type ChatEvent struct {
+	Type    string       `json:"type"` // message or read
+	Message *ChatMessage `json:"message,omitempty"`
+	Role    string       `json:"role,omitempty"`
+	ReadAt  *time.Time   `json:"readAt,omitempty"`
+}
+
+// chatHub fans events out to the streams open in this process. Behind
+// several instances a client may miss live events from the others; it
+// catches up from history using the after parameter or Last-Event-ID.
+type chatHub struct {
+	sync.Mutex
+	subs map[primitive.ObjectID]map[chan ChatEvent]struct{}
+}
+
+var chats = &chatHub{subs: map[primitive.ObjectID]map[chan ChatEvent]struct{}{}}
+
+func (h *chatHub) subscribe(orderID primitive.ObjectID) (chan ChatEvent, func()) {
+	ch := make(chan ChatEvent, 16)
+	h.Lock()
+	if h.subs[orderID] == nil {
+		h.subs[orderID] = map[chan ChatEvent]struct{}{}
+	}
+	h.subs[orderID][ch] = struct{}{}
+	h.Unlock()
+
+	return ch, func() {
+		h.Lock()
+		delete(h.subs[orderID], ch)
+		if len(h.subs[orderID]) == 0 {
+			delete(h.subs, orderID)
+		}
+		h.Unlock()
+	}
+}
+
+// publish never blocks; a stream too slow to keep up drops events and
+// has to catch up from history.
+func (h *chatHub) publish(orderID primitive.ObjectID, e ChatEvent) {
+	h.Lock()
+	defer h.Unlock()
+	for ch := range h.subs[orderID] {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+var (
+	phonePattern = regexp.MustCompile(`\+?\d[\d\s().-]{6,}\d`)
+	emailPattern = regexp.MustCompile(`[\w.+-]+@[\w-]+(\.[\w-]+)+`)
+)
+
+// redactContacts hides phone numbers and email addresses typed into a
+// message so the two sides stay in the thread.
+func redactContacts(body string) string {
+	body = emailPattern.ReplaceAllString(body, "[contact hidden]")
+	return phonePattern.ReplaceAllString(body, "[contact hidden]")
+}
+
+// maskPhone keeps only the last two digits.
+func maskPhone(phone string) string {
+	digits := 0
+	for _, c := range phone {
+		if c >= '0' && c <= '9' {
+			digits++
+		}
+	}
+	if digits <= 2 {
+		return phone
+	}
+	var b strings.Builder
+	seen := 0
+	for _, c := range phone {
+		if c >= '0' && c <= '9' {
+			seen++
+			if seen <= digits-2 {
+				c = '•'
+			}
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// chatParticipant works out who is calling: a courier by the email
+// parameter, an admin by the adminId parameter, otherwise the customer
+// from the request's account. It returns the role and the display name.
+func chatParticipant(ctx context.Context, r *http.Request, order Order) (string, string, error) {
+	q := r.URL.Query()
+	if email := q.Get("email"); email != "" {
+		if email != order.CourierEmail {
+			return "", "", &orderError{http.StatusForbidden, "You are not assigned to this order"}
+		}
+		name := order.CourierName
+		if fields := strings.Fields(name); len(fields) > 0 {
+			name = fields[0]
+		}
+		return chatCourier, name, nil
+	}
+
+	if adminID := q.Get("adminId"); adminID != "" {
+		id, err := primitive.ObjectIDFromHex(adminID)
+		if err != nil {
+			return "", "", &orderError{http.StatusBadRequest, "Invalid AdminID format"}
+		}
+		var admin Admin
+		if err := client.Database("myapp").Collection("users").FindOne(ctx, bson.M{"_id": id, "role": "admin"}).Decode(&admin); err != nil {
+			return "", "", &orderError{http.StatusForbidden, "Not an admin"}
+		}
+		return chatAdmin, "Support", nil
+	}
+
+	accountID, _, err := requestAccount(ctx, r, scopeOrdersRead)
+	if err != nil {
+		return "", "", err
+	}
+	if accountID != order.UserID {
+		return "", "", &orderError{http.StatusNotFound, "Order not found"}
+	}
+	user, err := findAccount(ctx, accountID)
+	if err != nil {
+		return "", "", err
+	}
+	name := user.Name
+	if fields := strings.Fields(name); len(fields) > 0 {
+		name = fields[0]
+	}
+	return chatCustomer, name, nil
+}
+
+// chatEndStatuses are the statuses an order does not leave.
+var chatEndStatuses = []string{"Delivered", "Partially delivered", "Delivery failed", "Returned to sender", "Canceled"}
+
+// chatOpen reports whether messages can still be sent: there is a
+// courier, and the order has not ended more than chatCloseAfter ago. An
+// order ends when it is delivered or on its last failed attempt; one that
+// ended at an unknown time is closed straight away.
+func chatOpen(order Order, now time.Time) bool {
+	if order.CourierEmail == "" {
+		return false
+	}
+	if !containsString(chatEndStatuses, order.Status) {
+		return true
+	}
+
+	var endedAt *time.Time
+	switch {
+	case order.DeliveredAt != nil:
+		endedAt = order.DeliveredAt
+	case len(order.DeliveryAttempts) > 0:
+		endedAt = &order.DeliveryAttempts[len(order.DeliveryAttempts)-1].At
+	default:
+		return false
+	}
+	return now.Before(endedAt.Add(chatCloseAfter))
+}
+
+// loadChat finds the order and caller for a chat request, writing the
+// error response itself when it fails.
+func loadChat(w http.ResponseWriter, r *http.Request) (Order, string, string, bool) {
+	var order Order
+	orderID, err := primitive.ObjectIDFromHex(mux.Vars(r)["orderId"])
+	if err != nil {
+		http.Error(w, "Invalid OrderID format", http.StatusBadRequest)
+		return order, "", "", false
+	}
+
+	err = client.Database("myapp").Collection("orders").FindOne(r.Context(), bson.M{"_id": orderID}).Decode(&order)
+	if err != nil {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return order, "", "", false
+	}
+
+	role, name, err := chatParticipant(r.Context(), r, order)
+	if err != nil {
+		writeAccountError(w, err)
+		return order, "", "", false
+	}
+	return order, role, name, true
+}
+
+func chatMessages(ctx context.Context, orderID primitive.ObjectID, after *primitive.ObjectID) ([]ChatMessage, error) {
+	filter := bson.M{"orderId": orderID}
+	if after != nil {
+		filter["_id"] = bson.M{"$gt": *after}
+	}
+	cursor, err := client.Database("myapp").Collection("chat_messages").Find(ctx, filter, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	messages := []ChatMessage{}
+	if err := cursor.All(ctx, &messages); err != nil {
+		return nil, err
+	}
+	return messages, nil
+}
+
+// GetOrderChat returns the thread, or the messages after the one given,
+// with the other side's masked contact details.
+func GetOrderChat(w http.ResponseWriter, r *http.Request) {
+	order, role, _, ok := loadChat(w, r)
+	if !ok {
+		return
+	}
+
+	var after *primitive.ObjectID
+	if s := r.URL.Query().Get("after"); s != "" {
+		id, err := primitive.ObjectIDFromHex(s)
+		if err != nil {
+			http.Error(w, "Invalid message ID", http.StatusBadRequest)
+			return
+		}
+		after = &id
+	}
+
+	messages, err := chatMessages(r.Context(), order.ID, after)
+	if err != nil {
+		http.Error(w, "Failed to retrieve messages", http.StatusInternalServerError)
+		return
+	}
+
+	contact := map[string]string{}
+	switch role {
+	case chatCustomer:
+		contact["name"] = order.CourierName
+		contact["phone"] = maskPhone(order.CourierPhone)
+	case chatCourier:
+		if user, err := findAccount(r.Context(), order.UserID); err == nil {
+			contact["name"] = user.Name
+			contact["phone"] = maskPhone(user.Phone)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"orderId":  order.ID,
+		"role":     role,
+		"open":     chatOpen(order, time.Now().UTC()),
+		"contact":  contact,
+		"messages": messages,
+	})
+}
+
+func SendOrderChatMessage(w http.ResponseWriter, r *http.Request) {
+	order, role, name, ok := loadChat(w, r)
+	if !ok {
+		return
+	}
+	if !chatOpen(order, time.Now().UTC()) {
+		http.Error(w, "This conversation is closed", http.StatusConflict)
+		return
+	}
+
+	var request struct {
+		Body string `json:"body"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	body := strings.TrimSpace(request.Body)
+	if body == "" || len(body) > maxChatMessage {
+		http.Error(w, fmt.Sprintf("Message must be between 1 and %d characters", maxChatMessage), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().UTC()
+	msg := ChatMessage{
+		ID:         primitive.NewObjectID(),
+		OrderID:    order.ID,
+		SenderRole: role,
+		SenderName: name,
+		Body:       redactContacts(body),
+		CreatedAt:  now,
+		ReadBy:     map[string]time.Time{role: now},
+	}
+	if _, err := client.Database("myapp").Collection("chat_messages").InsertOne(r.Context(), msg); err != nil {
+		http.Error(w, "Failed to send message", http.StatusInternalServerError)
+		return
+	}
+	chats.publish(order.ID, ChatEvent{Type: "message", Message: &msg})
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(msg)
+}
+
+// MarkOrderChatRead records that the caller has read every message so far.
+func MarkOrderChatRead(w http.ResponseWriter, r *http.Request) {
+	order, role, _, ok := loadChat(w, r)
+	if !ok {
+		return
+	}
+
+	now := time.Now().UTC()
+	_, err := client.Database("myapp").Collection("chat_messages").UpdateMany(r.Context(),
+		bson.M{"orderId": order.ID, "readBy." + role: bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"readBy." + role: now}},
+	)
+	if err != nil {
+		http.Error(w, "Failed to mark messages read", http.StatusInternalServerError)
+		return
+	}
+	chats.publish(order.ID, ChatEvent{Type: "read", Role: role, ReadAt: &now})
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode("Messages marked as read")
+}
+
+// StreamOrderChat is a server-sent event stream of the thread. On
+// reconnect, messages after Last-Event-ID are replayed first.
+func StreamOrderChat(w http.ResponseWriter, r *http.Request) {
+	order, _, _, ok := loadChat(w, r)
+	if !ok {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	events, unsubscribe := chats.subscribe(order.ID)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(e ChatEvent) {
+		data, _ := json.Marshal(e)
+		if e.Message != nil {
+			fmt.Fprintf(w, "id: %s\n", e.Message.ID.Hex())
+		}
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+		flusher.Flush()
+	}
+
+	if id, err := primitive.ObjectIDFromHex(r.Header.Get("Last-Event-ID")); err == nil {
+		missed, err := chatMessages(r.Context(), order.ID, &id)
+		if err == nil {
+			for i := range missed {
+				send(ChatEvent{Type: "message", Message: &missed[i]})
+			}
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(25 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-events:
+			send(e)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		}
+	}
+}
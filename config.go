@@ -0,0 +1,17 @@
+package main
+
+import (
+	"os"
+	"strconv"
+)
+
+func envInt(name string, def int) int {
+	if v, err := strconv.Atoi(os.Getenv(name)); err == nil {
+		return v
+	}
+	return def
+}
+
+// developmentMode relaxes checks that get in the way of running against
+// local services, such as webhook receivers on localhost over plain http.
+var developmentMode = os.Getenv("APP_ENV") == "development"
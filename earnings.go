@@ -0,0 +1,465 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type CourierEarning struct {
+	ID           primitive.ObjectID  `bson:"_id,omitempty" json:"id"`
+	CourierID    primitive.ObjectID  `json:"courierId" bson:"courierId"`
+	CourierEmail string              `json:"courierEmail" bson:"courierEmail"`
+	OrderID      primitive.ObjectID  `json:"orderId" bson:"orderId"`
+	DistanceKm   float64             `json:"distanceKm" bson:"distanceKm"`
+	Base         int64               `json:"base" bson:"base"`
+	DistancePay  int64               `json:"distancePay" bson:"distancePay"`
+	Tip          int64               `json:"tip" bson:"tip"`
+	Commission   int64               `json:"commission" bson:"commission"`
+	Total        int64               `json:"total" bson:"total"`
+	DeliveredAt  time.Time           `json:"deliveredAt" bson:"deliveredAt"`
+	PayoutID     *primitive.ObjectID `json:"payoutId,omitempty" bson:"payoutId,omitempty"`
+}
+
+type Payout struct {
+	ID           primitive.ObjectID   `bson:"_id,omitempty" json:"id"`
+	BatchID      primitive.ObjectID   `json:"batchId" bson:"batchId"`
+	CourierID    primitive.ObjectID   `json:"courierId" bson:"courierId"`
+	CourierEmail string               `json:"courierEmail" bson:"courierEmail"`
+	PeriodStart  time.Time            `json:"periodStart" bson:"periodStart"`
+	PeriodEnd    time.Time            `json:"periodEnd" bson:"periodEnd"`
+	EarningIDs   []primitive.ObjectID `json:"earningIds" bson:"earningIds"`
+	Deliveries   int                  `json:"deliveries" bson:"deliveries"`
+	Gross        int64                `json:"gross" bson:"gross"`
+	Tips         int64                `json:"tips" bson:"tips"`
+	Commission   int64                `json:"commission" bson:"commission"`
+	Net          int64                `json:"net" bson:"net"`
+	Status       string               `json:"status" bson:"status"`
+	CreatedAt    time.Time            `json:"createdAt" bson:"createdAt"`
+	PaidAt       *time.Time           `json:"paidAt,omitempty" bson:"paidAt,omitempty"`
+}
+
+type PayoutBatch struct {
+	ID          primitive.ObjectID   `bson:"_id,omitempty" json:"id"`
+	PeriodStart time.Time            `json:"periodStart" bson:"periodStart"`
+	PeriodEnd   time.Time            `json:"periodEnd" bson:"periodEnd"`
+	PayoutIDs   []primitive.ObjectID `json:"payoutIds" bson:"payoutIds"`
+	Total       int64                `json:"total" bson:"total"`
+	CreatedBy   string               `json:"createdBy,omitempty" bson:"createdBy,omitempty"`
+	CreatedAt   time.Time            `json:"createdAt" bson:"createdAt"`
+}
+
+func computeCourierEarning(order Order) CourierEarning {
+	km := orderDistanceKm(order)
+	earning := CourierEarning{
+		OrderID:     order.ID,
+		DistanceKm:  km,
+		Base:        courierBasePay,
+		DistancePay: int64(math.Round(km * float64(courierPayPerKm))),
+		Tip:         order.Tip,
+	}
+	// The courier is never paid more than the customer was charged for the
+	// delivery itself.
+	if order.Price > 0 && earning.Base+earning.DistancePay > order.Price {
+		if earning.Base > order.Price {
+			earning.Base = order.Price
+		}
+		earning.DistancePay = order.Price - earning.Base
+	}
+	earning.Commission = (earning.Base + earning.DistancePay) * courierCommissionBp / 10000
+	earning.Total = earning.Base + earning.DistancePay + earning.Tip - earning.Commission
+	return earning
+}
+
+// recordCourierEarning is idempotent per order, so re-sending "Delivered"
+// does not pay the courier twice.
+func recordCourierEarning(ctx context.Context, order Order) error {
+	var courier Courier
+	err := client.Database("myapp").Collection("couriers").FindOne(ctx, bson.M{"email": order.CourierEmail}).Decode(&courier)
+	if err != nil {
+		return err
+	}
+
+	earning := computeCourierEarning(order)
+	earning.ID = primitive.NewObjectID()
+	earning.CourierID = courier.ID
+	earning.CourierEmail = courier.Email
+	earning.DeliveredAt = time.Now().UTC()
+
+	collection := client.Database("myapp").Collection("courier_earnings")
+	_, err = collection.UpdateOne(ctx,
+		bson.M{"orderId": order.ID},
+		bson.M{"$setOnInsert": earning},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+func findCourierEarnings(ctx context.Context, filter bson.M) ([]CourierEarning, error) {
+	collection := client.Database("myapp").Collection("courier_earnings")
+	cursor, err := collection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "deliveredAt", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	earnings := []CourierEarning{}
+	if err := cursor.All(ctx, &earnings); err != nil {
+		return nil, err
+	}
+	return earnings, nil
+}
+
+func timeRangeFilter(from, to time.Time) bson.M {
+	r := bson.M{}
+	if !from.IsZero() {
+		r["$gte"] = from
+	}
+	if !to.IsZero() {
+		r["$lt"] = to
+	}
+	return r
+}
+
+func GetCourierEarnings(w http.ResponseWriter, r *http.Request) {
+	email := r.URL.Query().Get("email")
+	if email == "" {
+		http.Error(w, "Courier email is required", http.StatusBadRequest)
+		return
+	}
+
+	from, to, err := parseDateRange(r)
+	if err != nil {
+		http.Error(w, "Invalid date range", http.StatusBadRequest)
+		return
+	}
+
+	filter := bson.M{"courierEmail": email}
+	if dr := timeRangeFilter(from, to); len(dr) > 0 {
+		filter["deliveredAt"] = dr
+	}
+
+	earnings, err := findCourierEarnings(context.TODO(), filter)
+	if err != nil {
+		http.Error(w, "Failed to retrieve earnings", http.StatusInternalServerError)
+		return
+	}
+
+	type day struct {
+		Date       string `json:"date"`
+		Deliveries int    `json:"deliveries"`
+		Net        int64  `json:"net"`
+	}
+	var summary struct {
+		Deliveries int              `json:"deliveries"`
+		Gross      int64            `json:"gross"`
+		Tips       int64            `json:"tips"`
+		Commission int64            `json:"commission"`
+		Net        int64            `json:"net"`
+		Unpaid     int64            `json:"unpaid"`
+		Daily      []day            `json:"daily"`
+		Earnings   []CourierEarning `json:"earnings"`
+	}
+	summary.Daily = []day{}
+	summary.Earnings = earnings
+
+	for _, e := range earnings {
+		summary.Deliveries++
+		summary.Gross += e.Base + e.DistancePay
+		summary.Tips += e.Tip
+		summary.Commission += e.Commission
+		summary.Net += e.Total
+		if e.PayoutID == nil {
+			summary.Unpaid += e.Total
+		}
+
+		date := e.DeliveredAt.Format("2006-01-02")
+		if n := len(summary.Daily); n > 0 && summary.Daily[n-1].Date == date {
+			summary.Daily[n-1].Deliveries++
+			summary.Daily[n-1].Net += e.Total
+		} else {
+			summary.Daily = append(summary.Daily, day{Date: date, Deliveries: 1, Net: e.Total})
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
+
+// lastWeekStart returns the Monday 00:00 UTC of the week before now.
+func lastWeekStart(now time.Time) time.Time {
+	now = now.UTC()
+	offset := (int(now.Weekday()) + 6) % 7
+	monday := time.Date(now.Year(), now.Month(), now.Day()-offset, 0, 0, 0, 0, time.UTC)
+	return monday.AddDate(0, 0, -7)
+}
+
+func GeneratePayoutBatch(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		WeekStart string `json:"weekStart"`
+		AdminID   string `json:"adminId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	start := lastWeekStart(time.Now())
+	if request.WeekStart != "" {
+		t, err := time.Parse("2006-01-02", request.WeekStart)
+		if err != nil {
+			http.Error(w, "Invalid weekStart, expected YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+		if t.Weekday() != time.Monday {
+			http.Error(w, "weekStart must be a Monday", http.StatusBadRequest)
+			return
+		}
+		start = t
+	}
+	end := start.AddDate(0, 0, 7)
+
+	ctx := context.TODO()
+	earnings, err := findCourierEarnings(ctx, bson.M{
+		"payoutId":    bson.M{"$exists": false},
+		"deliveredAt": timeRangeFilter(start, end),
+	})
+	if err != nil {
+		http.Error(w, "Failed to retrieve earnings", http.StatusInternalServerError)
+		return
+	}
+
+	batch := PayoutBatch{
+		ID:          primitive.NewObjectID(),
+		PeriodStart: start,
+		PeriodEnd:   end,
+		PayoutIDs:   []primitive.ObjectID{},
+		CreatedBy:   request.AdminID,
+		CreatedAt:   time.Now().UTC(),
+	}
+
+	// Earnings are claimed for a payout before its totals are computed, and
+	// the totals come from what was actually claimed. A concurrent batch
+	// then only ever gets the earnings this one did not claim.
+	var couriers []CourierEarning
+	seen := map[primitive.ObjectID]bool{}
+	for _, e := range earnings {
+		if !seen[e.CourierID] {
+			seen[e.CourierID] = true
+			couriers = append(couriers, e)
+		}
+	}
+
+	payoutCollection := client.Database("myapp").Collection("payouts")
+	earningCollection := client.Database("myapp").Collection("courier_earnings")
+	for _, c := range couriers {
+		p := Payout{
+			ID:           primitive.NewObjectID(),
+			BatchID:      batch.ID,
+			CourierID:    c.CourierID,
+			CourierEmail: c.CourierEmail,
+			PeriodStart:  start,
+			PeriodEnd:    end,
+			Status:       "Pending",
+			CreatedAt:    batch.CreatedAt,
+		}
+
+		_, err := earningCollection.UpdateMany(ctx,
+			bson.M{
+				"courierId":   c.CourierID,
+				"payoutId":    bson.M{"$exists": false},
+				"deliveredAt": timeRangeFilter(start, end),
+			},
+			bson.M{"$set": bson.M{"payoutId": p.ID}},
+		)
+		if err != nil {
+			http.Error(w, "Failed to claim earnings for payout", http.StatusInternalServerError)
+			return
+		}
+		claimed, err := findCourierEarnings(ctx, bson.M{"payoutId": p.ID})
+		if err != nil {
+			http.Error(w, "Failed to retrieve claimed earnings", http.StatusInternalServerError)
+			return
+		}
+		if len(claimed) == 0 {
+			continue
+		}
+
+		for _, e := range claimed {
+			p.EarningIDs = append(p.EarningIDs, e.ID)
+			p.Deliveries++
+			p.Gross += e.Base + e.DistancePay
+			p.Tips += e.Tip
+			p.Commission += e.Commission
+			p.Net += e.Total
+		}
+
+		if _, err := payoutCollection.InsertOne(ctx, p); err != nil {
+			earningCollection.UpdateMany(ctx, bson.M{"payoutId": p.ID}, bson.M{"$unset": bson.M{"payoutId": ""}})
+			http.Error(w, "Failed to create payout", http.StatusInternalServerError)
+			return
+		}
+		batch.PayoutIDs = append(batch.PayoutIDs, p.ID)
+		batch.Total += p.Net
+	}
+
+	if _, err := client.Database("myapp").Collection("payout_batches").InsertOne(ctx, batch); err != nil {
+		http.Error(w, "Failed to create payout batch", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(batch)
+}
+
+func findPayouts(ctx context.Context, filter bson.M) ([]Payout, error) {
+	collection := client.Database("myapp").Collection("payouts")
+	cursor, err := collection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "periodStart", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	payouts := []Payout{}
+	if err := cursor.All(ctx, &payouts); err != nil {
+		return nil, err
+	}
+	return payouts, nil
+}
+
+func GetPayouts(w http.ResponseWriter, r *http.Request) {
+	filter := bson.M{}
+	if status := r.URL.Query().Get("status"); status != "" {
+		filter["status"] = status
+	}
+	if email := r.URL.Query().Get("email"); email != "" {
+		filter["courierEmail"] = email
+	}
+
+	payouts, err := findPayouts(context.TODO(), filter)
+	if err != nil {
+		http.Error(w, "Failed to retrieve payouts", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(payouts)
+}
+
+func GetCourierPayouts(w http.ResponseWriter, r *http.Request) {
+	email := r.URL.Query().Get("email")
+	if email == "" {
+		http.Error(w, "Courier email is required", http.StatusBadRequest)
+		return
+	}
+
+	payouts, err := findPayouts(context.TODO(), bson.M{"courierEmail": email})
+	if err != nil {
+		http.Error(w, "Failed to retrieve payouts", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(payouts)
+}
+
+func MarkPayoutPaid(w http.ResponseWriter, r *http.Request) {
+	payoutID, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid PayoutID format", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now().UTC()
+	result, err := client.Database("myapp").Collection("payouts").UpdateOne(context.TODO(),
+		bson.M{"_id": payoutID, "status": "Pending"},
+		bson.M{"$set": bson.M{"status": "Paid", "paidAt": now}},
+	)
+	if err != nil {
+		http.Error(w, "Failed to update payout", http.StatusInternalServerError)
+		return
+	}
+	if result.MatchedCount == 0 {
+		http.Error(w, "Payout not found or already paid", http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode("Payout marked as paid")
+}
+
+func GetPayoutStatement(w http.ResponseWriter, r *http.Request) {
+	writePayoutStatement(w, r, "")
+}
+
+func GetCourierPayoutStatement(w http.ResponseWriter, r *http.Request) {
+	email := r.URL.Query().Get("email")
+	if email == "" {
+		http.Error(w, "Courier email is required", http.StatusBadRequest)
+		return
+	}
+	writePayoutStatement(w, r, email)
+}
+
+// writePayoutStatement restricts the statement to courierEmail when it is
+// not empty.
+func writePayoutStatement(w http.ResponseWriter, r *http.Request, courierEmail string) {
+	payoutID, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid PayoutID format", http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.TODO()
+	var payout Payout
+	err = client.Database("myapp").Collection("payouts").FindOne(ctx, bson.M{"_id": payoutID}).Decode(&payout)
+	if err != nil || (courierEmail != "" && payout.CourierEmail != courierEmail) {
+		http.Error(w, "Payout not found", http.StatusNotFound)
+		return
+	}
+
+	earnings, err := findCourierEarnings(ctx, bson.M{"payoutId": payout.ID})
+	if err != nil {
+		http.Error(w, "Failed to retrieve earnings", http.StatusInternalServerError)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=payout-%s.csv", payout.ID.Hex()))
+
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"orderId", "deliveredAt", "distanceKm", "base", "distancePay", "tip", "commission", "total"})
+		for _, e := range earnings {
+			cw.Write([]string{
+				e.OrderID.Hex(),
+				e.DeliveredAt.Format(time.RFC3339),
+				strconv.FormatFloat(e.DistanceKm, 'f', 2, 64),
+				strconv.FormatInt(e.Base, 10),
+				strconv.FormatInt(e.DistancePay, 10),
+				strconv.FormatInt(e.Tip, 10),
+				strconv.FormatInt(e.Commission, 10),
+				strconv.FormatInt(e.Total, 10),
+			})
+		}
+		cw.Write([]string{"TOTAL", "", "", "", "", strconv.FormatInt(payout.Tips, 10), strconv.FormatInt(payout.Commission, 10), strconv.FormatInt(payout.Net, 10)})
+		cw.Flush()
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"payout":   payout,
+		"earnings": earnings,
+	})
+}
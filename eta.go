@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	// dispatchAllowance is how long an unassigned order is expected to wait
+	// for a courier to reach the pickup.
+	dispatchAllowance = time.Duration(envInt("DISPATCH_ALLOWANCE_MINUTES", 20)) * time.Minute
+
+	// locationMaxAge is how old a courier's last position may be before ETAs
+	// stop starting from it.
+	locationMaxAge = time.Duration(envInt("LOCATION_MAX_AGE_MINUTES", 15)) * time.Minute
+)
+
+const (
+	speedSampleSize = 20
+	minSpeedSamples = 3
+
+	etaBasisCourier  = "courier_location"
+	etaBasisRoute    = "route"
+	etaBasisEstimate = "estimate"
+)
+
+// etaStatuses are the order statuses that still have a pickup or delivery
+// ahead of them.
+var etaStatuses = bson.A{"Scheduled", "Pending", "Pending Acceptance", "Accepted", "Picked up", "In transit", "Reattempt scheduled"}
+
+type OrderETA struct {
+	Pickup     *time.Time `json:"pickup,omitempty" bson:"pickup,omitempty"`
+	Delivery   *time.Time `json:"delivery,omitempty" bson:"delivery,omitempty"`
+	SpeedKmh   float64    `json:"speedKmh" bson:"speedKmh"`
+	Basis      string     `json:"basis" bson:"basis"`
+	ComputedAt time.Time  `json:"computedAt" bson:"computedAt"`
+}
+
+// courierPosition returns the courier's last reported position if it is
+// recent enough to route from.
+func courierPosition(courier Courier, now time.Time) *GeoPoint {
+	if courier.Location == nil || courier.LocationUpdatedAt == nil || now.Sub(*courier.LocationUpdatedAt) > locationMaxAge {
+		return nil
+	}
+	return courier.Location
+}
+
+// courierHistoricalSpeed averages the courier's pickup-to-delivery speed over
+// recent deliveries, falling back to courierSpeedKmh without enough history.
+func courierHistoricalSpeed(ctx context.Context, email string) float64 {
+	if email == "" {
+		return courierSpeedKmh
+	}
+
+	opts := options.Find().SetSort(bson.M{"deliveredAt": -1}).SetLimit(speedSampleSize)
+	cursor, err := client.Database("myapp").Collection("orders").Find(ctx, bson.M{
+		"courierEmail": email,
+		"status":       "Delivered",
+		"pickedUpAt":   bson.M{"$exists": true},
+		"deliveredAt":  bson.M{"$exists": true},
+	}, opts)
+	if err != nil {
+		return courierSpeedKmh
+	}
+	defer cursor.Close(ctx)
+
+	var orders []Order
+	if err := cursor.All(ctx, &orders); err != nil {
+		return courierSpeedKmh
+	}
+
+	var km, hours float64
+	samples := 0
+	for _, o := range orders {
+		d := orderDistanceKm(o)
+		h := o.DeliveredAt.Sub(*o.PickedUpAt).Hours()
+		if d <= 0 || h <= 0 {
+			continue
+		}
+		km += d
+		hours += h
+		samples++
+	}
+	if samples < minSpeedSamples {
+		return courierSpeedKmh
+	}
+
+	speed := km / hours
+	if speed < courierSpeedKmh/5 || speed > courierSpeedKmh*5 {
+		return courierSpeedKmh
+	}
+	return speed
+}
+
+type courierRoute struct {
+	plan  RoutePlan
+	basis string
+}
+
+// etaEstimator computes ETAs for several orders at once, planning each
+// courier's route only once.
+type etaEstimator struct {
+	now    time.Time
+	routes map[string]*courierRoute
+}
+
+func newETAEstimator(now time.Time) *etaEstimator {
+	return &etaEstimator{now: now, routes: map[string]*courierRoute{}}
+}
+
+func (e *etaEstimator) route(ctx context.Context, order Order) (*courierRoute, error) {
+	if r, ok := e.routes[order.CourierEmail]; ok {
+		return r, nil
+	}
+
+	var courier Courier
+	err := client.Database("myapp").Collection("couriers").FindOne(ctx, bson.M{"email": order.CourierEmail}).Decode(&courier)
+	if err != nil {
+		return nil, err
+	}
+
+	cursor, err := client.Database("myapp").Collection("orders").Find(ctx, bson.M{
+		"courierEmail": order.CourierEmail,
+		"status":       bson.M{"$in": activeCourierStatuses},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var orders []Order
+	if err := cursor.All(ctx, &orders); err != nil {
+		return nil, err
+	}
+
+	r := &courierRoute{basis: etaBasisRoute}
+	start := courierPosition(courier, e.now)
+	if start != nil {
+		r.basis = etaBasisCourier
+	}
+	r.plan = planCourierRoute(orders, start, e.now, courierHistoricalSpeed(ctx, order.CourierEmail))
+	e.routes[order.CourierEmail] = r
+	return r, nil
+}
+
+// estimate returns the expected pickup and delivery times of order, or nil
+// when the order has nothing left to do. Orders with a courier are placed on
+// the courier's planned route; others get a rough estimate from the
+// dispatch allowance and the default speed.
+func (e *etaEstimator) estimate(ctx context.Context, order Order) (*OrderETA, error) {
+	if !containsStatus(etaStatuses, order.Status) {
+		return nil, nil
+	}
+
+	if order.CourierEmail != "" && order.Status != "Reattempt scheduled" {
+		r, err := e.route(ctx, order)
+		if err != nil {
+			return nil, err
+		}
+		eta := &OrderETA{SpeedKmh: r.plan.SpeedKmh, Basis: r.basis, ComputedAt: e.now}
+		found := false
+		for _, s := range r.plan.Stops {
+			if s.OrderID != order.ID {
+				continue
+			}
+			found = true
+			at := s.ETA
+			if s.Kind == stopPickup && (eta.Pickup == nil || at.Before(*eta.Pickup)) {
+				eta.Pickup = &at
+			}
+			if s.Kind == stopDropOff && (eta.Delivery == nil || at.After(*eta.Delivery)) {
+				eta.Delivery = &at
+			}
+		}
+		if found {
+			return eta, nil
+		}
+	}
+
+	eta := &OrderETA{SpeedKmh: courierSpeedKmh, Basis: etaBasisEstimate, ComputedAt: e.now}
+	start := e.now
+	if order.Status == "Reattempt scheduled" && order.NextAttemptAt != nil && order.NextAttemptAt.After(start) {
+		start = *order.NextAttemptAt
+	}
+	if !pickedUp(order) && order.Status != "Reattempt scheduled" {
+		pickup := start.Add(dispatchAllowance)
+		if order.PickupWindow != nil && pickup.Before(order.PickupWindow.Earliest) {
+			pickup = order.PickupWindow.Earliest
+		}
+		eta.Pickup = &pickup
+		start = pickup.Add(stopServiceTime)
+	}
+	delivery := start.Add(travelTime(order))
+	if order.DeliveryWindow != nil && delivery.Before(order.DeliveryWindow.Earliest) {
+		delivery = order.DeliveryWindow.Earliest
+	}
+	eta.Delivery = &delivery
+	return eta, nil
+}
+
+func containsStatus(statuses bson.A, status string) bool {
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// UpdateCourierLocation records the courier's current position, used to
+// start ETAs and routes from where the courier actually is.
+func UpdateCourierLocation(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Email string  `json:"email"`
+		Lat   float64 `json:"lat"`
+		Lng   float64 `json:"lng"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if request.Lat < -90 || request.Lat > 90 || request.Lng < -180 || request.Lng > 180 {
+		http.Error(w, "Invalid lat/lng", http.StatusBadRequest)
+		return
+	}
+
+	pos := GeoPoint{Lat: request.Lat, Lng: request.Lng}
+	now := time.Now().UTC()
+	result, err := client.Database("myapp").Collection("couriers").UpdateOne(context.TODO(),
+		bson.M{"email": request.Email},
+		bson.M{"$set": bson.M{
+			"location":          pos,
+			"locationUpdatedAt": now,
+		}},
+	)
+	if err != nil {
+		http.Error(w, "Failed to update location", http.StatusInternalServerError)
+		return
+	}
+	if result.MatchedCount == 0 {
+		http.Error(w, "Courier not found", http.StatusNotFound)
+		return
+	}
+
+	if err := processGeofences(context.TODO(), request.Email, pos, now); err != nil {
+		log.Println("Failed to process geofences:", err)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode("Location updated successfully")
+}
@@ -0,0 +1,676 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	exportQueued    = "queued"
+	exportRunning   = "running"
+	exportCompleted = "completed"
+	exportFailed    = "failed"
+)
+
+// maxStreamedExportRows caps downloads served straight from a request.
+// Larger ranges have to be exported as a background job.
+var maxStreamedExportRows = int64(envInt("EXPORT_STREAM_MAX_ROWS", 100000))
+
+// exportRetention is how long a finished job and its file are kept.
+var exportRetention = time.Duration(envInt("EXPORT_RETENTION_HOURS", 24)) * time.Hour
+
+// exportColumns are the order fields an export can include. Values are
+// strings, int64s, float64s, times or nil.
+var exportColumns = map[string]func(o Order) interface{}{
+	"id":              func(o Order) interface{} { return o.ID.Hex() },
+	"createdAt":       func(o Order) interface{} { return o.ID.Timestamp().UTC() },
+	"status":          func(o Order) interface{} { return o.Status },
+	"userId":          func(o Order) interface{} { return o.UserID.Hex() },
+	"merchantId":      func(o Order) interface{} { return optionalID(o.MerchantID) },
+	"pickupLocation":  func(o Order) interface{} { return o.PickupLocation },
+	"dropOffLocation": func(o Order) interface{} { return o.DropOffLocation },
+	"packageDetails":  func(o Order) interface{} { return o.PackageDetails },
+	"deliveryTime":    func(o Order) interface{} { return o.DeliveryTime },
+	"courierEmail":    func(o Order) interface{} { return o.CourierEmail },
+	"courierName":     func(o Order) interface{} { return o.CourierName },
+	"price":           func(o Order) interface{} { return o.Price },
+	"tip":             func(o Order) interface{} { return o.Tip },
+	"paymentMethod":   func(o Order) interface{} { return o.PaymentMethod },
+	"stops":           func(o Order) interface{} { return int64(len(o.Stops)) },
+	"zoneId":          func(o Order) interface{} { return optionalID(o.ZoneID) },
+	"pickedUpAt":      func(o Order) interface{} { return optionalTime(o.PickedUpAt) },
+	"deliveredAt":     func(o Order) interface{} { return optionalTime(o.DeliveredAt) },
+}
+
+var defaultExportColumns = []string{
+	"id", "createdAt", "status", "userId", "pickupLocation", "dropOffLocation",
+	"courierEmail", "price", "tip", "deliveredAt",
+}
+
+func optionalID(id *primitive.ObjectID) interface{} {
+	if id == nil {
+		return nil
+	}
+	return id.Hex()
+}
+
+func optionalTime(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return *t
+}
+
+// exportText renders a column value for the text based formats.
+func exportText(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case time.Time:
+		return v.Format(time.RFC3339)
+	}
+	return fmt.Sprint(v)
+}
+
+// spreadsheetText renders a value for the spreadsheet formats. Text that a
+// spreadsheet would take for a formula, such as a package description of
+// "=HYPERLINK(...)", is prefixed with an apostrophe so it stays text.
+func spreadsheetText(v interface{}) string {
+	text := exportText(v)
+	if _, ok := v.(string); ok && text != "" && strings.ContainsRune("=+-@\t\r", rune(text[0])) {
+		return "'" + text
+	}
+	return text
+}
+
+// parseDay accepts RFC 3339 times and plain dates. A plain date used as an
+// upper bound includes the whole day.
+func parseDay(s string, end bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", s)
+	if err == nil && end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, err
+}
+
+// orderListFilter builds the filter shared by order listings and exports
+// from the query: from and to on creation time, status (comma separated),
+// courier (email) and customer (user id).
+func orderListFilter(q url.Values) (bson.M, error) {
+	filter := bson.M{}
+
+	created := bson.M{}
+	if s := q.Get("from"); s != "" {
+		t, err := parseDay(s, false)
+		if err != nil {
+			return nil, fmt.Errorf("invalid from")
+		}
+		created["$gte"] = primitive.NewObjectIDFromTimestamp(t)
+	}
+	if s := q.Get("to"); s != "" {
+		t, err := parseDay(s, true)
+		if err != nil {
+			return nil, fmt.Errorf("invalid to")
+		}
+		created["$lt"] = primitive.NewObjectIDFromTimestamp(t)
+	}
+	if len(created) > 0 {
+		filter["_id"] = created
+	}
+
+	if s := q.Get("status"); s != "" {
+		filter["status"] = bson.M{"$in": strings.Split(s, ",")}
+	}
+	if s := q.Get("courier"); s != "" {
+		filter["courierEmail"] = s
+	}
+	if s := q.Get("customer"); s != "" {
+		userID, err := primitive.ObjectIDFromHex(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid customer")
+		}
+		filter["userId"] = userID
+	}
+	return filter, nil
+}
+
+func exportColumnList(s string) ([]string, error) {
+	if s == "" {
+		return defaultExportColumns, nil
+	}
+	columns := strings.Split(s, ",")
+	for _, c := range columns {
+		if _, ok := exportColumns[c]; !ok {
+			return nil, fmt.Errorf("unknown column %q", c)
+		}
+	}
+	return columns, nil
+}
+
+// exportWriter writes one row of column values at a time. Close must be
+// called to complete the file.
+type exportWriter interface {
+	Write(values []interface{}) error
+	Close() error
+}
+
+var exportFormats = map[string]struct {
+	ContentType string
+	Extension   string
+}{
+	"csv":    {"text/csv", "csv"},
+	"xlsx":   {"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", "xlsx"},
+	"ndjson": {"application/x-ndjson", "ndjson"},
+}
+
+func newExportWriter(format string, w io.Writer, columns []string) (exportWriter, error) {
+	header := make([]interface{}, len(columns))
+	for i, c := range columns {
+		header[i] = c
+	}
+
+	switch format {
+	case "csv":
+		cw := &csvExportWriter{w: csv.NewWriter(w)}
+		return cw, cw.Write(header)
+	case "xlsx":
+		xw, err := newXLSXWriter(w)
+		if err != nil {
+			return nil, err
+		}
+		return xw, xw.Write(header)
+	case "ndjson":
+		return &ndjsonExportWriter{enc: json.NewEncoder(w), columns: columns}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q", format)
+}
+
+type csvExportWriter struct {
+	w *csv.Writer
+}
+
+func (cw *csvExportWriter) Write(values []interface{}) error {
+	record := make([]string, len(values))
+	for i, v := range values {
+		record[i] = spreadsheetText(v)
+	}
+	return cw.w.Write(record)
+}
+
+func (cw *csvExportWriter) Close() error {
+	cw.w.Flush()
+	return cw.w.Error()
+}
+
+type ndjsonExportWriter struct {
+	enc     *json.Encoder
+	columns []string
+}
+
+func (nw *ndjsonExportWriter) Write(values []interface{}) error {
+	record := make(map[string]interface{}, len(values))
+	for i, v := range values {
+		record[nw.columns[i]] = v
+	}
+	return nw.enc.Encode(record)
+}
+
+func (nw *ndjsonExportWriter) Close() error { return nil }
+
+// xlsxWriter streams a single sheet workbook. Strings are written inline
+// so no shared string table has to be held until the end.
+type xlsxWriter struct {
+	zw    *zip.Writer
+	sheet io.Writer
+	rows  int
+}
+
+var xlsxParts = []struct{ Name, Body string }{
+	{"[Content_Types].xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/></Types>`},
+	{"_rels/.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`},
+	{"xl/workbook.xml", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="Orders" sheetId="1" r:id="rId1"/></sheets></workbook>`},
+	{"xl/_rels/workbook.xml.rels", `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/></Relationships>`},
+}
+
+func newXLSXWriter(w io.Writer) (*xlsxWriter, error) {
+	zw := zip.NewWriter(w)
+	for _, part := range xlsxParts {
+		f, err := zw.Create(part.Name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(f, part.Body); err != nil {
+			return nil, err
+		}
+	}
+
+	sheet, err := zw.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.WriteString(sheet, `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	return &xlsxWriter{zw: zw, sheet: sheet}, err
+}
+
+func (xw *xlsxWriter) Write(values []interface{}) error {
+	xw.rows++
+	var b strings.Builder
+	fmt.Fprintf(&b, `<row r="%d">`, xw.rows)
+	for _, v := range values {
+		switch v := v.(type) {
+		case nil:
+			b.WriteString(`<c/>`)
+		case int64, float64:
+			fmt.Fprintf(&b, `<c><v>%s</v></c>`, exportText(v))
+		default:
+			b.WriteString(`<c t="inlineStr"><is><t xml:space="preserve">`)
+			xml.EscapeText(&b, []byte(spreadsheetText(v)))
+			b.WriteString(`</t></is></c>`)
+		}
+	}
+	b.WriteString(`</row>`)
+	_, err := io.WriteString(xw.sheet, b.String())
+	return err
+}
+
+func (xw *xlsxWriter) Close() error {
+	if _, err := io.WriteString(xw.sheet, `</sheetData></worksheet>`); err != nil {
+		return err
+	}
+	return xw.zw.Close()
+}
+
+// writeOrderExport streams the orders matching filter, oldest first, and
+// returns how many were written.
+func writeOrderExport(ctx context.Context, w io.Writer, format string, columns []string, filter bson.M) (int64, error) {
+	cursor, err := client.Database("myapp").Collection("orders").Find(ctx, filter, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	ew, err := newExportWriter(format, w, columns)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int64
+	values := make([]interface{}, len(columns))
+	for cursor.Next(ctx) {
+		var order Order
+		if err := cursor.Decode(&order); err != nil {
+			return n, err
+		}
+		for i, c := range columns {
+			values[i] = exportColumns[c](order)
+		}
+		if err := ew.Write(values); err != nil {
+			return n, err
+		}
+		n++
+	}
+	if err := cursor.Err(); err != nil {
+		return n, err
+	}
+	return n, ew.Close()
+}
+
+// exportRequest reads the format, columns and filter of an export. owner
+// restricts it to one account's orders; admins pass nil.
+func exportRequest(q url.Values, owner *primitive.ObjectID) (format string, columns []string, filter bson.M, err error) {
+	format = q.Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if _, ok := exportFormats[format]; !ok {
+		return "", nil, nil, fmt.Errorf("format must be csv, xlsx or ndjson")
+	}
+	if columns, err = exportColumnList(q.Get("columns")); err != nil {
+		return "", nil, nil, err
+	}
+	if filter, err = orderListFilter(q); err != nil {
+		return "", nil, nil, err
+	}
+	if owner != nil {
+		filter["userId"] = *owner
+	}
+	return format, columns, filter, nil
+}
+
+func exportOrders(w http.ResponseWriter, r *http.Request, owner *primitive.ObjectID) {
+	format, columns, filter, err := exportRequest(r.URL.Query(), owner)
+	if err != nil {
+		http.Error(w, "Invalid export: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	n, err := client.Database("myapp").Collection("orders").CountDocuments(ctx, filter)
+	if err != nil {
+		http.Error(w, "Failed to count orders", http.StatusInternalServerError)
+		return
+	}
+	if n > maxStreamedExportRows {
+		http.Error(w, fmt.Sprintf("%d orders match; create an export job for more than %d", n, maxStreamedExportRows), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	f := exportFormats[format]
+	w.Header().Set("Content-Type", f.ContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=orders-%s.%s", time.Now().UTC().Format("20060102-150405"), f.Extension))
+
+	// Once streaming has started the status can no longer change, so a
+	// failure leaves the download truncated.
+	if _, err := writeOrderExport(ctx, w, format, columns, filter); err != nil {
+		log.Println("Failed to export orders:", err)
+	}
+}
+
+func ExportOrders(w http.ResponseWriter, r *http.Request) {
+	accountID, _, err := requestAccount(r.Context(), r, scopeOrdersRead)
+	if err != nil {
+		writeAccountError(w, err)
+		return
+	}
+	exportOrders(w, r, &accountID)
+}
+
+func ExportAllOrders(w http.ResponseWriter, r *http.Request) {
+	exportOrders(w, r, nil)
+}
+
+// ExportJob is an export generated in the background and kept in the blob
+// store for exportRetention, after which sweepExports deletes the file and
+// the job. The request's query is kept rather than the
+// filter, since stored documents cannot have operator keys.
+type ExportJob struct {
+	ID         primitive.ObjectID  `json:"id" bson:"_id"`
+	AccountID  *primitive.ObjectID `json:"accountId,omitempty" bson:"accountId,omitempty"`
+	Format     string              `json:"format" bson:"format"`
+	Columns    []string            `json:"columns" bson:"columns"`
+	Query      string              `json:"query" bson:"query"`
+	Status     string              `json:"status" bson:"status"`
+	Error      string              `json:"error,omitempty" bson:"error,omitempty"`
+	Rows       int64               `json:"rows" bson:"rows"`
+	BlobKey    string              `json:"-" bson:"blobKey,omitempty"`
+	CreatedAt  time.Time           `json:"createdAt" bson:"createdAt"`
+	FinishedAt *time.Time          `json:"finishedAt,omitempty" bson:"finishedAt,omitempty"`
+	LeaseUntil time.Time           `json:"-" bson:"leaseUntil"`
+}
+
+func (job ExportJob) downloadPath() string {
+	if job.AccountID != nil {
+		return "/api/orders/exports/" + job.ID.Hex() + "/download"
+	}
+	return "/api/admin/exports/" + job.ID.Hex() + "/download"
+}
+
+func createExportJob(w http.ResponseWriter, r *http.Request, owner *primitive.ObjectID) {
+	format, columns, _, err := exportRequest(r.URL.Query(), owner)
+	if err != nil {
+		http.Error(w, "Invalid export: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	job := ExportJob{
+		ID:        primitive.NewObjectID(),
+		AccountID: owner,
+		Format:    format,
+		Columns:   columns,
+		Query:     r.URL.RawQuery,
+		Status:    exportQueued,
+		CreatedAt: time.Now().UTC(),
+	}
+	if _, err := client.Database("myapp").Collection("export_jobs").InsertOne(r.Context(), job); err != nil {
+		http.Error(w, "Failed to queue export", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+func findExportJob(w http.ResponseWriter, r *http.Request, owner *primitive.ObjectID) (ExportJob, bool) {
+	var job ExportJob
+	jobID, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid JobID format", http.StatusBadRequest)
+		return job, false
+	}
+
+	filter := bson.M{"_id": jobID}
+	if owner != nil {
+		filter["accountId"] = *owner
+	}
+	err = client.Database("myapp").Collection("export_jobs").FindOne(r.Context(), filter).Decode(&job)
+	if err != nil {
+		http.Error(w, "Export not found", http.StatusNotFound)
+		return job, false
+	}
+	return job, true
+}
+
+func getExportJob(w http.ResponseWriter, r *http.Request, owner *primitive.ObjectID) {
+	job, ok := findExportJob(w, r, owner)
+	if !ok {
+		return
+	}
+
+	response := map[string]interface{}{"job": job}
+	if job.Status == exportCompleted {
+		response["downloadUrl"] = job.downloadPath()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func downloadExport(w http.ResponseWriter, r *http.Request, owner *primitive.ObjectID) {
+	job, ok := findExportJob(w, r, owner)
+	if !ok {
+		return
+	}
+	if job.Status != exportCompleted {
+		http.Error(w, "Export is not ready", http.StatusConflict)
+		return
+	}
+
+	body, _, err := blobs.Get(r.Context(), job.BlobKey)
+	if err == errBlobNotFound {
+		http.Error(w, "Export not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to read export", http.StatusInternalServerError)
+		return
+	}
+	defer body.Close()
+
+	f := exportFormats[job.Format]
+	w.Header().Set("Content-Type", f.ContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=orders-%s.%s", job.ID.Hex(), f.Extension))
+	io.Copy(w, body)
+}
+
+func CreateOrderExportJob(w http.ResponseWriter, r *http.Request) {
+	accountID, _, err := requestAccount(r.Context(), r, scopeOrdersRead)
+	if err != nil {
+		writeAccountError(w, err)
+		return
+	}
+	createExportJob(w, r, &accountID)
+}
+
+func GetOrderExportJob(w http.ResponseWriter, r *http.Request) {
+	accountID, _, err := requestAccount(r.Context(), r, scopeOrdersRead)
+	if err != nil {
+		writeAccountError(w, err)
+		return
+	}
+	getExportJob(w, r, &accountID)
+}
+
+func DownloadOrderExport(w http.ResponseWriter, r *http.Request) {
+	accountID, _, err := requestAccount(r.Context(), r, scopeOrdersRead)
+	if err != nil {
+		writeAccountError(w, err)
+		return
+	}
+	downloadExport(w, r, &accountID)
+}
+
+func CreateAdminExportJob(w http.ResponseWriter, r *http.Request) { createExportJob(w, r, nil) }
+func GetAdminExportJob(w http.ResponseWriter, r *http.Request)    { getExportJob(w, r, nil) }
+func DownloadAdminExport(w http.ResponseWriter, r *http.Request)  { downloadExport(w, r, nil) }
+
+func claimExportJob(ctx context.Context, now time.Time) (*ExportJob, error) {
+	var job ExportJob
+	err := client.Database("myapp").Collection("export_jobs").FindOneAndUpdate(ctx,
+		bson.M{
+			"status":     bson.M{"$in": bson.A{exportQueued, exportRunning}},
+			"leaseUntil": bson.M{"$lte": now},
+		},
+		bson.M{"$set": bson.M{"status": exportRunning, "leaseUntil": now.Add(30 * time.Minute)}},
+		options.FindOneAndUpdate().SetSort(bson.M{"createdAt": 1}).SetReturnDocument(options.After),
+	).Decode(&job)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// generateExport writes the export to a temporary file first, so the
+// database cursor is not held open while the blob store is slow.
+func generateExport(ctx context.Context, job *ExportJob) (string, int64, error) {
+	q, err := url.ParseQuery(job.Query)
+	if err != nil {
+		return "", 0, err
+	}
+	_, _, filter, err := exportRequest(q, job.AccountID)
+	if err != nil {
+		return "", 0, err
+	}
+
+	tmp, err := os.CreateTemp("", "export-*")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	n, err := writeOrderExport(ctx, tmp, job.Format, job.Columns, filter)
+	if err != nil {
+		return "", n, err
+	}
+
+	info, err := tmp.Stat()
+	if err != nil {
+		return "", n, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return "", n, err
+	}
+	f := exportFormats[job.Format]
+	key := fmt.Sprintf("exports/%s.%s", job.ID.Hex(), f.Extension)
+	return key, n, blobs.Put(ctx, key, tmp, info.Size(), f.ContentType)
+}
+
+func processExportJob(ctx context.Context, job *ExportJob) error {
+	key, n, err := generateExport(ctx, job)
+
+	set := bson.M{"status": exportCompleted, "rows": n, "blobKey": key, "finishedAt": time.Now().UTC()}
+	if err != nil {
+		log.Println("Failed to generate export:", err)
+		set = bson.M{"status": exportFailed, "error": "Failed to generate export", "finishedAt": time.Now().UTC()}
+	}
+	_, err = client.Database("myapp").Collection("export_jobs").UpdateOne(ctx, bson.M{"_id": job.ID}, bson.M{"$set": set})
+	return err
+}
+
+// sweepExports deletes jobs that finished more than exportRetention ago,
+// the file before the job, so a failed delete is retried on the next sweep.
+func sweepExports(ctx context.Context, now time.Time) error {
+	jobs := client.Database("myapp").Collection("export_jobs")
+	cursor, err := jobs.Find(ctx, bson.M{
+		"status":     bson.M{"$in": bson.A{exportCompleted, exportFailed}},
+		"finishedAt": bson.M{"$lt": now.Add(-exportRetention)},
+	})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	var expired []ExportJob
+	if err := cursor.All(ctx, &expired); err != nil {
+		return err
+	}
+	for _, job := range expired {
+		if job.BlobKey != "" {
+			if err := blobs.Delete(ctx, job.BlobKey); err != nil {
+				return err
+			}
+		}
+		if _, err := jobs.DeleteOne(ctx, bson.M{"_id": job.ID}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runExportWorker(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := sweepExports(context.TODO(), time.Now().UTC()); err != nil {
+			log.Println("Failed to sweep expired exports:", err)
+		}
+		for {
+			job, err := claimExportJob(context.TODO(), time.Now().UTC())
+			if err != nil {
+				log.Println("Failed to claim export job:", err)
+				break
+			}
+			if job == nil {
+				break
+			}
+			if err := processExportJob(context.TODO(), job); err != nil {
+				log.Println("Failed to record export job:", err)
+			}
+		}
+	}
+}
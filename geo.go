@@ -0,0 +1,43 @@
+package main
+
+import "math"
+
+type GeoPoint struct {
+	Lat float64 `json:"lat" bson:"lat"`
+	Lng float64 `json:"lng" bson:"lng"`
+}
+
+const earthRadiusKm = 6371.0
+
+func haversineKm(a, b GeoPoint) float64 {
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+
+	dLat := toRad(b.Lat - a.Lat)
+	dLng := toRad(b.Lng - a.Lng)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(a.Lat))*math.Cos(toRad(b.Lat))*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(h))
+}
+
+// orderDistanceKm is zero when the order was created without coordinates.
+// Multi-stop orders sum the legs between consecutive stops that have them.
+func orderDistanceKm(order Order) float64 {
+	if len(order.Stops) > 0 {
+		var km float64
+		var prev *GeoPoint
+		for _, s := range order.Stops {
+			if s.Coordinates == nil {
+				continue
+			}
+			if prev != nil {
+				km += haversineKm(*prev, *s.Coordinates)
+			}
+			prev = s.Coordinates
+		}
+		return km
+	}
+	if order.PickupCoordinates == nil || order.DropOffCoordinates == nil {
+		return 0
+	}
+	return haversineKm(*order.PickupCoordinates, *order.DropOffCoordinates)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var geofenceRadiusKm = float64(envInt("GEOFENCE_RADIUS_METERS", 150)) / 1000
+
+const (
+	geofenceEnter = "enter"
+	geofenceExit  = "exit"
+)
+
+// GeofenceEvent records a tracked courier entering or leaving the area
+// around one of an order's pickup or drop-off points.
+type GeofenceEvent struct {
+	ID           primitive.ObjectID  `json:"id" bson:"_id,omitempty"`
+	OrderID      primitive.ObjectID  `json:"orderId" bson:"orderId"`
+	StopID       *primitive.ObjectID `json:"stopId,omitempty" bson:"stopId,omitempty"`
+	Target       string              `json:"target" bson:"target"`
+	Event        string              `json:"event" bson:"event"`
+	CourierEmail string              `json:"courierEmail" bson:"courierEmail"`
+	Position     GeoPoint            `json:"position" bson:"position"`
+	At           time.Time           `json:"at" bson:"at"`
+}
+
+type geofenceTarget struct {
+	key    string
+	kind   string
+	stopID *primitive.ObjectID
+	point  *GeoPoint
+}
+
+// geofenceTargets lists the points the courier has still to visit for the
+// order, keyed as stored in Order.Geofence.
+func geofenceTargets(order Order) []geofenceTarget {
+	if len(order.Stops) > 0 {
+		var targets []geofenceTarget
+		for _, s := range order.Stops {
+			if s.finished() {
+				continue
+			}
+			stopID := s.ID
+			targets = append(targets, geofenceTarget{s.ID.Hex(), s.Kind, &stopID, s.Coordinates})
+		}
+		return targets
+	}
+
+	targets := []geofenceTarget{{handoverDropOff, stopDropOff, nil, order.DropOffCoordinates}}
+	if !pickedUp(order) {
+		targets = append(targets, geofenceTarget{handoverPickup, stopPickup, nil, order.PickupCoordinates})
+	}
+	return targets
+}
+
+// processGeofences compares the courier's new position with the points of
+// its active orders and records an event for every boundary crossed.
+func processGeofences(ctx context.Context, email string, pos GeoPoint, now time.Time) error {
+	orders := client.Database("myapp").Collection("orders")
+	cursor, err := orders.Find(ctx, bson.M{
+		"courierEmail": email,
+		"status":       bson.M{"$in": activeCourierStatuses},
+	})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	var active []Order
+	if err := cursor.All(ctx, &active); err != nil {
+		return err
+	}
+
+	events := client.Database("myapp").Collection("geofence_events")
+	for _, order := range active {
+		for _, t := range geofenceTargets(order) {
+			if t.point == nil {
+				continue
+			}
+			inside := haversineKm(pos, *t.point) <= geofenceRadiusKm
+			if inside == order.Geofence[t.key] {
+				continue
+			}
+
+			event := GeofenceEvent{
+				ID:           primitive.NewObjectID(),
+				OrderID:      order.ID,
+				StopID:       t.stopID,
+				Target:       t.kind,
+				Event:        geofenceExit,
+				CourierEmail: email,
+				Position:     pos,
+				At:           now,
+			}
+			if inside {
+				event.Event = geofenceEnter
+			}
+			if _, err := events.InsertOne(ctx, event); err != nil {
+				return err
+			}
+			_, err := orders.UpdateOne(ctx, bson.M{"_id": order.ID}, bson.M{"$set": bson.M{"geofence." + t.key: inside}})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func GetGeofenceEvents(w http.ResponseWriter, r *http.Request) {
+	orderID, err := primitive.ObjectIDFromHex(mux.Vars(r)["orderId"])
+	if err != nil {
+		http.Error(w, "Invalid OrderID format", http.StatusBadRequest)
+		return
+	}
+
+	opts := options.Find().SetSort(bson.M{"at": 1})
+	cursor, err := client.Database("myapp").Collection("geofence_events").Find(context.TODO(), bson.M{"orderId": orderID}, opts)
+	if err != nil {
+		http.Error(w, "Failed to retrieve geofence events", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.TODO())
+
+	events := []GeofenceEvent{}
+	if err := cursor.All(context.TODO(), &events); err != nil {
+		http.Error(w, "Failed to decode geofence events", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	handoverPickup  = "pickup"
+	handoverDropOff = "dropoff"
+
+	maxPinAttempts = 5
+)
+
+var (
+	errPinRequired = errors.New("handover PIN is required")
+	errPinInvalid  = errors.New("invalid handover PIN")
+	errPinLocked   = errors.New("too many invalid PIN attempts")
+)
+
+// HandoverStage guards one physical handover. The pickup PIN goes to the
+// sender; the drop-off PIN goes to the recipient when they can be reached
+// and to the sender otherwise.
+type HandoverStage struct {
+	PIN          string     `json:"-" bson:"pin"`
+	Attempts     int        `json:"attempts" bson:"attempts"`
+	VerifiedAt   *time.Time `json:"verifiedAt,omitempty" bson:"verifiedAt,omitempty"`
+	OverriddenBy string     `json:"overriddenBy,omitempty" bson:"overriddenBy,omitempty"`
+	OverrideNote string     `json:"overrideNote,omitempty" bson:"overrideNote,omitempty"`
+}
+
+type Handover struct {
+	Pickup  HandoverStage `json:"pickup" bson:"pickup"`
+	DropOff HandoverStage `json:"dropOff" bson:"dropOff"`
+}
+
+// OrderRecipient is who the parcel is for. A recipient with an email
+// address or phone number is sent the drop-off PIN directly.
+type OrderRecipient struct {
+	Name  string `json:"name,omitempty" bson:"name,omitempty"`
+	Email string `json:"email,omitempty" bson:"email,omitempty"`
+	Phone string `json:"phone,omitempty" bson:"phone,omitempty"`
+}
+
+func (r *OrderRecipient) reachable() bool {
+	return r != nil && (r.Email != "" || r.Phone != "")
+}
+
+// pinDelivery is a drop-off PIN on its way to a recipient.
+type pinDelivery struct {
+	To      Recipient
+	DropOff string
+	PIN     string
+}
+
+// recipientPins lists the drop-off PINs that go straight to a recipient:
+// the order's own and those of drop-off stops with contact details.
+func recipientPins(order Order) []pinDelivery {
+	var deliveries []pinDelivery
+	if order.Handover != nil && order.Recipient.reachable() {
+		deliveries = append(deliveries, pinDelivery{
+			To: Recipient{
+				Key:   "recipient:" + order.ID.Hex(),
+				Name:  order.Recipient.Name,
+				Email: order.Recipient.Email,
+				Phone: order.Recipient.Phone,
+			},
+			DropOff: order.DropOffLocation,
+			PIN:     order.Handover.DropOff.PIN,
+		})
+	}
+	for _, s := range order.Stops {
+		if s.Handover == nil || (s.ContactEmail == "" && s.ContactPhone == "") {
+			continue
+		}
+		deliveries = append(deliveries, pinDelivery{
+			To: Recipient{
+				Key:   "recipient:" + order.ID.Hex() + ":" + s.ID.Hex(),
+				Name:  s.ContactName,
+				Email: s.ContactEmail,
+				Phone: s.ContactPhone,
+			},
+			DropOff: s.Location,
+			PIN:     s.Handover.PIN,
+		})
+	}
+	return deliveries
+}
+
+// senderPins adds the PINs the sender hands out to response: always the
+// pickup PIN, and the drop-off PINs of recipients who are not sent theirs.
+func senderPins(order Order, response map[string]interface{}) {
+	response["pickupPin"] = order.Handover.Pickup.PIN
+	if !order.Recipient.reachable() {
+		response["dropOffPin"] = order.Handover.DropOff.PIN
+	}
+	if len(order.Stops) > 0 {
+		response["stopPins"] = stopPins(order)
+	}
+}
+
+func generatePin() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+func newHandover() (*Handover, error) {
+	pickup, err := generatePin()
+	if err != nil {
+		return nil, err
+	}
+	dropOff, err := generatePin()
+	if err != nil {
+		return nil, err
+	}
+	return &Handover{
+		Pickup:  HandoverStage{PIN: pickup},
+		DropOff: HandoverStage{PIN: dropOff},
+	}, nil
+}
+
+// handoverStageFor maps a courier status to the handover it requires, if
+// any.
+func handoverStageFor(status string) string {
+	switch status {
+	case "Picked up":
+		return handoverPickup
+	case "Delivered":
+		return handoverDropOff
+	}
+	return ""
+}
+
+// verifyHandoverPin checks pin for the handover the status transition needs.
+// Orders created before PINs existed, stages already verified and stages
+// overridden by an admin pass without a PIN.
+func verifyHandoverPin(ctx context.Context, order Order, status, pin string) error {
+	stageName := handoverStageFor(status)
+	if stageName == "" || order.Handover == nil {
+		return nil
+	}
+
+	stage := order.Handover.Pickup
+	field := "handover.pickup"
+	if stageName == handoverDropOff {
+		stage = order.Handover.DropOff
+		field = "handover.dropOff"
+	}
+
+	return verifyStagePin(ctx, func(attempts bson.M) bson.M {
+		return bson.M{"_id": order.ID, field + ".attempts": attempts}
+	}, field, stage, pin)
+}
+
+// verifyStagePin checks pin against stage, which lives at path in the order
+// document. match selects the order with the given condition on the stage's
+// attempts. The attempt is counted before the PIN is compared, so
+// concurrent guesses each use one up and no more than maxPinAttempts are
+// ever compared.
+func verifyStagePin(ctx context.Context, match func(attempts bson.M) bson.M, path string, stage HandoverStage, pin string) error {
+	if stage.VerifiedAt != nil {
+		return nil
+	}
+	if stage.Attempts >= maxPinAttempts {
+		return errPinLocked
+	}
+	if pin == "" {
+		return errPinRequired
+	}
+
+	collection := client.Database("myapp").Collection("orders")
+	result, err := collection.UpdateOne(ctx,
+		match(bson.M{"$lt": maxPinAttempts}),
+		bson.M{"$inc": bson.M{path + ".attempts": 1}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return errPinLocked
+	}
+	if subtle.ConstantTimeCompare([]byte(pin), []byte(stage.PIN)) != 1 {
+		return errPinInvalid
+	}
+
+	result, err = collection.UpdateOne(ctx,
+		match(bson.M{"$lte": maxPinAttempts}),
+		bson.M{"$set": bson.M{path + ".verifiedAt": time.Now().UTC()}},
+	)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return errPinLocked
+	}
+	return nil
+}
+
+// writePinError answers the request for a failed PIN check and reports
+// whether it did.
+func writePinError(w http.ResponseWriter, err error) bool {
+	switch err {
+	case nil:
+		return false
+	case errPinRequired:
+		http.Error(w, "Handover PIN is required", http.StatusBadRequest)
+	case errPinInvalid:
+		http.Error(w, "Invalid handover PIN", http.StatusForbidden)
+	case errPinLocked:
+		http.Error(w, "Too many invalid PIN attempts, contact support", http.StatusLocked)
+	default:
+		http.Error(w, "Failed to verify handover PIN", http.StatusInternalServerError)
+	}
+	return true
+}
+
+func GetOrderHandoverPins(w http.ResponseWriter, r *http.Request) {
+	orderID, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid OrderID format", http.StatusBadRequest)
+		return
+	}
+
+	userID, err := primitive.ObjectIDFromHex(r.Header.Get("userId"))
+	if err != nil {
+		http.Error(w, "Invalid UserID format", http.StatusBadRequest)
+		return
+	}
+
+	var order Order
+	err = client.Database("myapp").Collection("orders").FindOne(context.TODO(), bson.M{"_id": orderID, "userId": userID}).Decode(&order)
+	if err != nil {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+
+	if order.Handover == nil {
+		http.Error(w, "This order has no handover PINs", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response := map[string]interface{}{}
+	senderPins(order, response)
+	json.NewEncoder(w).Encode(response)
+}
+
+// OverrideHandover lets an admin release a handover stage without a PIN,
+// for instance when the recipient lost it or the attempts are exhausted.
+func OverrideHandover(w http.ResponseWriter, r *http.Request) {
+	orderID, err := primitive.ObjectIDFromHex(mux.Vars(r)["orderId"])
+	if err != nil {
+		http.Error(w, "Invalid OrderID format", http.StatusBadRequest)
+		return
+	}
+
+	var request struct {
+		Stage   string `json:"stage"`
+		StopID  string `json:"stopId"`
+		Reason  string `json:"reason"`
+		AdminID string `json:"adminId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	filter := bson.M{"_id": orderID, "handover": bson.M{"$exists": true}}
+	var field string
+	switch {
+	case request.StopID != "":
+		stopID, err := primitive.ObjectIDFromHex(request.StopID)
+		if err != nil {
+			http.Error(w, "Invalid StopID format", http.StatusBadRequest)
+			return
+		}
+		filter = bson.M{"_id": orderID, "stops": bson.M{"$elemMatch": bson.M{"id": stopID, "handover": bson.M{"$exists": true}}}}
+		field = "stops.$.handover"
+	case request.Stage == handoverPickup:
+		field = "handover.pickup"
+	case request.Stage == handoverDropOff:
+		field = "handover.dropOff"
+	default:
+		http.Error(w, "Stage must be pickup or dropoff, or a stopId must be given", http.StatusBadRequest)
+		return
+	}
+	if request.Reason == "" {
+		http.Error(w, "Reason is required", http.StatusBadRequest)
+		return
+	}
+
+	result, err := client.Database("myapp").Collection("orders").UpdateOne(context.TODO(),
+		filter,
+		bson.M{"$set": bson.M{
+			field + ".verifiedAt":   time.Now().UTC(),
+			field + ".overriddenBy": request.AdminID,
+			field + ".overrideNote": request.Reason,
+		}},
+	)
+	if err != nil {
+		http.Error(w, "Failed to override handover", http.StatusInternalServerError)
+		return
+	}
+	if result.MatchedCount == 0 {
+		http.Error(w, "Order not found or has no handover PINs", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode("Handover overridden successfully")
+}
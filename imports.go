@@ -0,0 +1,614 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	importModePartial      = "partial"
+	importModeAllOrNothing = "all_or_nothing"
+
+	importQueued    = "queued"
+	importRunning   = "running"
+	importCompleted = "completed"
+	importFailed    = "failed"
+
+	rowPending    = "pending"
+	rowInvalid    = "invalid"
+	rowCreating   = "creating"
+	rowCreated    = "created"
+	rowFailed     = "failed"
+	rowSkipped    = "skipped"
+	rowRolledBack = "rolled_back"
+
+	maxImportBytes = 10 << 20
+)
+
+var (
+	maxImportRows = envInt("IMPORT_MAX_ROWS", 2000)
+	// importLease is how long a worker owns a running job before another
+	// may pick it up. Each row's order ID is saved before the order is
+	// created, so a worker taking over retries a row stuck in creating
+	// under the same ID and neither charges nor creates it twice.
+	importLease = 5 * time.Minute
+)
+
+// ImportRow is one line of an upload and what became of it.
+type ImportRow struct {
+	Line    int                 `json:"line" bson:"line"`
+	Order   *Order              `json:"-" bson:"order,omitempty"`
+	Status  string              `json:"status" bson:"status"`
+	OrderID *primitive.ObjectID `json:"orderId,omitempty" bson:"orderId,omitempty"`
+	Price   int64               `json:"price,omitempty" bson:"price,omitempty"`
+	Error   string              `json:"error,omitempty" bson:"error,omitempty"`
+}
+
+// ImportJob is a bulk order upload. Rows are parsed when it is submitted and
+// created by the import worker, which reports on each row.
+type ImportJob struct {
+	ID         primitive.ObjectID  `json:"id" bson:"_id"`
+	AccountID  primitive.ObjectID  `json:"accountId" bson:"accountId"`
+	MerchantID *primitive.ObjectID `json:"merchantId,omitempty" bson:"merchantId,omitempty"`
+	Format     string              `json:"format" bson:"format"`
+	Mode       string              `json:"mode" bson:"mode"`
+	Status     string              `json:"status" bson:"status"`
+	Error      string              `json:"error,omitempty" bson:"error,omitempty"`
+	Total      int                 `json:"total" bson:"total"`
+	Succeeded  int                 `json:"succeeded" bson:"succeeded"`
+	Failed     int                 `json:"failed" bson:"failed"`
+	Rows       []ImportRow         `json:"rows" bson:"rows"`
+	CreatedAt  time.Time           `json:"createdAt" bson:"createdAt"`
+	StartedAt  *time.Time          `json:"startedAt,omitempty" bson:"startedAt,omitempty"`
+	FinishedAt *time.Time          `json:"finishedAt,omitempty" bson:"finishedAt,omitempty"`
+	LeaseUntil time.Time           `json:"-" bson:"leaseUntil"`
+}
+
+// csvColumns are the CSV headers an import understands. Multi-stop orders
+// need JSON Lines.
+var csvColumns = map[string]func(o *Order, v string) error{
+	"pickupLocation":  func(o *Order, v string) error { o.PickupLocation = v; return nil },
+	"dropOffLocation": func(o *Order, v string) error { o.DropOffLocation = v; return nil },
+	"packageDetails":  func(o *Order, v string) error { o.PackageDetails = v; return nil },
+	"deliveryTime":    func(o *Order, v string) error { o.DeliveryTime = v; return nil },
+	"paymentMethod":   func(o *Order, v string) error { o.PaymentMethod = v; return nil },
+	"tip": func(o *Order, v string) error {
+		tip, err := strconv.ParseInt(v, 10, 64)
+		o.Tip = tip
+		return err
+	},
+	"pickupLat":        func(o *Order, v string) error { return parseCoordinate(&o.PickupCoordinates, v, true) },
+	"pickupLng":        func(o *Order, v string) error { return parseCoordinate(&o.PickupCoordinates, v, false) },
+	"dropOffLat":       func(o *Order, v string) error { return parseCoordinate(&o.DropOffCoordinates, v, true) },
+	"dropOffLng":       func(o *Order, v string) error { return parseCoordinate(&o.DropOffCoordinates, v, false) },
+	"pickupEarliest":   func(o *Order, v string) error { return parseWindowTime(&o.PickupWindow, v, true) },
+	"pickupLatest":     func(o *Order, v string) error { return parseWindowTime(&o.PickupWindow, v, false) },
+	"deliveryEarliest": func(o *Order, v string) error { return parseWindowTime(&o.DeliveryWindow, v, true) },
+	"deliveryLatest":   func(o *Order, v string) error { return parseWindowTime(&o.DeliveryWindow, v, false) },
+	"timezone": func(o *Order, v string) error {
+		for _, tw := range []*TimeWindow{o.PickupWindow, o.DeliveryWindow} {
+			if tw != nil {
+				tw.Timezone = v
+			}
+		}
+		return nil
+	},
+}
+
+func parseCoordinate(p **GeoPoint, v string, lat bool) error {
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return err
+	}
+	if *p == nil {
+		*p = &GeoPoint{}
+	}
+	if lat {
+		(*p).Lat = f
+	} else {
+		(*p).Lng = f
+	}
+	return nil
+}
+
+func parseWindowTime(tw **TimeWindow, v string, earliest bool) error {
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return err
+	}
+	if *tw == nil {
+		*tw = &TimeWindow{}
+	}
+	if earliest {
+		(*tw).Earliest = t
+	} else {
+		(*tw).Latest = t
+	}
+	return nil
+}
+
+// parseCSVImport reads one order per record after a header row. Bad
+// records become invalid rows; only an unreadable header fails the upload.
+func parseCSVImport(body io.Reader) ([]ImportRow, error) {
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("missing header row")
+	}
+	for i, name := range header {
+		header[i] = strings.TrimSpace(name)
+		if _, ok := csvColumns[header[i]]; !ok {
+			return nil, fmt.Errorf("unknown column %q", header[i])
+		}
+	}
+
+	var rows []ImportRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			perr, ok := err.(*csv.ParseError)
+			if !ok {
+				return nil, err
+			}
+			rows = append(rows, ImportRow{Line: perr.Line, Status: rowInvalid, Error: perr.Err.Error()})
+			continue
+		}
+		line, _ := reader.FieldPos(0)
+		row := ImportRow{Line: line, Status: rowPending}
+		if len(record) != len(header) {
+			row.Status, row.Error = rowInvalid, fmt.Sprintf("expected %d fields, got %d", len(header), len(record))
+			rows = append(rows, row)
+			continue
+		}
+
+		// The timezone applies to the windows, so it is set after them.
+		var order Order
+		var timezone string
+		for i, v := range record {
+			v = strings.TrimSpace(v)
+			if v == "" {
+				continue
+			}
+			if header[i] == "timezone" {
+				timezone = v
+				continue
+			}
+			if err := csvColumns[header[i]](&order, v); err != nil {
+				row.Status, row.Error = rowInvalid, fmt.Sprintf("invalid %s: %q", header[i], v)
+				break
+			}
+		}
+		if timezone != "" {
+			csvColumns["timezone"](&order, timezone)
+		}
+		if row.Status == rowPending {
+			row.Order = &order
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// parseJSONLinesImport reads one JSON order, in the CreateOrder format, per
+// non-blank line.
+func parseJSONLinesImport(body io.Reader) ([]ImportRow, error) {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), maxImportBytes)
+
+	var rows []ImportRow
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		row := ImportRow{Line: line, Status: rowPending}
+		var order Order
+		if err := json.Unmarshal([]byte(text), &order); err != nil {
+			row.Status, row.Error = rowInvalid, "Invalid JSON: "+err.Error()
+		} else {
+			row.Order = &order
+		}
+		rows = append(rows, row)
+	}
+	return rows, scanner.Err()
+}
+
+// importFormat picks the parser from the format parameter or, failing
+// that, the content type.
+func importFormat(r *http.Request) string {
+	if f := r.URL.Query().Get("format"); f != "" {
+		return f
+	}
+	switch ct := r.Header.Get("Content-Type"); {
+	case strings.HasPrefix(ct, "text/csv"):
+		return "csv"
+	case strings.HasPrefix(ct, "application/x-ndjson"), strings.HasPrefix(ct, "application/jsonl"):
+		return "jsonl"
+	}
+	return ""
+}
+
+// ImportOrders accepts a CSV or JSON Lines upload and queues it. The
+// response carries the job id to poll for the per-row report.
+func ImportOrders(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	accountID, merchant, err := requestAccount(ctx, r, scopeOrdersCreate)
+	if err != nil {
+		writeAccountError(w, err)
+		return
+	}
+
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = importModePartial
+	}
+	if mode != importModePartial && mode != importModeAllOrNothing {
+		http.Error(w, "Mode must be partial or all_or_nothing", http.StatusBadRequest)
+		return
+	}
+
+	body := http.MaxBytesReader(w, r.Body, maxImportBytes)
+	format := importFormat(r)
+	var rows []ImportRow
+	switch format {
+	case "csv":
+		rows, err = parseCSVImport(body)
+	case "jsonl":
+		rows, err = parseJSONLinesImport(body)
+	default:
+		http.Error(w, "Format must be csv or jsonl", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Invalid upload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(rows) == 0 {
+		http.Error(w, "The upload has no orders", http.StatusBadRequest)
+		return
+	}
+	if len(rows) > maxImportRows {
+		http.Error(w, fmt.Sprintf("An upload may have at most %d orders", maxImportRows), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	job := ImportJob{
+		ID:        primitive.NewObjectID(),
+		AccountID: accountID,
+		Format:    format,
+		Mode:      mode,
+		Status:    importQueued,
+		Total:     len(rows),
+		Rows:      rows,
+		CreatedAt: time.Now().UTC(),
+	}
+	if merchant != nil {
+		job.MerchantID = &merchant.ID
+	}
+	if _, err := client.Database("myapp").Collection("import_jobs").InsertOne(ctx, job); err != nil {
+		http.Error(w, "Failed to queue import", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"jobId":     job.ID,
+		"rows":      job.Total,
+		"statusUrl": "/api/orders/imports/" + job.ID.Hex(),
+	})
+}
+
+func GetImportJob(w http.ResponseWriter, r *http.Request) {
+	jobID, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid JobID format", http.StatusBadRequest)
+		return
+	}
+
+	accountID, _, err := requestAccount(context.TODO(), r, scopeOrdersCreate)
+	if err != nil {
+		writeAccountError(w, err)
+		return
+	}
+
+	var job ImportJob
+	err = client.Database("myapp").Collection("import_jobs").FindOne(context.TODO(), bson.M{"_id": jobID, "accountId": accountID}).Decode(&job)
+	if err != nil {
+		http.Error(w, "Import not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
+
+func claimImportJob(ctx context.Context, now time.Time) (*ImportJob, error) {
+	var job ImportJob
+	err := client.Database("myapp").Collection("import_jobs").FindOneAndUpdate(ctx,
+		bson.M{
+			"status":     bson.M{"$in": bson.A{importQueued, importRunning}},
+			"leaseUntil": bson.M{"$lte": now},
+		},
+		bson.M{"$set": bson.M{"status": importRunning, "leaseUntil": now.Add(importLease)}},
+		options.FindOneAndUpdate().SetSort(bson.M{"createdAt": 1}).SetReturnDocument(options.After),
+	).Decode(&job)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// importer works through one claimed job, saving each row as it goes so a
+// job picked up again after a crash resumes where it stopped.
+type importer struct {
+	ctx  context.Context
+	jobs *mongo.Collection
+	job  *ImportJob
+}
+
+func (im *importer) order(row ImportRow) Order {
+	order := *row.Order
+	order.TemplateID = nil
+	order.Occurrence = ""
+	order.MerchantID = im.job.MerchantID
+	return order
+}
+
+func (im *importer) saveRow(i int) error {
+	row := im.job.Rows[i]
+	prefix := fmt.Sprintf("rows.%d.", i)
+	set := bson.M{
+		prefix + "status": row.Status,
+		prefix + "error":  row.Error,
+		"leaseUntil":      time.Now().UTC().Add(importLease),
+	}
+	update := bson.M{"$set": set}
+	if row.OrderID != nil {
+		set[prefix+"orderId"] = row.OrderID
+		set[prefix+"price"] = row.Price
+	} else {
+		update["$unset"] = bson.M{prefix + "orderId": "", prefix + "price": ""}
+	}
+	_, err := im.jobs.UpdateOne(im.ctx, bson.M{"_id": im.job.ID}, update)
+	return err
+}
+
+// finish records the final status with counts derived from the rows.
+func (im *importer) finish(status, message string) error {
+	succeeded, failed := 0, 0
+	for _, row := range im.job.Rows {
+		switch row.Status {
+		case rowCreated:
+			succeeded++
+		case rowInvalid, rowFailed:
+			failed++
+		}
+	}
+	now := time.Now().UTC()
+	_, err := im.jobs.UpdateOne(im.ctx, bson.M{"_id": im.job.ID}, bson.M{"$set": bson.M{
+		"status":     status,
+		"error":      message,
+		"succeeded":  succeeded,
+		"failed":     failed,
+		"finishedAt": now,
+	}})
+	return err
+}
+
+// setRest marks every row still pending with status.
+func (im *importer) setRest(status string) error {
+	for i := range im.job.Rows {
+		if im.job.Rows[i].Status == rowPending {
+			im.job.Rows[i].Status = status
+			if err := im.saveRow(i); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// create creates the order for row i and records the outcome. The order ID
+// is saved on the row first, so a row left in creating by a crash is
+// retried under the same ID.
+func (im *importer) create(i int) error {
+	row := &im.job.Rows[i]
+	if row.Status != rowCreating {
+		id := primitive.NewObjectID()
+		row.Status, row.OrderID = rowCreating, &id
+		if err := im.saveRow(i); err != nil {
+			return err
+		}
+	}
+
+	order, err := createOrder(im.ctx, *row.OrderID, im.order(*row), im.job.AccountID)
+	if oerr, ok := err.(*orderError); ok {
+		row.Status, row.Error, row.OrderID = rowFailed, oerr.Message, nil
+	} else if err != nil {
+		log.Println("Failed to create imported order:", err)
+		row.Status, row.Error, row.OrderID = rowFailed, "Failed to create order", nil
+	} else {
+		row.Status, row.OrderID, row.Price = rowCreated, &order.ID, order.Price
+	}
+	return im.saveRow(i)
+}
+
+// creatable reports whether row i still needs its order created.
+func (im *importer) creatable(i int) bool {
+	status := im.job.Rows[i].Status
+	return status == rowPending || status == rowCreating
+}
+
+func (im *importer) runPartial() error {
+	for i := range im.job.Rows {
+		if !im.creatable(i) {
+			continue
+		}
+		if err := im.create(i); err != nil {
+			return err
+		}
+	}
+	return im.finish(importCompleted, "")
+}
+
+// runAllOrNothing validates every row before creating any. Orders are then
+// created one at a time and are live, charged and published as they go;
+// should a row still fail at creation, for example on wallet balance, the
+// orders already created are cancelled and refunded. The all-or-nothing
+// outcome is reached by that compensating rollback, not by a transaction,
+// so subscribers may see created events followed by cancellations.
+func (im *importer) runAllOrNothing() error {
+	resumed := false
+	for _, row := range im.job.Rows {
+		if row.Status == rowFailed || row.Status == rowRolledBack {
+			// A previous run stopped while rolling back.
+			return im.abort(row.Line)
+		}
+		resumed = resumed || row.Status == rowCreated || row.Status == rowCreating
+	}
+
+	if !resumed {
+		invalid := false
+		for i := range im.job.Rows {
+			row := &im.job.Rows[i]
+			if row.Status == rowInvalid {
+				invalid = true
+				continue
+			}
+			_, err := prepareOrder(im.ctx, im.order(*row), im.job.AccountID)
+			if oerr, ok := err.(*orderError); ok {
+				row.Status, row.Error = rowInvalid, oerr.Message
+				invalid = true
+				if err := im.saveRow(i); err != nil {
+					return err
+				}
+			} else if err != nil {
+				return err
+			}
+		}
+		if invalid {
+			if err := im.setRest(rowSkipped); err != nil {
+				return err
+			}
+			return im.finish(importFailed, "Some rows are invalid; no orders were created")
+		}
+	}
+
+	for i := range im.job.Rows {
+		if !im.creatable(i) {
+			continue
+		}
+		if err := im.create(i); err != nil {
+			return err
+		}
+		if im.job.Rows[i].Status == rowFailed {
+			return im.abort(im.job.Rows[i].Line)
+		}
+	}
+	return im.finish(importCompleted, "")
+}
+
+// abort rolls back an all-or-nothing job after the row on line failed.
+func (im *importer) abort(line int) error {
+	if err := im.rollback(); err != nil {
+		return err
+	}
+	if err := im.setRest(rowSkipped); err != nil {
+		return err
+	}
+	return im.finish(importFailed, fmt.Sprintf("Line %d failed; created orders were cancelled", line))
+}
+
+func (im *importer) rollback() error {
+	orders := client.Database("myapp").Collection("orders")
+	for i := range im.job.Rows {
+		row := &im.job.Rows[i]
+		if row.Status != rowCreated && row.Status != rowCreating {
+			continue
+		}
+		var order Order
+		err := orders.FindOne(im.ctx, bson.M{"_id": row.OrderID}).Decode(&order)
+		if err == nil {
+			err = deleteOrder(im.ctx, order, "Canceled", eventOrderCancelled)
+		}
+		if err == mongo.ErrNoDocuments {
+			// Already rolled back, or charged but never stored. Refunds only
+			// return what is still outstanding, so this is safe either way.
+			order = Order{ID: *row.OrderID, UserID: im.job.AccountID, PaymentMethod: paymentMethodWallet}
+		} else if err != nil {
+			return err
+		}
+		if err := refundOrQueue(im.ctx, order, "Bulk import rolled back"); err != nil {
+			return err
+		}
+		row.Status = rowRolledBack
+		if err := im.saveRow(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func processImportJob(ctx context.Context, job *ImportJob) error {
+	if job.StartedAt == nil {
+		now := time.Now().UTC()
+		job.StartedAt = &now
+		_, err := client.Database("myapp").Collection("import_jobs").UpdateOne(ctx, bson.M{"_id": job.ID}, bson.M{"$set": bson.M{"startedAt": now}})
+		if err != nil {
+			return err
+		}
+	}
+
+	im := &importer{ctx: ctx, jobs: client.Database("myapp").Collection("import_jobs"), job: job}
+	if job.Mode == importModeAllOrNothing {
+		return im.runAllOrNothing()
+	}
+	return im.runPartial()
+}
+
+func runImportWorker(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for {
+			job, err := claimImportJob(context.TODO(), time.Now().UTC())
+			if err != nil {
+				log.Println("Failed to claim import job:", err)
+				break
+			}
+			if job == nil {
+				break
+			}
+			if err := processImportJob(context.TODO(), job); err != nil {
+				log.Println("Failed to process import job:", err)
+			}
+		}
+	}
+}
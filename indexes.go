@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// collectionIndexes lists the indexes the handlers rely on, mostly unique
+// ones that turn check-then-insert races into duplicate-key errors.
+var collectionIndexes = map[string][]mongo.IndexModel{
+	"invoices": {
+		{
+			Keys: bson.D{{Key: "kind", Value: 1}, {Key: "orderId", Value: 1}},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{"kind": invoiceKindOrder}),
+		},
+		{
+			Keys: bson.D{{Key: "kind", Value: 1}, {Key: "userId", Value: 1}, {Key: "month", Value: 1}},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{"kind": invoiceKindMonthly}),
+		},
+		{
+			Keys: bson.D{{Key: "number", Value: 1}},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{"number": bson.M{"$exists": true}}),
+		},
+		{Keys: bson.D{{Key: "userId", Value: 1}, {Key: "issuedAt", Value: -1}}},
+	},
+	"ratings": {
+		{Keys: bson.D{{Key: "orderId", Value: 1}, {Key: "kind", Value: 1}}, Options: options.Index().SetUnique(true)},
+	},
+	"orders": {
+		{
+			Keys: bson.D{{Key: "templateId", Value: 1}, {Key: "occurrence", Value: 1}},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{"templateId": bson.M{"$exists": true}}),
+		},
+		{
+			Keys: bson.D{{Key: "trackingToken", Value: 1}},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{"trackingToken": bson.M{"$exists": true}}),
+		},
+	},
+	"ledger": {
+		{Keys: bson.D{{Key: "orderId", Value: 1}, {Key: "type", Value: 1}}},
+	},
+	"outbox": {
+		{Keys: bson.D{{Key: "orderId", Value: 1}, {Key: "event", Value: 1}}},
+	},
+	"api_keys": {
+		{Keys: bson.D{{Key: "hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+	},
+	"notifications": {
+		{
+			Keys:    bson.D{{Key: "eventId", Value: 1}, {Key: "recipient", Value: 1}, {Key: "channel", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+	},
+	"merchants": {
+		{Keys: bson.D{{Key: "email", Value: 1}}, Options: options.Index().SetUnique(true)},
+	},
+	"merchant_sessions": {
+		{Keys: bson.D{{Key: "hash", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "expiresAt", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	},
+	"webhook_deliveries": {
+		{
+			Keys: bson.D{{Key: "eventId", Value: 1}, {Key: "endpointId", Value: 1}},
+			Options: options.Index().SetUnique(true).
+				SetPartialFilterExpression(bson.M{"replay": false}),
+		},
+		{Keys: bson.D{{Key: "endpointId", Value: 1}, {Key: "orderId", Value: 1}, {Key: "seq", Value: 1}}},
+	},
+}
+
+// ensureIndexes creates the indexes in collectionIndexes. Creating an index
+// that already exists with the same definition is a no-op.
+func ensureIndexes(ctx context.Context) error {
+	db := client.Database("myapp")
+	for name, models := range collectionIndexes {
+		if _, err := db.Collection(name).Indexes().CreateMany(ctx, models); err != nil {
+			return err
+		}
+	}
+	return nil
+}
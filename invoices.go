@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	invoiceKindOrder   = "order"
+	invoiceKindMonthly = "monthly"
+)
+
+type InvoiceLine struct {
+	OrderID     *primitive.ObjectID `json:"orderId,omitempty" bson:"orderId,omitempty"`
+	Description string              `json:"description" bson:"description"`
+	Amount      int64               `json:"amount" bson:"amount"`
+}
+
+type Invoice struct {
+	ID            primitive.ObjectID  `bson:"_id,omitempty" json:"id"`
+	Number        string              `json:"number" bson:"number,omitempty"`
+	Kind          string              `json:"kind" bson:"kind"`
+	UserID        primitive.ObjectID  `json:"userId" bson:"userId"`
+	CustomerName  string              `json:"customerName" bson:"customerName"`
+	CustomerEmail string              `json:"customerEmail" bson:"customerEmail"`
+	OrderID       *primitive.ObjectID `json:"orderId,omitempty" bson:"orderId,omitempty"`
+	Month         string              `json:"month,omitempty" bson:"month,omitempty"`
+	Lines         []InvoiceLine       `json:"lines" bson:"lines"`
+	Total         int64               `json:"total" bson:"total"`
+	IssuedAt      time.Time           `json:"issuedAt" bson:"issuedAt"`
+	PDF           []byte              `json:"-" bson:"pdf"`
+}
+
+func nextSequence(ctx context.Context, name string) (int64, error) {
+	var counter struct {
+		Seq int64 `bson:"seq"`
+	}
+	err := client.Database("myapp").Collection("counters").FindOneAndUpdate(ctx,
+		bson.M{"_id": name},
+		bson.M{"$inc": bson.M{"seq": 1}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&counter)
+	return counter.Seq, err
+}
+
+func formatCents(amount int64) string {
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, amount/100, amount%100)
+}
+
+func orderInvoiceLines(order Order) []InvoiceLine {
+	kind := "Delivery"
+	if order.ReturnOf != nil {
+		kind = "Return to sender"
+	}
+	lines := []InvoiceLine{{
+		OrderID:     &order.ID,
+		Description: fmt.Sprintf("%s %s -> %s", kind, order.PickupLocation, order.DropOffLocation),
+		Amount:      order.Price,
+	}}
+	if order.Tip > 0 {
+		lines = append(lines, InvoiceLine{OrderID: &order.ID, Description: "Courier tip", Amount: order.Tip})
+	}
+	return lines
+}
+
+func renderInvoicePDF(inv Invoice) []byte {
+	lines := []string{
+		"INVOICE " + inv.Number,
+		"",
+		"Issued:   " + inv.IssuedAt.Format("2006-01-02"),
+		"Customer: " + inv.CustomerName,
+		"Email:    " + inv.CustomerEmail,
+	}
+	if inv.Month != "" {
+		lines = append(lines, "Period:   "+inv.Month)
+	}
+	lines = append(lines, "", fmt.Sprintf("%-26s %-40s %12s", "Order", "Description", "Amount"), strings.Repeat("-", 80))
+	for _, l := range inv.Lines {
+		orderID := ""
+		if l.OrderID != nil {
+			orderID = l.OrderID.Hex()
+		}
+		desc := l.Description
+		if len(desc) > 40 {
+			desc = desc[:37] + "..."
+		}
+		lines = append(lines, fmt.Sprintf("%-26s %-40s %12s", orderID, desc, formatCents(l.Amount)))
+	}
+	lines = append(lines, strings.Repeat("-", 80), fmt.Sprintf("%67s %12s", "TOTAL", formatCents(inv.Total)))
+	return textPDF(lines)
+}
+
+// issueInvoice stores inv and then numbers it, in one transaction. An
+// insert that loses to a unique index never takes a number, so invoice
+// numbers have no gaps.
+func issueInvoice(ctx context.Context, inv Invoice) (Invoice, error) {
+	inv.ID = primitive.NewObjectID()
+	inv.IssuedAt = time.Now().UTC()
+	for _, l := range inv.Lines {
+		inv.Total += l.Amount
+	}
+
+	err := withTransaction(ctx, func(sc mongo.SessionContext) error {
+		collection := client.Database("myapp").Collection("invoices")
+		if _, err := collection.InsertOne(sc, inv); err != nil {
+			return err
+		}
+
+		seq, err := nextSequence(sc, "invoice")
+		if err != nil {
+			return err
+		}
+		inv.Number = fmt.Sprintf("INV-%06d", seq)
+		inv.PDF = renderInvoicePDF(inv)
+		_, err = collection.UpdateOne(sc,
+			bson.M{"_id": inv.ID},
+			bson.M{"$set": bson.M{"number": inv.Number, "pdf": inv.PDF}},
+		)
+		return err
+	})
+	return inv, err
+}
+
+// ensureOrderInvoice returns the existing invoice for a delivered order or
+// issues one. The unique (kind, orderId) index makes the loser of two
+// concurrent requests fail its insert; it then returns the winner's invoice.
+func ensureOrderInvoice(ctx context.Context, order Order) (Invoice, error) {
+	collection := client.Database("myapp").Collection("invoices")
+	filter := bson.M{"kind": invoiceKindOrder, "orderId": order.ID}
+
+	var inv Invoice
+	err := collection.FindOne(ctx, filter).Decode(&inv)
+	if err != mongo.ErrNoDocuments {
+		return inv, err
+	}
+
+	user, err := findAccount(ctx, order.UserID)
+	if err != nil {
+		return inv, err
+	}
+
+	inv, err = issueInvoice(ctx, Invoice{
+		Kind:          invoiceKindOrder,
+		UserID:        user.ID,
+		CustomerName:  user.Name,
+		CustomerEmail: user.Email,
+		OrderID:       &order.ID,
+		Lines:         orderInvoiceLines(order),
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		inv = Invoice{}
+		err = collection.FindOne(ctx, filter).Decode(&inv)
+	}
+	return inv, err
+}
+
+func writeInvoice(w http.ResponseWriter, r *http.Request, inv Invoice) {
+	if r.URL.Query().Get("format") == "pdf" {
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%s.pdf", inv.Number))
+		w.Write(inv.PDF)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(inv)
+}
+
+func GetOrderReceipt(w http.ResponseWriter, r *http.Request) {
+	orderID, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid OrderID format", http.StatusBadRequest)
+		return
+	}
+
+	userID, err := primitive.ObjectIDFromHex(r.Header.Get("userId"))
+	if err != nil {
+		http.Error(w, "Invalid UserID format", http.StatusBadRequest)
+		return
+	}
+
+	var order Order
+	err = client.Database("myapp").Collection("orders").FindOne(context.TODO(), bson.M{"_id": orderID, "userId": userID}).Decode(&order)
+	if err != nil {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+
+	if order.Status != "Delivered" && order.Status != "Partially delivered" {
+		http.Error(w, "Receipt is only available for delivered orders", http.StatusConflict)
+		return
+	}
+
+	inv, err := ensureOrderInvoice(context.TODO(), order)
+	if err != nil {
+		http.Error(w, "Failed to generate receipt", http.StatusInternalServerError)
+		return
+	}
+
+	writeInvoice(w, r, inv)
+}
+
+func GetInvoices(w http.ResponseWriter, r *http.Request) {
+	filter := bson.M{}
+	if kind := r.URL.Query().Get("kind"); kind != "" {
+		filter["kind"] = kind
+	}
+	if s := r.URL.Query().Get("userId"); s != "" {
+		userID, err := primitive.ObjectIDFromHex(s)
+		if err != nil {
+			http.Error(w, "Invalid UserID format", http.StatusBadRequest)
+			return
+		}
+		filter["userId"] = userID
+	}
+	from, to, err := parseDateRange(r)
+	if err != nil {
+		http.Error(w, "Invalid date range", http.StatusBadRequest)
+		return
+	}
+	if dr := timeRangeFilter(from, to); len(dr) > 0 {
+		filter["issuedAt"] = dr
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "issuedAt", Value: -1}}).SetProjection(bson.M{"pdf": 0})
+	cursor, err := client.Database("myapp").Collection("invoices").Find(context.TODO(), filter, opts)
+	if err != nil {
+		http.Error(w, "Failed to retrieve invoices", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.TODO())
+
+	invoices := []Invoice{}
+	if err := cursor.All(context.TODO(), &invoices); err != nil {
+		http.Error(w, "Failed to decode invoices", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(invoices)
+}
+
+func GetInvoice(w http.ResponseWriter, r *http.Request) {
+	invoiceID, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid InvoiceID format", http.StatusBadRequest)
+		return
+	}
+
+	var inv Invoice
+	err = client.Database("myapp").Collection("invoices").FindOne(context.TODO(), bson.M{"_id": invoiceID}).Decode(&inv)
+	if err != nil {
+		http.Error(w, "Invoice not found", http.StatusNotFound)
+		return
+	}
+
+	writeInvoice(w, r, inv)
+}
+
+// GenerateMonthlyInvoices issues one consolidated invoice per customer for
+// the orders delivered in the given month that are billed on account: those
+// with no payment method and return legs the wallet could not cover. Customers who already have an invoice for that month are skipped;
+// the unique (kind, userId, month) index settles concurrent runs.
+func GenerateMonthlyInvoices(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Month  string `json:"month"`
+		UserID string `json:"userId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	start, err := time.Parse("2006-01", request.Month)
+	if err != nil {
+		http.Error(w, "Invalid month, expected YYYY-MM", http.StatusBadRequest)
+		return
+	}
+	end := start.AddDate(0, 1, 0)
+
+	filter := bson.M{
+		"status":        bson.M{"$in": bson.A{"Delivered", "Partially delivered"}},
+		"deliveredAt":   bson.M{"$gte": start, "$lt": end},
+		"paymentMethod": bson.M{"$in": bson.A{nil, paymentMethodInvoice}},
+	}
+	if request.UserID != "" {
+		userID, err := primitive.ObjectIDFromHex(request.UserID)
+		if err != nil {
+			http.Error(w, "Invalid UserID format", http.StatusBadRequest)
+			return
+		}
+		filter["userId"] = userID
+	}
+
+	ctx := context.TODO()
+	cursor, err := client.Database("myapp").Collection("orders").Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "deliveredAt", Value: 1}}))
+	if err != nil {
+		http.Error(w, "Failed to retrieve orders", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	var orders []Order
+	if err := cursor.All(ctx, &orders); err != nil {
+		http.Error(w, "Failed to decode orders", http.StatusInternalServerError)
+		return
+	}
+
+	byUser := map[primitive.ObjectID][]Order{}
+	var userIDs []primitive.ObjectID
+	for _, o := range orders {
+		if _, ok := byUser[o.UserID]; !ok {
+			userIDs = append(userIDs, o.UserID)
+		}
+		byUser[o.UserID] = append(byUser[o.UserID], o)
+	}
+
+	invoiceCollection := client.Database("myapp").Collection("invoices")
+	issued := []Invoice{}
+	for _, userID := range userIDs {
+		n, err := invoiceCollection.CountDocuments(ctx, bson.M{"kind": invoiceKindMonthly, "userId": userID, "month": request.Month})
+		if err != nil {
+			http.Error(w, "Failed to check existing invoices", http.StatusInternalServerError)
+			return
+		}
+		if n > 0 {
+			continue
+		}
+
+		user, err := findAccount(ctx, userID)
+		if err != nil {
+			continue
+		}
+
+		var lines []InvoiceLine
+		for _, o := range byUser[userID] {
+			lines = append(lines, orderInvoiceLines(o)...)
+		}
+
+		inv, err := issueInvoice(ctx, Invoice{
+			Kind:          invoiceKindMonthly,
+			UserID:        userID,
+			CustomerName:  user.Name,
+			CustomerEmail: user.Email,
+			Month:         request.Month,
+			Lines:         lines,
+		})
+		if mongo.IsDuplicateKeyError(err) {
+			continue
+		}
+		if err != nil {
+			http.Error(w, "Failed to issue invoice", http.StatusInternalServerError)
+			return
+		}
+		issued = append(issued, inv)
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(issued)
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	// loginWindow is how long failed attempts are remembered.
+	loginWindow = time.Duration(envInt("LOGIN_WINDOW_MINUTES", 15)) * time.Minute
+
+	// loginMaxFailures failures on one account within loginWindow lock it
+	// for loginLockout; loginIPMaxFailures do the same for one IP.
+	loginMaxFailures   = envInt("LOGIN_MAX_FAILURES", 5)
+	loginIPMaxFailures = envInt("LOGIN_IP_MAX_FAILURES", 50)
+	loginLockout       = time.Duration(envInt("LOGIN_LOCKOUT_MINUTES", 15)) * time.Minute
+
+	// loginAlertAccounts is how many different accounts one IP may fail on
+	// within loginWindow before it is reported as credential stuffing.
+	loginAlertAccounts = envInt("LOGIN_ALERT_DISTINCT_ACCOUNTS", 10)
+)
+
+const (
+	// After loginDelayAfter failures each attempt has to wait twice as
+	// long as the last, up to loginMaxDelay.
+	loginDelayAfter = 2
+	loginMaxDelay   = 30 * time.Second
+
+	// loginInFlightLease bounds how long a reserved attempt holds up the
+	// next one should its request never finish.
+	loginInFlightLease = 10 * time.Second
+
+	throttleAccount = "account"
+	throttleIP      = "ip"
+
+	alertAccountLocked       = "account_locked"
+	alertIPLocked            = "ip_locked"
+	alertCredentialStuffing  = "credential_stuffing"
+	alertSuccessAfterFailure = "success_after_failures"
+
+	invalidCredentials = "Invalid email or password"
+)
+
+// LoginThrottle counts recent failed logins for an account or an IP. The
+// account is the email that was tried, whether or not it exists, so a lock
+// says nothing about which emails are registered. An account's attempts run
+// one at a time: each reserves InFlightUntil before the password is checked.
+type LoginThrottle struct {
+	Key           string     `json:"key" bson:"_id"`
+	Kind          string     `json:"kind" bson:"kind"`
+	Failures      int        `json:"failures" bson:"failures"`
+	WindowStart   time.Time  `json:"windowStart" bson:"windowStart"`
+	LastFailureAt time.Time  `json:"lastFailureAt" bson:"lastFailureAt"`
+	LockedUntil   *time.Time `json:"lockedUntil,omitempty" bson:"lockedUntil,omitempty"`
+	NextAttemptAt *time.Time `json:"nextAttemptAt,omitempty" bson:"nextAttemptAt,omitempty"`
+	InFlightUntil *time.Time `json:"-" bson:"inFlightUntil,omitempty"`
+	Accounts      []string   `json:"accounts,omitempty" bson:"accounts,omitempty"`
+}
+
+// SecurityAlert is raised on a suspicious login pattern, for admins to
+// follow up and acknowledge.
+type SecurityAlert struct {
+	ID             primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Kind           string             `json:"kind" bson:"kind"`
+	Role           string             `json:"role,omitempty" bson:"role,omitempty"`
+	Email          string             `json:"email,omitempty" bson:"email,omitempty"`
+	IP             string             `json:"ip" bson:"ip"`
+	Failures       int                `json:"failures" bson:"failures"`
+	CreatedAt      time.Time          `json:"createdAt" bson:"createdAt"`
+	AcknowledgedBy string             `json:"acknowledgedBy,omitempty" bson:"acknowledgedBy,omitempty"`
+	AcknowledgedAt *time.Time         `json:"acknowledgedAt,omitempty" bson:"acknowledgedAt,omitempty"`
+}
+
+func accountThrottleKey(role, email string) string {
+	return throttleAccount + ":" + role + ":" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipThrottleKey(ip string) string {
+	return throttleIP + ":" + ip
+}
+
+// retryAfter is how long the throttle makes the next attempt wait.
+func (t LoginThrottle) retryAfter(now time.Time) time.Duration {
+	var wait time.Duration
+	for _, until := range []*time.Time{t.LockedUntil, t.NextAttemptAt, t.InFlightUntil} {
+		if until != nil && until.Sub(now) > wait {
+			wait = until.Sub(now)
+		}
+	}
+	return wait
+}
+
+// loginDelay is how long an account has to wait after its failures-th
+// failure in a window.
+func loginDelay(failures int) time.Duration {
+	n := failures - loginDelayAfter
+	if n <= 0 {
+		return 0
+	}
+	if n >= 6 {
+		return loginMaxDelay
+	}
+	return time.Second << uint(n-1)
+}
+
+// reserveLoginAttempt atomically claims the account's next attempt, unless
+// it is locked, still waiting out its delay or has another attempt in
+// flight. Concurrent requests therefore cannot all get past the throttle
+// before any of their failures is counted.
+func reserveLoginAttempt(ctx context.Context, key string, now time.Time) (bool, error) {
+	notAfterNow := bson.M{"$not": bson.M{"$gt": now}}
+	_, err := client.Database("myapp").Collection("login_throttles").UpdateOne(ctx,
+		bson.M{"_id": key, "lockedUntil": notAfterNow, "nextAttemptAt": notAfterNow, "inFlightUntil": notAfterNow},
+		bson.M{
+			"$set":         bson.M{"inFlightUntil": now.Add(loginInFlightLease)},
+			"$setOnInsert": bson.M{"kind": throttleAccount, "failures": 0, "windowStart": now, "lastFailureAt": now},
+		},
+		options.Update().SetUpsert(true),
+	)
+	if mongo.IsDuplicateKeyError(err) {
+		// The throttle exists but did not match, so the attempt must wait.
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func releaseLoginAttempt(ctx context.Context, key string) {
+	_, err := client.Database("myapp").Collection("login_throttles").UpdateOne(ctx,
+		bson.M{"_id": key}, bson.M{"$unset": bson.M{"inFlightUntil": ""}})
+	if err != nil {
+		log.Println("Failed to release login attempt:", err)
+	}
+}
+
+func loadThrottles(ctx context.Context, keys ...string) ([]LoginThrottle, error) {
+	cursor, err := client.Database("myapp").Collection("login_throttles").Find(ctx, bson.M{"_id": bson.M{"$in": keys}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var throttles []LoginThrottle
+	err = cursor.All(ctx, &throttles)
+	return throttles, err
+}
+
+// bumpThrottle counts a failure against key, starting a new window when
+// the last one has passed. account is added to the IP's list of accounts.
+func bumpThrottle(ctx context.Context, key, kind, account string, now time.Time) (LoginThrottle, error) {
+	collection := client.Database("myapp").Collection("login_throttles")
+
+	update := bson.M{
+		"$inc": bson.M{"failures": 1},
+		"$set": bson.M{"lastFailureAt": now},
+	}
+	if account != "" {
+		update["$addToSet"] = bson.M{"accounts": account}
+	}
+	var t LoginThrottle
+	err := collection.FindOneAndUpdate(ctx,
+		bson.M{"_id": key, "windowStart": bson.M{"$gt": now.Add(-loginWindow)}},
+		update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&t)
+	if err != mongo.ErrNoDocuments {
+		return t, err
+	}
+
+	set := bson.M{"kind": kind, "failures": 1, "windowStart": now, "lastFailureAt": now}
+	if account != "" {
+		set["accounts"] = []string{account}
+	}
+	err = collection.FindOneAndUpdate(ctx,
+		bson.M{"_id": key}, bson.M{"$set": set},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&t)
+	return t, err
+}
+
+// lockThrottle locks the throttle out once it reaches max failures. It
+// reports whether a new lock was set.
+func lockThrottle(ctx context.Context, t LoginThrottle, max int, now time.Time) (bool, error) {
+	if t.Failures < max || (t.LockedUntil != nil && t.LockedUntil.After(now)) {
+		return false, nil
+	}
+	result, err := client.Database("myapp").Collection("login_throttles").UpdateOne(ctx,
+		bson.M{"_id": t.Key},
+		bson.M{"$set": bson.M{"lockedUntil": now.Add(loginLockout)}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return result.ModifiedCount > 0, nil
+}
+
+func raiseSecurityAlert(ctx context.Context, alert SecurityAlert) {
+	alert.ID = primitive.NewObjectID()
+	alert.CreatedAt = time.Now().UTC()
+	if _, err := client.Database("myapp").Collection("security_alerts").InsertOne(ctx, alert); err != nil {
+		log.Println("Failed to store security alert:", err)
+	}
+	log.Printf("Security alert: %s for %s %q from %s after %d failures", alert.Kind, alert.Role, alert.Email, alert.IP, alert.Failures)
+}
+
+// recordLoginFailure counts the failure against the account and the IP,
+// locking either out and raising alerts where needed.
+func recordLoginFailure(ctx context.Context, role, email, ip string) error {
+	now := time.Now().UTC()
+	account, err := bumpThrottle(ctx, accountThrottleKey(role, email), throttleAccount, "", now)
+	if err != nil {
+		return err
+	}
+	// Ends the attempt reserved by reserveLoginAttempt.
+	_, err = client.Database("myapp").Collection("login_throttles").UpdateOne(ctx,
+		bson.M{"_id": account.Key},
+		bson.M{
+			"$set":   bson.M{"nextAttemptAt": now.Add(loginDelay(account.Failures))},
+			"$unset": bson.M{"inFlightUntil": ""},
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if locked, err := lockThrottle(ctx, account, loginMaxFailures, now); err != nil {
+		return err
+	} else if locked {
+		raiseSecurityAlert(ctx, SecurityAlert{Kind: alertAccountLocked, Role: role, Email: email, IP: ip, Failures: account.Failures})
+	}
+
+	byIP, err := bumpThrottle(ctx, ipThrottleKey(ip), throttleIP, accountThrottleKey(role, email), now)
+	if err != nil {
+		return err
+	}
+	if locked, err := lockThrottle(ctx, byIP, loginIPMaxFailures, now); err != nil {
+		return err
+	} else if locked {
+		raiseSecurityAlert(ctx, SecurityAlert{Kind: alertIPLocked, IP: ip, Failures: byIP.Failures})
+	}
+	// Raised once per window, when an account the IP has not failed on yet
+	// brings it to the threshold.
+	if len(byIP.Accounts) == loginAlertAccounts && account.Failures == 1 {
+		raiseSecurityAlert(ctx, SecurityAlert{Kind: alertCredentialStuffing, IP: ip, Failures: byIP.Failures})
+	}
+	return nil
+}
+
+// recordLoginSuccess clears the account's failures. The IP keeps its count
+// so one good account does not reset a guessing run on others.
+func recordLoginSuccess(ctx context.Context, role, email, ip string) error {
+	var t LoginThrottle
+	err := client.Database("myapp").Collection("login_throttles").FindOneAndDelete(ctx,
+		bson.M{"_id": accountThrottleKey(role, email)}).Decode(&t)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if t.Failures > 0 && t.Failures >= loginMaxFailures-1 && time.Since(t.WindowStart) < loginWindow {
+		raiseSecurityAlert(ctx, SecurityAlert{Kind: alertSuccessAfterFailure, Role: role, Email: email, IP: ip, Failures: t.Failures})
+	}
+	return nil
+}
+
+// passwordMatches compares digests of both sides in constant time. Hashing
+// first gives the comparison fixed-length inputs, since ConstantTimeCompare
+// returns at once on a length mismatch and would leak the stored length.
+func passwordMatches(stored, given string) bool {
+	a, b := sha256.Sum256([]byte(stored)), sha256.Sum256([]byte(given))
+	return subtle.ConstantTimeCompare(a[:], b[:]) == 1
+}
+
+// authenticate runs check, which looks the account up and compares the
+// password, behind the attempt throttles. Every failure gets the same
+// response whether or not the account exists. It writes the error response
+// itself and reports whether the caller may log in.
+func authenticate(w http.ResponseWriter, r *http.Request, role, email string, check func(ctx context.Context) (bool, error)) bool {
+	ctx := r.Context()
+	ip := clientIP(r)
+	now := time.Now().UTC()
+	accountKey := accountThrottleKey(role, email)
+
+	throttles, err := loadThrottles(ctx, accountKey, ipThrottleKey(ip))
+	if err != nil {
+		http.Error(w, "Failed to log in", http.StatusInternalServerError)
+		return false
+	}
+	var wait time.Duration
+	for _, t := range throttles {
+		if d := t.retryAfter(now); d > wait {
+			wait = d
+		}
+	}
+	reserved := false
+	if wait == 0 {
+		reserved, err = reserveLoginAttempt(ctx, accountKey, now)
+		if err != nil {
+			http.Error(w, "Failed to log in", http.StatusInternalServerError)
+			return false
+		}
+		if !reserved {
+			// Another attempt got in first; it will finish within the lease.
+			wait = time.Second
+		}
+	}
+	if !reserved {
+		auditAuth(r, "auth.login_throttled", role, email, auditFailure)
+		w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+		http.Error(w, "Too many login attempts, try again later", http.StatusTooManyRequests)
+		return false
+	}
+
+	ok, err := check(ctx)
+	if err != nil {
+		releaseLoginAttempt(ctx, accountKey)
+		http.Error(w, "Failed to log in", http.StatusInternalServerError)
+		return false
+	}
+	if !ok {
+		if err := recordLoginFailure(ctx, role, email, ip); err != nil {
+			log.Println("Failed to record login failure:", err)
+		}
+		auditAuth(r, "auth.login", role, email, auditFailure)
+		http.Error(w, invalidCredentials, http.StatusUnauthorized)
+		return false
+	}
+
+	if err := recordLoginSuccess(ctx, role, email, ip); err != nil {
+		log.Println("Failed to clear login failures:", err)
+	}
+	auditAuth(r, "auth.login", role, email, auditSuccess)
+	return true
+}
+
+// findForLogin decodes the account matching filter into v. A missing
+// account is not an error; a password comparison is still run against a
+// dummy, so a missing account costs the same comparison as a wrong password.
+func findForLogin(ctx context.Context, collection string, filter bson.M, v interface{}) (bool, error) {
+	err := client.Database("myapp").Collection(collection).FindOne(ctx, filter).Decode(v)
+	if err == mongo.ErrNoDocuments {
+		passwordMatches("no account", "")
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// GetLoginLocks lists the accounts and IPs currently locked out.
+func GetLoginLocks(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	cursor, err := client.Database("myapp").Collection("login_throttles").Find(ctx,
+		bson.M{"lockedUntil": bson.M{"$gt": time.Now().UTC()}},
+		options.Find().SetSort(bson.M{"lockedUntil": -1}))
+	if err != nil {
+		http.Error(w, "Failed to retrieve login locks", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(ctx)
+
+	locks := []LoginThrottle{}
+	if err := cursor.All(ctx, &locks); err != nil {
+		http.Error(w, "Failed to decode login locks", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(locks)
+}
+
+// UnlockLogin clears the failures and lock of an account, given role and
+// email, or of an IP.
+func UnlockLogin(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		AdminID string `json:"adminId"`
+		Role    string `json:"role"`
+		Email   string `json:"email"`
+		IP      string `json:"ip"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if _, err := findAdmin(r.Context(), request.AdminID); err != nil {
+		writeAccountError(w, err)
+		return
+	}
+
+	var key string
+	switch {
+	case request.Email != "" && containsString([]string{"user", "courier", "admin", "merchant"}, request.Role):
+		key = accountThrottleKey(request.Role, request.Email)
+	case request.IP != "":
+		key = ipThrottleKey(request.IP)
+	default:
+		http.Error(w, "Give a role and email, or an IP", http.StatusBadRequest)
+		return
+	}
+
+	var t LoginThrottle
+	err := client.Database("myapp").Collection("login_throttles").FindOneAndDelete(r.Context(), bson.M{"_id": key}).Decode(&t)
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "No failed logins recorded", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to unlock", http.StatusInternalServerError)
+		return
+	}
+	auditAction(r, "auth.unlocked", "login_lock", key, t, nil)
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode("Unlocked successfully")
+}
+
+func GetSecurityAlerts(w http.ResponseWriter, r *http.Request) {
+	filter := bson.M{}
+	if kind := r.URL.Query().Get("kind"); kind != "" {
+		filter["kind"] = kind
+	}
+	switch r.URL.Query().Get("acknowledged") {
+	case "true":
+		filter["acknowledgedAt"] = bson.M{"$exists": true}
+	case "false":
+		filter["acknowledgedAt"] = bson.M{"$exists": false}
+	}
+
+	opts := options.Find().SetSort(bson.M{"createdAt": -1})
+	cursor, err := client.Database("myapp").Collection("security_alerts").Find(context.TODO(), filter, opts)
+	if err != nil {
+		http.Error(w, "Failed to retrieve security alerts", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.TODO())
+
+	alerts := []SecurityAlert{}
+	if err := cursor.All(context.TODO(), &alerts); err != nil {
+		http.Error(w, "Failed to decode security alerts", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(alerts)
+}
+
+func AcknowledgeSecurityAlert(w http.ResponseWriter, r *http.Request) {
+	alertID, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid AlertID format", http.StatusBadRequest)
+		return
+	}
+
+	var request struct {
+		AdminID string `json:"adminId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if _, err := findAdmin(r.Context(), request.AdminID); err != nil {
+		writeAccountError(w, err)
+		return
+	}
+
+	result, err := client.Database("myapp").Collection("security_alerts").UpdateOne(context.TODO(),
+		bson.M{"_id": alertID, "acknowledgedAt": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"acknowledgedBy": request.AdminID, "acknowledgedAt": time.Now().UTC()}},
+	)
+	if err != nil {
+		http.Error(w, "Failed to acknowledge security alert", http.StatusInternalServerError)
+		return
+	}
+	if result.MatchedCount == 0 {
+		http.Error(w, "Security alert not found or already acknowledged", http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode("Security alert acknowledged")
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoginDelay(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{loginDelayAfter, 0},
+		{loginDelayAfter + 1, time.Second},
+		{loginDelayAfter + 2, 2 * time.Second},
+		{loginDelayAfter + 3, 4 * time.Second},
+		{loginDelayAfter + 5, 16 * time.Second},
+		{loginDelayAfter + 6, loginMaxDelay},
+		{loginDelayAfter + 100, loginMaxDelay},
+	}
+	for _, tt := range tests {
+		if got := loginDelay(tt.failures); got != tt.want {
+			t.Errorf("loginDelay(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+
+	// The delay never shrinks as failures grow and never passes the cap.
+	prev := time.Duration(0)
+	for failures := 0; failures < 200; failures++ {
+		d := loginDelay(failures)
+		if d < prev || d > loginMaxDelay {
+			t.Fatalf("loginDelay(%d) = %v after %v", failures, d, prev)
+		}
+		prev = d
+	}
+}
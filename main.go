@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"os"
 	"time"
 
 	"github.com/gorilla/handlers"
@@ -21,20 +22,68 @@ type User struct {
 	Phone    string             `json:"phone"`
 	Password string             `json:"password"`
 	ID       primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+
+	Rating *RatingSummary `json:"rating,omitempty" bson:"rating,omitempty"`
 }
 
 type Order struct {
-	ID              primitive.ObjectID `bson:"_id,omitempty" json:"id"`
-	PickupLocation  string             `json:"pickupLocation,omitempty"`
-	DropOffLocation string             `json:"dropOffLocation,omitempty"`
-	PackageDetails  string             `json:"packageDetails,omitempty"`
-	DeliveryTime    string             `json:"deliveryTime,omitempty"`
-	Status          string             `json:"status"`
-	UserID          primitive.ObjectID `bson:"userId" json:"userId"`
-	UserName        string             `json:"userName,omitempty " bson:"userName,omitempty "`
-	CourierEmail    string             `json:"courierEmail,omitempty" bson:"courierEmail,omitempty"`
-	CourierPhone    string             `json:"courierPhone,omitempty" bson:"courierPhone,omitempty"`
-	CourierName     string             `json:"courierName,omitempty" bson:"courierName,omitempty"`
+	ID              primitive.ObjectID  `bson:"_id,omitempty" json:"id"`
+	PickupLocation  string              `json:"pickupLocation,omitempty"`
+	DropOffLocation string              `json:"dropOffLocation,omitempty"`
+	PackageDetails  string              `json:"packageDetails,omitempty"`
+	DeliveryTime    string              `json:"deliveryTime,omitempty"`
+	Status          string              `json:"status"`
+	UserID          primitive.ObjectID  `bson:"userId" json:"userId"`
+	UserName        string              `json:"userName,omitempty " bson:"userName,omitempty "`
+	CourierID       *primitive.ObjectID `json:"courierId,omitempty" bson:"courierId,omitempty"`
+	CourierEmail    string              `json:"courierEmail,omitempty" bson:"courierEmail,omitempty"`
+	CourierPhone    string              `json:"courierPhone,omitempty" bson:"courierPhone,omitempty"`
+	CourierName     string              `json:"courierName,omitempty" bson:"courierName,omitempty"`
+	Price           int64               `json:"price" bson:"price"`
+	Tip             int64               `json:"tip,omitempty" bson:"tip,omitempty"`
+	PaymentMethod   string              `json:"paymentMethod,omitempty" bson:"paymentMethod,omitempty"`
+	DeliveredAt     *time.Time          `json:"deliveredAt,omitempty" bson:"deliveredAt,omitempty"`
+	ProofOfDelivery *ProofOfDelivery    `json:"proofOfDelivery,omitempty" bson:"proofOfDelivery,omitempty"`
+	Handover        *Handover           `json:"handover,omitempty" bson:"handover,omitempty"`
+	Recipient       *OrderRecipient     `json:"recipient,omitempty" bson:"recipient,omitempty"`
+
+	DeliveryAttempts []DeliveryAttempt   `json:"deliveryAttempts,omitempty" bson:"deliveryAttempts,omitempty"`
+	NextAttemptAt    *time.Time          `json:"nextAttemptAt,omitempty" bson:"nextAttemptAt,omitempty"`
+	ReturnOrderID    *primitive.ObjectID `json:"returnOrderId,omitempty" bson:"returnOrderId,omitempty"`
+	ReturnOf         *primitive.ObjectID `json:"returnOf,omitempty" bson:"returnOf,omitempty"`
+
+	PickupCoordinates  *GeoPoint `json:"pickupCoordinates,omitempty" bson:"pickupCoordinates,omitempty"`
+	DropOffCoordinates *GeoPoint `json:"dropOffCoordinates,omitempty" bson:"dropOffCoordinates,omitempty"`
+
+	PickupWindow   *TimeWindow `json:"pickupWindow,omitempty" bson:"pickupWindow,omitempty"`
+	DeliveryWindow *TimeWindow `json:"deliveryWindow,omitempty" bson:"deliveryWindow,omitempty"`
+
+	TemplateID *primitive.ObjectID `json:"templateId,omitempty" bson:"templateId,omitempty"`
+	Occurrence string              `json:"occurrence,omitempty" bson:"occurrence,omitempty"`
+
+	Stops []Stop `json:"stops,omitempty" bson:"stops,omitempty"`
+
+	PickedUpAt *time.Time `json:"pickedUpAt,omitempty" bson:"pickedUpAt,omitempty"`
+	ETA        *OrderETA  `json:"eta,omitempty" bson:"eta,omitempty"`
+	SLA        *SLAStatus `json:"sla,omitempty" bson:"sla,omitempty"`
+
+	ZoneID   *primitive.ObjectID `json:"zoneId,omitempty" bson:"zoneId,omitempty"`
+	Geofence map[string]bool     `json:"-" bson:"geofence,omitempty"`
+
+	TrackingToken string `json:"trackingToken,omitempty" bson:"trackingToken,omitempty"`
+
+	MerchantID *primitive.ObjectID `json:"merchantId,omitempty" bson:"merchantId,omitempty"`
+
+	Declines []CourierDecline `json:"declines,omitempty" bson:"declines,omitempty"`
+
+	Disputes     []DisputeResolution `json:"disputes,omitempty" bson:"disputes,omitempty"`
+	RedeliveryOf *primitive.ObjectID `json:"redeliveryOf,omitempty" bson:"redeliveryOf,omitempty"`
+}
+
+// CourierDecline records a courier turning an assignment down.
+type CourierDecline struct {
+	CourierEmail string    `json:"courierEmail" bson:"courierEmail"`
+	At           time.Time `json:"at" bson:"at"`
 }
 
 type Courier struct {
@@ -45,6 +94,11 @@ type Courier struct {
 	Password    string             `json:"password" bson:"password"`
 	VehicleType string             `json:"vehicleType" bson:"vehicleType"`
 	PlateNumber string             `json:"plateNumber" bson:"plateNumber"`
+
+	Location          *GeoPoint  `json:"location,omitempty" bson:"location,omitempty"`
+	LocationUpdatedAt *time.Time `json:"locationUpdatedAt,omitempty" bson:"locationUpdatedAt,omitempty"`
+
+	Rating *RatingSummary `json:"rating,omitempty" bson:"rating,omitempty"`
 }
 type Admin struct {
 	ID       primitive.ObjectID `bson:"_id,omitempty" json:"id"`
@@ -58,22 +112,100 @@ var client *mongo.Client
 
 func main() {
 	// Set up MongoDB connection
-	clientOptions := options.Client().ApplyURI("mongodb://localhost:27017")
+	mongoURI := os.Getenv("MONGO_URI")
+	if mongoURI == "" {
+		mongoURI = "mongodb://localhost:27017"
+	}
+	clientOptions := options.Client().ApplyURI(mongoURI)
 	var err error
 	client, err = mongo.Connect(context.TODO(), clientOptions)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if err := checkTransactions(context.TODO()); err != nil {
+		log.Fatal(err)
+	}
+	if err := ensureIndexes(context.TODO()); err != nil {
+		log.Fatal(err)
+	}
+	// Instances starting together leave the backfill to whichever takes
+	// the lock first.
+	err = withLedgerLock(context.TODO(), "outbox-backfill", func() error {
+		return backfillOutbox(context.TODO())
+	})
+	if err != nil && err != errLedgerBusy {
+		log.Fatal(err)
+	}
+	blobs = newBlobStoreFromEnv()
+	if path := os.Getenv("ROAD_GRAPH_FILE"); path != "" {
+		roadGraph, err = loadRoadGraph(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	senders = newSendersFromEnv()
+	go runScheduler(time.Minute)
+	go runNotifier(5 * time.Second)
+	go runWebhookDispatcher(5 * time.Second)
+	go runOutboxRelay(time.Second)
+	go runImportWorker(2 * time.Second)
+	go runExportWorker(5 * time.Second)
+	go runRefundRetries(time.Minute)
 	//InsertAdminUser()
 	router := mux.NewRouter()
+	router.Use(auditMiddleware)
 	//User
 	router.HandleFunc("/api/register", RegisterUser).Methods("POST")
 	router.HandleFunc("/api/users", GetUsers).Methods("GET")
 	router.HandleFunc("/api/login", LoginUser).Methods("POST")
+	router.HandleFunc("/api/orders/imports", ImportOrders).Methods("POST")
+	router.HandleFunc("/api/orders/imports/{id}", GetImportJob).Methods("GET")
+	router.HandleFunc("/api/orders/export", ExportOrders).Methods("GET")
+	router.HandleFunc("/api/orders/exports", CreateOrderExportJob).Methods("POST")
+	router.HandleFunc("/api/orders/exports/{id}", GetOrderExportJob).Methods("GET")
+	router.HandleFunc("/api/orders/exports/{id}/download", DownloadOrderExport).Methods("GET")
 	router.HandleFunc("/api/orders", CreateOrder).Methods("POST")
 	router.HandleFunc("/api/orders", GetOrders).Methods("GET")
 	router.HandleFunc("/api/orders/{id}", GetOrderDetails).Methods("GET")
 	router.HandleFunc("/api/orders/{id}/cancel", CancelOrder).Methods("DELETE")
+	router.HandleFunc("/api/orders/{id}/receipt", GetOrderReceipt).Methods("GET")
+	router.HandleFunc("/api/orders/{id}/proof/{kind}", GetProofOfDeliveryFile).Methods("GET")
+	router.HandleFunc("/api/orders/{id}/stops/{stopId}/proof/{kind}", GetProofOfDeliveryFile).Methods("GET")
+	router.HandleFunc("/api/orders/{id}/pins", GetOrderHandoverPins).Methods("GET")
+	router.HandleFunc("/api/orders/{id}/reschedule", RescheduleDelivery).Methods("PUT")
+	router.HandleFunc("/api/orders/{orderId}/rate-courier", RateCourier).Methods("POST")
+	router.HandleFunc("/api/orders/{orderId}/chat", GetOrderChat).Methods("GET")
+	router.HandleFunc("/api/orders/{orderId}/chat", SendOrderChatMessage).Methods("POST")
+	router.HandleFunc("/api/orders/{orderId}/chat/read", MarkOrderChatRead).Methods("PUT")
+	router.HandleFunc("/api/orders/{orderId}/chat/stream", StreamOrderChat).Methods("GET")
+	router.HandleFunc("/api/tickets", CreateTicket).Methods("POST")
+	router.HandleFunc("/api/tickets", GetTickets).Methods("GET")
+	router.HandleFunc("/api/tickets/{id}", GetTicket).Methods("GET")
+	router.HandleFunc("/api/tickets/{id}/comments", AddTicketComment).Methods("POST")
+	router.HandleFunc("/api/tickets/{id}/attachments/{attachmentId}", GetTicketAttachment).Methods("GET")
+	router.HandleFunc("/api/templates", CreateOrderTemplate).Methods("POST")
+	router.HandleFunc("/api/templates", GetOrderTemplates).Methods("GET")
+	router.HandleFunc("/api/templates/{id}", UpdateOrderTemplate).Methods("PUT")
+	router.HandleFunc("/api/templates/{id}", DeleteOrderTemplate).Methods("DELETE")
+	router.HandleFunc("/api/templates/{id}/pause", PauseOrderTemplate).Methods("POST")
+	router.HandleFunc("/api/templates/{id}/resume", ResumeOrderTemplate).Methods("POST")
+	router.HandleFunc("/api/templates/{id}/skip", SkipOrderTemplateOccurrence).Methods("POST")
+	router.HandleFunc("/api/wallet", GetWalletBalance).Methods("GET")
+	router.HandleFunc("/api/track/{token}", TrackOrder).Methods("GET")
+	router.HandleFunc("/api/wallet/statement", GetWalletStatement).Methods("GET")
+	router.HandleFunc("/api/notifications/preferences", GetNotificationPreferences).Methods("GET")
+	router.HandleFunc("/api/notifications/preferences", UpdateNotificationPreferences).Methods("PUT")
+	router.HandleFunc("/api/webhooks", CreateWebhookEndpoint).Methods("POST")
+	router.HandleFunc("/api/webhooks", GetWebhookEndpoints).Methods("GET")
+	router.HandleFunc("/api/webhooks/{id}", DeleteWebhookEndpoint).Methods("DELETE")
+
+	//Merchant
+	router.HandleFunc("/api/merchants/register", RegisterMerchant).Methods("POST")
+	router.HandleFunc("/api/merchants/login", LoginMerchant).Methods("POST")
+	router.HandleFunc("/api/merchant/keys", CreateAPIKey).Methods("POST")
+	router.HandleFunc("/api/merchant/keys", GetAPIKeys).Methods("GET")
+	router.HandleFunc("/api/merchant/keys/{id}/rotate", RotateAPIKey).Methods("POST")
+	router.HandleFunc("/api/merchant/keys/{id}", RevokeAPIKey).Methods("DELETE")
 
 	//Courier
 	router.HandleFunc("/api/register-courier", RegisterCourier).Methods("POST")
@@ -81,23 +213,83 @@ func main() {
 	router.HandleFunc("/api/orders/{orderId}/accept", AcceptOrder).Methods("POST")
 	router.HandleFunc("/api/orders/{orderId}/decline", DeclineOrder).Methods("POST")
 	router.HandleFunc("/api/orders/{orderId}/update-status", UpdateOrderStatusByCourier).Methods("PUT")
+	router.HandleFunc("/api/orders/{orderId}/proof-of-delivery", UploadProofOfDelivery).Methods("POST")
+	router.HandleFunc("/api/orders/{orderId}/stops/{stopId}/status", UpdateStopStatus).Methods("PUT")
+	router.HandleFunc("/api/orders/{orderId}/rate-customer", RateCustomer).Methods("POST")
+	router.HandleFunc("/api/orders/{orderId}/stops/{stopId}/proof-of-delivery", UploadStopProofOfDelivery).Methods("POST")
 	router.HandleFunc("/api/couriers", GetCouriers).Methods("GET")
 	router.HandleFunc("/api/courier/orders/assigned/{courierId}", GetOrdersAssignedToCourierByID).Methods("GET")
+	router.HandleFunc("/api/courier/route", GetCourierRoute).Methods("GET")
+	router.HandleFunc("/api/courier/location", UpdateCourierLocation).Methods("PUT")
+	router.HandleFunc("/api/courier/earnings", GetCourierEarnings).Methods("GET")
+	router.HandleFunc("/api/courier/ratings", GetCourierRatings).Methods("GET")
+	router.HandleFunc("/api/courier/payouts", GetCourierPayouts).Methods("GET")
+	router.HandleFunc("/api/courier/payouts/{id}/statement", GetCourierPayoutStatement).Methods("GET")
+	router.HandleFunc("/api/courier/notifications/preferences", GetCourierNotificationPreferences).Methods("GET")
+	router.HandleFunc("/api/courier/notifications/preferences", UpdateCourierNotificationPreferences).Methods("PUT")
 
 	//Admin
 	router.HandleFunc("/api/admin/login", LoginAdmin).Methods("POST")
 	router.HandleFunc("/api/admin/orders", GetAllOrders).Methods("GET")
+	router.HandleFunc("/api/admin/orders/export", ExportAllOrders).Methods("GET")
+	router.HandleFunc("/api/admin/exports", CreateAdminExportJob).Methods("POST")
+	router.HandleFunc("/api/admin/exports/{id}", GetAdminExportJob).Methods("GET")
+	router.HandleFunc("/api/admin/exports/{id}/download", DownloadAdminExport).Methods("GET")
 	router.HandleFunc("/api/admin/orders/{id}/status", UpdateOrderStatus).Methods("PUT")
 	router.HandleFunc("/api/admin/orders/{id}", DeleteOrder).Methods("DELETE")
 	router.HandleFunc("/api/admin/orders/{orderId}/assign-courier", AssignCourierToOrder).Methods("POST")
 	router.HandleFunc("/api/admin/orders/{orderId}/reassign-courier", ReassignCourierToOrder).Methods("PUT")
+	router.HandleFunc("/api/admin/orders/{orderId}/handover-override", OverrideHandover).Methods("POST")
+	router.HandleFunc("/api/admin/orders/{orderId}/courier-suggestions", GetCourierSuggestions).Methods("GET")
+	router.HandleFunc("/api/admin/orders/{orderId}/geofence-events", GetGeofenceEvents).Methods("GET")
+	router.HandleFunc("/api/admin/zones", CreateServiceZone).Methods("POST")
+	router.HandleFunc("/api/admin/zones", GetServiceZones).Methods("GET")
+	router.HandleFunc("/api/admin/zones/{id}", UpdateServiceZone).Methods("PUT")
+	router.HandleFunc("/api/admin/zones/{id}", DeleteServiceZone).Methods("DELETE")
 	router.HandleFunc("/api/courier/orders", GetOrdersAssignedToCourier).Methods("GET")
+	router.HandleFunc("/api/admin/users/{userId}/wallet/top-up", TopUpWallet).Methods("POST")
+	router.HandleFunc("/api/admin/users/{userId}/wallet/adjust", AdjustWallet).Methods("POST")
+	router.HandleFunc("/api/admin/users/{userId}/wallet/statement", GetUserWalletStatement).Methods("GET")
+	router.HandleFunc("/api/admin/payouts", GeneratePayoutBatch).Methods("POST")
+	router.HandleFunc("/api/admin/payouts", GetPayouts).Methods("GET")
+	router.HandleFunc("/api/admin/payouts/{id}/paid", MarkPayoutPaid).Methods("PUT")
+	router.HandleFunc("/api/admin/payouts/{id}/statement", GetPayoutStatement).Methods("GET")
+	router.HandleFunc("/api/admin/invoices", GetInvoices).Methods("GET")
+	router.HandleFunc("/api/admin/invoices/monthly", GenerateMonthlyInvoices).Methods("POST")
+	router.HandleFunc("/api/admin/invoices/{id}", GetInvoice).Methods("GET")
+	router.HandleFunc("/api/admin/sla/orders", GetSLAOrders).Methods("GET")
+	router.HandleFunc("/api/admin/analytics/orders", GetOrderVolume).Methods("GET")
+	router.HandleFunc("/api/admin/analytics/funnel", GetStatusFunnel).Methods("GET")
+	router.HandleFunc("/api/admin/analytics/transitions", GetTimelineTransitions).Methods("GET")
+	router.HandleFunc("/api/admin/analytics/couriers", GetCourierStats).Methods("GET")
+	router.HandleFunc("/api/admin/analytics/revenue", GetRevenue).Methods("GET")
+	router.HandleFunc("/api/admin/analytics/zones", GetZoneHeatmap).Methods("GET")
+	router.HandleFunc("/api/admin/notifications", GetNotifications).Methods("GET")
+	router.HandleFunc("/api/admin/ratings", GetRatings).Methods("GET")
+	router.HandleFunc("/api/admin/ratings/{id}/moderate", ModerateRating).Methods("PUT")
+	router.HandleFunc("/api/admin/tickets", GetAllTickets).Methods("GET")
+	router.HandleFunc("/api/admin/tickets/{id}", GetTicketAdmin).Methods("GET")
+	router.HandleFunc("/api/admin/tickets/{id}/assign", AssignTicket).Methods("PUT")
+	router.HandleFunc("/api/admin/tickets/{id}/comments", AddTicketCommentAdmin).Methods("POST")
+	router.HandleFunc("/api/admin/tickets/{id}/status", UpdateTicketStatus).Methods("PUT")
+	router.HandleFunc("/api/admin/tickets/{id}/resolve", ResolveTicket).Methods("POST")
+	router.HandleFunc("/api/admin/tickets/{id}/attachments/{attachmentId}", GetTicketAttachmentAdmin).Methods("GET")
+	router.HandleFunc("/api/admin/webhooks/deliveries", GetWebhookDeliveries).Methods("GET")
+	router.HandleFunc("/api/admin/webhooks/deliveries/{id}/replay", ReplayWebhookDelivery).Methods("POST")
+	router.HandleFunc("/api/admin/sla/events", GetSLAEvents).Methods("GET")
+	router.HandleFunc("/api/admin/sla/events/{id}/acknowledge", AcknowledgeSLAEvent).Methods("PUT")
+	router.HandleFunc("/api/admin/audit", GetAuditLog).Methods("GET")
+	router.HandleFunc("/api/admin/audit/verify", VerifyAuditLog).Methods("GET")
+	router.HandleFunc("/api/admin/login-locks", GetLoginLocks).Methods("GET")
+	router.HandleFunc("/api/admin/login-locks/unlock", UnlockLogin).Methods("POST")
+	router.HandleFunc("/api/admin/security/alerts", GetSecurityAlerts).Methods("GET")
+	router.HandleFunc("/api/admin/security/alerts/{id}/acknowledge", AcknowledgeSecurityAlert).Methods("PUT")
 
 	corsHandler := handlers.CORS(
 		handlers.AllowedOrigins([]string{"http://localhost:3000"}),
 		handlers.AllowedMethods([]string{"POST", "GET", "OPTIONS", "PUT", "DELETE"}),
 		handlers.AllowedHeaders([]string{"Content-Type"}),
-		handlers.AllowedHeaders([]string{"Content-Type", "userId"}),
+		handlers.AllowedHeaders([]string{"Content-Type", "userId", "merchantId", "Authorization"}),
 	)
 
 	log.Fatal(http.ListenAndServe(":8001", corsHandler(router)))
@@ -141,6 +333,7 @@ func RegisterUser(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to register user", http.StatusInternalServerError)
 		return
 	}
+	auditAuth(r, "auth.registered", "user", user.Email, auditSuccess)
 
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode("User registered successfully")
@@ -174,17 +367,12 @@ func LoginUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	collection := client.Database("myapp").Collection("users")
-
 	var existingUser User
-	err = collection.FindOne(context.TODO(), bson.M{"email": user.Email}).Decode(&existingUser)
-	if err != nil {
-		http.Error(w, "User not found", http.StatusUnauthorized)
-		return
-	}
-
-	if existingUser.Password != user.Password {
-		http.Error(w, "Invalid password", http.StatusUnauthorized)
+	ok := authenticate(w, r, "user", user.Email, func(ctx context.Context) (bool, error) {
+		found, err := findForLogin(ctx, "users", bson.M{"email": user.Email}, &existingUser)
+		return found && passwordMatches(existingUser.Password, user.Password), err
+	})
+	if !ok {
 		return
 	}
 
@@ -203,49 +391,166 @@ func CreateOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userIDStr := r.Header.Get("userId")
-	if userIDStr == "" {
-		http.Error(w, "UserID is required", http.StatusBadRequest)
-		return
-	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 
-	userID, err := primitive.ObjectIDFromHex(userIDStr)
+	accountID, merchant, err := requestAccount(ctx, r, scopeOrdersCreate)
 	if err != nil {
-		http.Error(w, "Invalid UserID format", http.StatusBadRequest)
+		writeAccountError(w, err)
 		return
 	}
 
-	order.UserID = userID
-
-	collection := client.Database("myapp").Collection("orders")
-
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
+	order.TemplateID = nil
+	order.Occurrence = ""
+	order.MerchantID = nil
+	if merchant != nil {
+		order.MerchantID = &merchant.ID
+	}
 
-	result, err := collection.InsertOne(ctx, order)
+	order, err = createOrder(ctx, primitive.NewObjectID(), order, accountID)
+	if oerr, ok := err.(*orderError); ok {
+		http.Error(w, oerr.Message, oerr.Status)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Failed to create order", http.StatusInternalServerError)
 		return
 	}
 
 	response := map[string]interface{}{
-		"message": "Order created successfully",
-		"orderId": result.InsertedID,
+		"message":     "Order created successfully",
+		"orderId":     order.ID,
+		"price":       order.Price,
+		"trackingUrl": "/api/track/" + order.TrackingToken,
+	}
+	senderPins(order, response)
+	if len(order.Stops) > 0 {
+		response["stops"] = order.Stops
 	}
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(response)
 }
 
-func GetOrders(w http.ResponseWriter, r *http.Request) {
-	userIDStr := r.Header.Get("userId")
-	if userIDStr == "" {
-		http.Error(w, "UserID is required", http.StatusBadRequest)
-		return
+// orderError is a problem with the submitted order that is reported back to
+// the client as is.
+type orderError struct {
+	Status  int
+	Message string
+}
+
+func (e *orderError) Error() string { return e.Message }
+
+// createOrder validates, prices, charges and stores a new order for userID
+// under orderID. Every way of creating customer orders goes through here.
+// Calling it again with the same orderID, say after a crash, neither charges
+// twice nor stores a second order; it returns the order already stored.
+func createOrder(ctx context.Context, orderID primitive.ObjectID, order Order, userID primitive.ObjectID) (Order, error) {
+	order, err := prepareOrder(ctx, order, userID)
+	if err != nil {
+		return order, err
+	}
+	order.ID = orderID
+
+	if order.PaymentMethod == paymentMethodWallet {
+		err = chargeWallet(ctx, userID, order.ID, orderTotal(order))
+		if err == errInsufficientFunds {
+			return order, &orderError{http.StatusPaymentRequired, "Insufficient wallet balance"}
+		}
+		if err != nil {
+			return order, err
+		}
+	}
+
+	if err := insertOrder(ctx, order); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			var existing Order
+			if ferr := client.Database("myapp").Collection("orders").FindOne(ctx, bson.M{"_id": orderID}).Decode(&existing); ferr == nil {
+				return existing, nil
+			}
+		}
+		refundOrderCharge(ctx, order, "Order creation failed")
+		return order, err
+	}
+
+	return order, nil
+}
+
+// prepareOrder validates and prices an order for userID without charging or
+// storing it.
+func prepareOrder(ctx context.Context, order Order, userID primitive.ObjectID) (Order, error) {
+	var err error
+
+	order.UserID = userID
+	order.ID = primitive.NewObjectID()
+
+	if err := prepareStops(&order); err != nil {
+		return order, &orderError{http.StatusBadRequest, "Invalid stops: " + err.Error()}
+	}
+	order.Price = priceOrder(order)
+	order.CourierID = nil
+	order.DeliveredAt = nil
+	order.ProofOfDelivery = nil
+	order.DeliveryAttempts = nil
+	order.NextAttemptAt = nil
+	order.ReturnOrderID = nil
+	order.ReturnOf = nil
+	order.PickedUpAt = nil
+	order.ETA = nil
+	order.SLA = nil
+	order.ZoneID = nil
+	order.Geofence = nil
+	order.Declines = nil
+	order.Disputes = nil
+	order.RedeliveryOf = nil
+
+	order.Handover, err = newHandover()
+	if err != nil {
+		return order, err
+	}
+	order.TrackingToken, err = newTrackingToken()
+	if err != nil {
+		return order, err
+	}
+
+	if order.Tip < 0 {
+		return order, &orderError{http.StatusBadRequest, "Tip cannot be negative"}
+	}
+
+	now := time.Now()
+	if err := validateOrderWindows(&order, now); err != nil {
+		return order, &orderError{http.StatusBadRequest, "Invalid time window: " + err.Error()}
+	}
+	if order.PickupWindow != nil {
+		order.Status = "Pending"
+		if order.PickupWindow.Earliest.After(now.Add(dispatchLead)) {
+			order.Status = "Scheduled"
+		}
+	}
+
+	dispatchAt := now
+	if order.PickupWindow != nil && order.PickupWindow.Earliest.After(now) {
+		dispatchAt = order.PickupWindow.Earliest
+	}
+	zone, err := zoneForOrder(ctx, order, dispatchAt)
+	if err != nil {
+		return order, err
+	}
+	if zone != nil {
+		order.ZoneID = &zone.ID
+		order.Price = zone.price(order.Price)
 	}
 
-	userID, err := primitive.ObjectIDFromHex(userIDStr)
+	if order.PaymentMethod != "" && order.PaymentMethod != paymentMethodWallet {
+		return order, &orderError{http.StatusBadRequest, "Unsupported payment method"}
+	}
+
+	return order, nil
+}
+
+func GetOrders(w http.ResponseWriter, r *http.Request) {
+	userID, _, err := requestAccount(context.TODO(), r, scopeOrdersRead)
 	if err != nil {
-		http.Error(w, "Invalid UserID format", http.StatusBadRequest)
+		writeAccountError(w, err)
 		return
 	}
 
@@ -263,9 +568,7 @@ func GetOrders(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userCollection := client.Database("myapp").Collection("users")
-	var user User
-	err = userCollection.FindOne(context.TODO(), bson.M{"_id": userID}).Decode(&user)
+	user, err := findAccount(context.TODO(), userID)
 	if err != nil {
 		http.Error(w, "User not found", http.StatusNotFound)
 		return
@@ -273,6 +576,7 @@ func GetOrders(w http.ResponseWriter, r *http.Request) {
 
 	for i := range orders {
 		orders[i].UserName = user.Name
+		orders[i].CourierPhone = maskPhone(orders[i].CourierPhone)
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -297,6 +601,18 @@ func GetOrderDetails(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Order not found", http.StatusNotFound)
 		return
 	}
+	order.setProofURLs()
+	order.CourierPhone = maskPhone(order.CourierPhone)
+
+	now := time.Now().UTC()
+	if eta, err := newETAEstimator(now).estimate(ctx, order); err == nil {
+		order.ETA = eta
+	} else {
+		log.Println("Failed to estimate ETA:", err)
+	}
+	if containsStatus(etaStatuses, order.Status) {
+		order.SLA = evaluateSLA(order, order.ETA, now)
+	}
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(order)
@@ -326,17 +642,21 @@ func CancelOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if order.Status != "Pending" && order.Status != "Pending acceptance" {
+	if order.Status != "Pending" && order.Status != "Pending acceptance" && order.Status != "Scheduled" {
 		http.Error(w, "Order cannot be canceled because it's not in a cancellable state", http.StatusBadRequest)
 		return
 	}
 
-	deleteResult, err := collection.DeleteOne(ctx, bson.M{"_id": orderID})
-	if err != nil || deleteResult.DeletedCount == 0 {
+	if err := deleteOrder(ctx, order, "Canceled", eventOrderCancelled); err != nil {
 		http.Error(w, "Failed to cancel order", http.StatusInternalServerError)
 		return
 	}
 
+	if err := refundOrQueue(ctx, order, "Order canceled"); err != nil {
+		http.Error(w, "Order canceled, but the refund failed; contact support", http.StatusInternalServerError)
+		return
+	}
+
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode("Order canceled successfully")
 }
@@ -365,6 +685,7 @@ func RegisterCourier(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to register courier", http.StatusInternalServerError)
 		return
 	}
+	auditAuth(r, "auth.registered", "courier", courier.Email, auditSuccess)
 
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode("Courier registered successfully")
@@ -397,17 +718,12 @@ func LoginCourier(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	collection := client.Database("myapp").Collection("couriers")
-
 	var existingCourier Courier
-	err = collection.FindOne(context.TODO(), bson.M{"email": courier.Email}).Decode(&existingCourier)
-	if err != nil {
-		http.Error(w, "Courier not found", http.StatusUnauthorized)
-		return
-	}
-
-	if existingCourier.Password != courier.Password {
-		http.Error(w, "Invalid password", http.StatusUnauthorized)
+	ok := authenticate(w, r, "courier", courier.Email, func(ctx context.Context) (bool, error) {
+		found, err := findForLogin(ctx, "couriers", bson.M{"email": courier.Email}, &existingCourier)
+		return found && passwordMatches(existingCourier.Password, courier.Password), err
+	})
+	if !ok {
 		return
 	}
 
@@ -467,7 +783,7 @@ func AcceptOrder(w http.ResponseWriter, r *http.Request) {
 		},
 	}
 
-	_, err = orderCollection.UpdateOne(context.TODO(), bson.M{"_id": orderID}, update)
+	_, err = updateOrder(context.TODO(), bson.M{"_id": orderID}, update, "")
 	if err != nil {
 		http.Error(w, "Failed to accept the order", http.StatusInternalServerError)
 		return
@@ -517,9 +833,12 @@ func DeclineOrder(w http.ResponseWriter, r *http.Request) {
 		"$set": bson.M{
 			"status": "Pending",
 		},
+		"$push": bson.M{
+			"declines": CourierDecline{CourierEmail: request.Email, At: time.Now().UTC()},
+		},
 	}
 
-	_, err = orderCollection.UpdateOne(context.TODO(), bson.M{"_id": orderID}, update)
+	_, err = updateOrder(context.TODO(), bson.M{"_id": orderID}, update, "")
 	if err != nil {
 		http.Error(w, "Failed to decline the order", http.StatusInternalServerError)
 		return
@@ -539,6 +858,9 @@ func UpdateOrderStatusByCourier(w http.ResponseWriter, r *http.Request) {
 	var request struct {
 		Status string `json:"status"`
 		Email  string `json:"email"`
+		Pin    string `json:"pin"`
+		Reason string `json:"reason"`
+		Note   string `json:"note"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
@@ -546,11 +868,16 @@ func UpdateOrderStatusByCourier(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if request.Status != "Picked up" && request.Status != "In transit" && request.Status != "Delivered" {
+	if request.Status != "Picked up" && request.Status != "In transit" && request.Status != "Delivered" && request.Status != "Delivery failed" {
 		http.Error(w, "Invalid status", http.StatusBadRequest)
 		return
 	}
 
+	if request.Status == "Delivery failed" && !deliveryFailureReasons[request.Reason] {
+		http.Error(w, "A valid failure reason is required", http.StatusBadRequest)
+		return
+	}
+
 	orderCollection := client.Database("myapp").Collection("orders")
 	var order Order
 	err = orderCollection.FindOne(context.TODO(), bson.M{"_id": orderID}).Decode(&order)
@@ -564,22 +891,109 @@ func UpdateOrderStatusByCourier(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if len(order.Stops) > 0 && (request.Status == "Delivered" || request.Status == "Delivery failed") {
+		http.Error(w, "Multi-stop orders are delivered by updating their stops", http.StatusConflict)
+		return
+	}
+
+	// An order awaiting a reattempt goes back out for delivery once the
+	// attempt is due, and not before.
+	if order.Status == "Reattempt scheduled" {
+		if request.Status != "In transit" {
+			http.Error(w, "The order must go back out for delivery first", http.StatusConflict)
+			return
+		}
+		if order.NextAttemptAt != nil && order.NextAttemptAt.After(time.Now()) {
+			http.Error(w, "The next delivery attempt is not due yet", http.StatusConflict)
+			return
+		}
+	}
+
+	if request.Status == "Delivered" && !order.ProofOfDelivery.complete() {
+		http.Error(w, "Proof of delivery is required before marking the order delivered", http.StatusConflict)
+		return
+	}
+
+	if request.Status == "Delivery failed" {
+		if order.Status != "Picked up" && order.Status != "In transit" {
+			http.Error(w, "Only orders out for delivery can fail", http.StatusConflict)
+			return
+		}
+
+		status, returnOrder, err := recordFailedAttempt(context.TODO(), order, DeliveryAttempt{
+			Reason:       request.Reason,
+			Note:         request.Note,
+			CourierEmail: request.Email,
+			At:           time.Now().UTC(),
+		})
+		if err != nil {
+			http.Error(w, "Failed to record delivery attempt", http.StatusInternalServerError)
+			return
+		}
+
+		response := map[string]interface{}{
+			"message": "Delivery attempt recorded",
+			"status":  status,
+		}
+		if returnOrder != nil {
+			response["returnOrderId"] = returnOrder.ID
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	if writePinError(w, verifyHandoverPin(context.TODO(), order, request.Status, request.Pin)) {
+		return
+	}
+
+	set := bson.M{
+		"status": request.Status,
+	}
+	if request.Status == "Picked up" {
+		set["pickedUpAt"] = time.Now().UTC()
+	}
+	if request.Status == "Delivered" {
+		set["deliveredAt"] = time.Now().UTC()
+	}
 	update := bson.M{
-		"$set": bson.M{
-			"status": request.Status,
-		},
+		"$set": set,
+	}
+	filter := bson.M{"_id": orderID}
+	if order.Status == "Reattempt scheduled" {
+		filter["status"] = order.Status
+		update["$unset"] = bson.M{"nextAttemptAt": ""}
 	}
 
-	_, err = orderCollection.UpdateOne(context.TODO(), bson.M{"_id": orderID}, update)
+	order, err = updateOrder(context.TODO(), filter, update, "")
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Order status changed, try again", http.StatusConflict)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Failed to update order status", http.StatusInternalServerError)
 		return
 	}
 
+	if request.Status == "Delivered" {
+		onOrderDelivered(context.TODO(), order)
+	}
+
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode("Order status updated successfully")
 }
 
+// onOrderDelivered runs the bookkeeping that follows a delivery. Failures
+// are logged rather than undoing the delivery.
+func onOrderDelivered(ctx context.Context, order Order) {
+	if err := recordCourierEarning(ctx, order); err != nil {
+		log.Println("Failed to record courier earning:", err)
+	}
+	if _, err := ensureOrderInvoice(ctx, order); err != nil {
+		log.Println("Failed to issue order invoice:", err)
+	}
+}
+
 // ADMIN Features
 func LoginAdmin(w http.ResponseWriter, r *http.Request) {
 	var admin User
@@ -589,17 +1003,12 @@ func LoginAdmin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	collection := client.Database("myapp").Collection("users")
-
 	var existingAdmin User
-	err = collection.FindOne(context.TODO(), bson.M{"email": admin.Email, "role": "admin"}).Decode(&existingAdmin)
-	if err != nil {
-		http.Error(w, "Admin not found", http.StatusUnauthorized)
-		return
-	}
-
-	if existingAdmin.Password != admin.Password {
-		http.Error(w, "Invalid password", http.StatusUnauthorized)
+	ok := authenticate(w, r, "admin", admin.Email, func(ctx context.Context) (bool, error) {
+		found, err := findForLogin(ctx, "users", bson.M{"email": admin.Email, "role": "admin"}, &existingAdmin)
+		return found && passwordMatches(existingAdmin.Password, admin.Password), err
+	})
+	if !ok {
 		return
 	}
 
@@ -611,9 +1020,18 @@ func LoginAdmin(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 func GetAllOrders(w http.ResponseWriter, r *http.Request) {
+	filter, err := orderListFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, "Invalid filter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	collection := client.Database("myapp").Collection("orders")
 
 	pipeline := []bson.M{
+		{
+			"$match": filter,
+		},
 		{
 			"$lookup": bson.M{
 				"from":         "users",
@@ -622,12 +1040,24 @@ func GetAllOrders(w http.ResponseWriter, r *http.Request) {
 				"as":           "user_details",
 			},
 		},
+		// Merchant orders have no user; their name comes from merchants.
+		{
+			"$lookup": bson.M{
+				"from":         "merchants",
+				"localField":   "userId",
+				"foreignField": "_id",
+				"as":           "merchant_details",
+			},
+		},
 		{
-			"$unwind": "$user_details",
+			"$unwind": bson.M{"path": "$user_details", "preserveNullAndEmptyArrays": true},
+		},
+		{
+			"$unwind": bson.M{"path": "$merchant_details", "preserveNullAndEmptyArrays": true},
 		},
 		{
 			"$project": bson.M{
-				"userName":        "$user_details.name",
+				"userName":        bson.M{"$ifNull": bson.A{"$user_details.name", "$merchant_details.name"}},
 				"pickupLocation":  1,
 				"dropOffLocation": 1,
 				"packageDetails":  1,
@@ -712,15 +1142,26 @@ func UpdateOrderStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	collection := client.Database("myapp").Collection("orders")
+	var before Order
+	err = client.Database("myapp").Collection("orders").FindOne(context.TODO(), bson.M{"_id": orderID}).Decode(&before)
+	if err != nil {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+
 	filter := bson.M{"_id": orderID}
 	updateData := bson.M{"$set": bson.M{"status": update.Status}}
 
-	_, err = collection.UpdateOne(context.TODO(), filter, updateData)
+	after, err := updateOrder(context.TODO(), filter, updateData, "")
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Failed to update order", http.StatusInternalServerError)
 		return
 	}
+	auditAction(r, "order.status_updated", "order", orderIDStr, before, after)
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode("Order status updated successfully")
@@ -735,16 +1176,30 @@ func DeleteOrder(w http.ResponseWriter, r *http.Request) {
 
 	collection := client.Database("myapp").Collection("orders")
 
-	result, err := collection.DeleteOne(context.TODO(), bson.M{"_id": orderID})
+	var order Order
+	err = collection.FindOne(context.TODO(), bson.M{"_id": orderID}).Decode(&order)
 	if err != nil {
-		http.Error(w, "Failed to delete order", http.StatusInternalServerError)
+		http.Error(w, "Order not found", http.StatusNotFound)
 		return
 	}
 
-	if result.DeletedCount == 0 {
+	err = deleteOrder(context.TODO(), order, order.Status, eventOrderDeleted)
+	if err == mongo.ErrNoDocuments {
 		http.Error(w, "Order not found", http.StatusNotFound)
 		return
 	}
+	if err != nil {
+		http.Error(w, "Failed to delete order", http.StatusInternalServerError)
+		return
+	}
+
+	auditAction(r, "order.deleted", "order", orderIDStr, order, nil)
+
+	if err := refundOrQueue(context.TODO(), order, "Order deleted by admin"); err != nil {
+		log.Println("Failed to refund deleted order:", err)
+		http.Error(w, "Order deleted, but the refund failed", http.StatusInternalServerError)
+		return
+	}
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode("Order deleted successfully")
@@ -766,6 +1221,38 @@ func AssignCourierToOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	orderCollection := client.Database("myapp").Collection("orders")
+	var order Order
+	err = orderCollection.FindOne(context.TODO(), bson.M{"_id": orderID}).Decode(&order)
+	if err != nil {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+
+	if order.CourierEmail != "" {
+		http.Error(w, "Order is already assigned to a courier", http.StatusConflict)
+		return
+	}
+	if order.Status == "Scheduled" {
+		http.Error(w, "Scheduled orders are assigned once they are released for dispatch", http.StatusConflict)
+		return
+	}
+
+	// Without an email the best ranked courier is dispatched, preferring
+	// the pickup zone's pool.
+	if request.Email == "" {
+		suggestions, err := suggestCouriers(context.TODO(), order)
+		if err != nil {
+			http.Error(w, "Failed to rank couriers", http.StatusInternalServerError)
+			return
+		}
+		if len(suggestions) == 0 {
+			http.Error(w, "No courier is available for this order", http.StatusConflict)
+			return
+		}
+		request.Email = suggestions[0].Email
+	}
+
 	var courier Courier
 	courierCollection := client.Database("myapp").Collection("couriers")
 	err = courierCollection.FindOne(context.TODO(), bson.M{"email": request.Email}).Decode(&courier)
@@ -774,20 +1261,19 @@ func AssignCourierToOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	orderCollection := client.Database("myapp").Collection("orders")
-	var order Order
-	err = orderCollection.FindOne(context.TODO(), bson.M{"_id": orderID}).Decode(&order)
+	ok, reason, err := courierCanMeetWindow(context.TODO(), courier, order)
 	if err != nil {
-		http.Error(w, "Order not found", http.StatusNotFound)
+		http.Error(w, "Failed to check courier availability", http.StatusInternalServerError)
 		return
 	}
-
-	if order.CourierEmail != "" {
-		http.Error(w, "Order is already assigned to a courier", http.StatusConflict)
+	if !ok {
+		http.Error(w, "Courier cannot meet the order's time window: "+reason, http.StatusConflict)
 		return
 	}
 
-	filter := bson.M{"_id": orderID}
+	// Only an unassigned order is updated, so of two concurrent assignments
+	// the second finds nothing to match.
+	filter := bson.M{"_id": orderID, "courierEmail": bson.M{"$in": bson.A{nil, ""}}}
 	update := bson.M{
 		"$set": bson.M{
 			"courierId":    courier.ID,
@@ -796,11 +1282,16 @@ func AssignCourierToOrder(w http.ResponseWriter, r *http.Request) {
 		},
 	}
 
-	_, err = orderCollection.UpdateOne(context.TODO(), filter, update)
+	updated, err := updateOrder(context.TODO(), filter, update, "")
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Order is already assigned to a courier", http.StatusConflict)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Failed to assign courier to order", http.StatusInternalServerError)
 		return
 	}
+	auditAction(r, "order.courier_assigned", "order", orderIDStr, order, updated)
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode("Courier assigned to order successfully")
@@ -849,6 +1340,16 @@ func ReassignCourierToOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ok, reason, err := courierCanMeetWindow(context.TODO(), courier, order)
+	if err != nil {
+		http.Error(w, "Failed to check courier availability", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "Courier cannot meet the order's time window: "+reason, http.StatusConflict)
+		return
+	}
+
 	filter := bson.M{"_id": orderID}
 	update := bson.M{
 		"$set": bson.M{
@@ -860,16 +1361,16 @@ func ReassignCourierToOrder(w http.ResponseWriter, r *http.Request) {
 		},
 	}
 
-	result, err := orderCollection.UpdateOne(context.TODO(), filter, update)
-	if err != nil {
-		http.Error(w, "Failed to reassign courier to order", http.StatusInternalServerError)
+	updated, err := updateOrder(context.TODO(), filter, update, "")
+	if err == mongo.ErrNoDocuments {
+		http.Error(w, "Order not found or no changes made", http.StatusConflict)
 		return
 	}
-
-	if result.MatchedCount == 0 {
-		http.Error(w, "Order not found or no changes made", http.StatusConflict)
+	if err != nil {
+		http.Error(w, "Failed to reassign courier to order", http.StatusInternalServerError)
 		return
 	}
+	auditAction(r, "order.courier_reassigned", "order", orderIDStr, order, updated)
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode("Order reassigned successfully, pending courier acceptance")
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	scopeOrdersCreate   = "orders:create"
+	scopeOrdersRead     = "orders:read"
+	scopeWebhooksManage = "webhooks:manage"
+
+	apiKeyPrefix          = "mk_"
+	merchantSessionPrefix = "ms_"
+)
+
+var apiKeyScopes = []string{scopeOrdersCreate, scopeOrdersRead, scopeWebhooksManage}
+
+var (
+	// apiKeyRotationGrace is how long a rotated key keeps working, so
+	// integrations can switch over without downtime.
+	apiKeyRotationGrace = time.Duration(envInt("API_KEY_ROTATION_GRACE_HOURS", 24)) * time.Hour
+	// lastUsedResolution limits lastUsedAt writes to one per key per period.
+	lastUsedResolution = time.Minute
+	// merchantSessionTTL is how long a dashboard login lasts.
+	merchantSessionTTL = time.Duration(envInt("MERCHANT_SESSION_HOURS", 12)) * time.Hour
+)
+
+// Merchant is a business account. Its orders are charged to and owned by
+// the merchant's ID in place of a user ID, so wallets, webhooks and
+// invoices work for merchants unchanged.
+type Merchant struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Name      string             `json:"name" bson:"name"`
+	Email     string             `json:"email" bson:"email"`
+	Phone     string             `json:"phone" bson:"phone"`
+	Password  string             `json:"password,omitempty" bson:"password"`
+	CreatedAt time.Time          `json:"createdAt" bson:"createdAt"`
+}
+
+// APIKey is stored by the SHA-256 of the key. Keys are long and random, so
+// a fast hash is enough; the plain key is only returned when issued.
+type APIKey struct {
+	ID         primitive.ObjectID  `json:"id" bson:"_id,omitempty"`
+	MerchantID primitive.ObjectID  `json:"merchantId" bson:"merchantId"`
+	Name       string              `json:"name" bson:"name"`
+	Prefix     string              `json:"prefix" bson:"prefix"`
+	Hash       string              `json:"-" bson:"hash"`
+	Scopes     []string            `json:"scopes" bson:"scopes"`
+	CreatedAt  time.Time           `json:"createdAt" bson:"createdAt"`
+	LastUsedAt *time.Time          `json:"lastUsedAt,omitempty" bson:"lastUsedAt,omitempty"`
+	ExpiresAt  *time.Time          `json:"expiresAt,omitempty" bson:"expiresAt,omitempty"`
+	RevokedAt  *time.Time          `json:"revokedAt,omitempty" bson:"revokedAt,omitempty"`
+	RotatedTo  *primitive.ObjectID `json:"rotatedTo,omitempty" bson:"rotatedTo,omitempty"`
+}
+
+// MerchantSession is a dashboard login, stored by the SHA-256 of its token
+// like an API key.
+type MerchantSession struct {
+	ID         primitive.ObjectID `bson:"_id"`
+	MerchantID primitive.ObjectID `bson:"merchantId"`
+	Hash       string             `bson:"hash"`
+	CreatedAt  time.Time          `bson:"createdAt"`
+	ExpiresAt  time.Time          `bson:"expiresAt"`
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// newAPIKey returns a fresh key and the record to store for it.
+func newAPIKey(merchantID primitive.ObjectID, name string, scopes []string) (string, APIKey, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", APIKey{}, err
+	}
+	key := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(b)
+	return key, APIKey{
+		ID:         primitive.NewObjectID(),
+		MerchantID: merchantID,
+		Name:       name,
+		Prefix:     key[:len(apiKeyPrefix)+6],
+		Hash:       hashAPIKey(key),
+		Scopes:     scopes,
+		CreatedAt:  time.Now().UTC(),
+	}, nil
+}
+
+func validScopes(scopes []string) bool {
+	if len(scopes) == 0 {
+		return false
+	}
+	for _, s := range scopes {
+		if !containsString(apiKeyScopes, s) {
+			return false
+		}
+	}
+	return true
+}
+
+// authenticateAPIKey resolves a bearer key to its merchant and records when
+// the key was last used.
+func authenticateAPIKey(ctx context.Context, key, scope string) (Merchant, error) {
+	var merchant Merchant
+	unauthorized := &orderError{http.StatusUnauthorized, "Invalid API key"}
+
+	var k APIKey
+	err := client.Database("myapp").Collection("api_keys").FindOne(ctx, bson.M{
+		"hash":      hashAPIKey(key),
+		"revokedAt": bson.M{"$exists": false},
+	}).Decode(&k)
+	if err == mongo.ErrNoDocuments {
+		return merchant, unauthorized
+	}
+	if err != nil {
+		return merchant, err
+	}
+
+	now := time.Now().UTC()
+	if k.ExpiresAt != nil && !now.Before(*k.ExpiresAt) {
+		return merchant, unauthorized
+	}
+	if !containsString(k.Scopes, scope) {
+		return merchant, &orderError{http.StatusForbidden, "API key lacks the " + scope + " scope"}
+	}
+
+	err = client.Database("myapp").Collection("merchants").FindOne(ctx, bson.M{"_id": k.MerchantID}).Decode(&merchant)
+	if err == mongo.ErrNoDocuments {
+		return merchant, unauthorized
+	}
+	if err != nil {
+		return merchant, err
+	}
+
+	client.Database("myapp").Collection("api_keys").UpdateOne(ctx, bson.M{
+		"_id": k.ID,
+		"$or": bson.A{
+			bson.M{"lastUsedAt": bson.M{"$exists": false}},
+			bson.M{"lastUsedAt": bson.M{"$lt": now.Add(-lastUsedResolution)}},
+		},
+	}, bson.M{"$set": bson.M{"lastUsedAt": now}})
+
+	return merchant, nil
+}
+
+// requestAccount returns the account a request acts for: the merchant of
+// the API key in the Authorization header, which must carry scope, or of
+// the dashboard session there, or else the logged in user named by the
+// userId header. merchant is nil for users. A merchant ID in the userId
+// header is refused, since it would bypass the key's scopes.
+func requestAccount(ctx context.Context, r *http.Request, scope string) (accountID primitive.ObjectID, merchant *Merchant, err error) {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		key := strings.TrimPrefix(auth, "Bearer ")
+		var m Merchant
+		switch {
+		case key == auth:
+			return accountID, nil, &orderError{http.StatusUnauthorized, "Invalid API key"}
+		case strings.HasPrefix(key, merchantSessionPrefix):
+			m, err = authenticateMerchantSession(ctx, key)
+		case strings.HasPrefix(key, apiKeyPrefix):
+			m, err = authenticateAPIKey(ctx, key, scope)
+		default:
+			return accountID, nil, &orderError{http.StatusUnauthorized, "Invalid API key"}
+		}
+		if err != nil {
+			return accountID, nil, err
+		}
+		return m.ID, &m, nil
+	}
+
+	userIDStr := r.Header.Get("userId")
+	if userIDStr == "" {
+		return accountID, nil, &orderError{http.StatusBadRequest, "UserID is required"}
+	}
+	accountID, err = primitive.ObjectIDFromHex(userIDStr)
+	if err != nil {
+		return accountID, nil, &orderError{http.StatusBadRequest, "Invalid UserID format"}
+	}
+	n, err := client.Database("myapp").Collection("merchants").CountDocuments(ctx, bson.M{"_id": accountID})
+	if err != nil {
+		return accountID, nil, err
+	}
+	if n > 0 {
+		return accountID, nil, &orderError{http.StatusUnauthorized, "Merchants must authenticate with an API key or a dashboard session"}
+	}
+	return accountID, nil, nil
+}
+
+// writeAccountError reports an error from requestAccount.
+func writeAccountError(w http.ResponseWriter, err error) {
+	if oerr, ok := err.(*orderError); ok {
+		http.Error(w, oerr.Message, oerr.Status)
+		return
+	}
+	http.Error(w, "Failed to authenticate request", http.StatusInternalServerError)
+}
+
+// findAccount looks up a user, or failing that a merchant, by ID. Merchants
+// are returned as a User so billing and messaging treat both alike.
+func findAccount(ctx context.Context, id primitive.ObjectID) (User, error) {
+	var user User
+	err := client.Database("myapp").Collection("users").FindOne(ctx, bson.M{"_id": id}).Decode(&user)
+	if err != mongo.ErrNoDocuments {
+		return user, err
+	}
+
+	var merchant Merchant
+	err = client.Database("myapp").Collection("merchants").FindOne(ctx, bson.M{"_id": id}).Decode(&merchant)
+	if err != nil {
+		return user, err
+	}
+	return User{ID: merchant.ID, Name: merchant.Name, Email: merchant.Email, Phone: merchant.Phone}, nil
+}
+
+func RegisterMerchant(w http.ResponseWriter, r *http.Request) {
+	var merchant Merchant
+	if err := json.NewDecoder(r.Body).Decode(&merchant); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if merchant.Name == "" || merchant.Email == "" || merchant.Password == "" {
+		http.Error(w, "Name, email and password are required", http.StatusBadRequest)
+		return
+	}
+
+	merchant.ID = primitive.NewObjectID()
+	merchant.CreatedAt = time.Now().UTC()
+	// The unique email index turns a concurrent registration with the same
+	// email into a duplicate key error.
+	_, err := client.Database("myapp").Collection("merchants").InsertOne(context.TODO(), merchant)
+	if mongo.IsDuplicateKeyError(err) {
+		http.Error(w, "Merchant already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to register merchant", http.StatusInternalServerError)
+		return
+	}
+	auditAuth(r, "auth.registered", "merchant", merchant.Email, auditSuccess)
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{
+		"merchantId": merchant.ID.Hex(),
+		"message":    "Merchant registered successfully",
+	})
+}
+
+func LoginMerchant(w http.ResponseWriter, r *http.Request) {
+	var request Merchant
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	var merchant Merchant
+	ok := authenticate(w, r, "merchant", request.Email, func(ctx context.Context) (bool, error) {
+		found, err := findForLogin(ctx, "merchants", bson.M{"email": request.Email}, &merchant)
+		return found && passwordMatches(merchant.Password, request.Password), err
+	})
+	if !ok {
+		return
+	}
+
+	token, err := startMerchantSession(context.TODO(), merchant.ID)
+	if err != nil {
+		http.Error(w, "Failed to start session", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"merchantId":   merchant.ID.Hex(),
+		"sessionToken": token,
+		"message":      "Login successful!",
+	})
+}
+
+// startMerchantSession stores a new dashboard session for merchantID and
+// returns its token, which is only ever shown at login.
+func startMerchantSession(ctx context.Context, merchantID primitive.ObjectID) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := merchantSessionPrefix + base64.RawURLEncoding.EncodeToString(b)
+	now := time.Now().UTC()
+	_, err := client.Database("myapp").Collection("merchant_sessions").InsertOne(ctx, MerchantSession{
+		ID:         primitive.NewObjectID(),
+		MerchantID: merchantID,
+		Hash:       hashAPIKey(token),
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(merchantSessionTTL),
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// authenticateMerchantSession resolves a dashboard session token to its
+// merchant.
+func authenticateMerchantSession(ctx context.Context, token string) (Merchant, error) {
+	var merchant Merchant
+	unauthorized := &orderError{http.StatusUnauthorized, "Invalid or expired session"}
+
+	var session MerchantSession
+	err := client.Database("myapp").Collection("merchant_sessions").FindOne(ctx, bson.M{
+		"hash":      hashAPIKey(token),
+		"expiresAt": bson.M{"$gt": time.Now().UTC()},
+	}).Decode(&session)
+	if err == mongo.ErrNoDocuments {
+		return merchant, unauthorized
+	}
+	if err != nil {
+		return merchant, err
+	}
+
+	err = client.Database("myapp").Collection("merchants").FindOne(ctx, bson.M{"_id": session.MerchantID}).Decode(&merchant)
+	if err == mongo.ErrNoDocuments {
+		return merchant, unauthorized
+	}
+	return merchant, err
+}
+
+// merchantSession returns the merchant logged in to the dashboard, from the
+// session token in the Authorization header. Keys are managed from there
+// only, never with an API key.
+func merchantSession(r *http.Request) (primitive.ObjectID, error) {
+	auth := r.Header.Get("Authorization")
+	token := strings.TrimPrefix(auth, "Bearer ")
+	if token == auth || !strings.HasPrefix(token, merchantSessionPrefix) {
+		return primitive.NilObjectID, &orderError{http.StatusUnauthorized, "A dashboard session is required"}
+	}
+	merchant, err := authenticateMerchantSession(r.Context(), token)
+	return merchant.ID, err
+}
+
+// issueAPIKey stores a new key and writes it to the response. The plain
+// key is only ever shown here.
+func issueAPIKey(w http.ResponseWriter, r *http.Request, merchantID primitive.ObjectID, name string, scopes []string, rotated *APIKey) {
+	key, record, err := newAPIKey(merchantID, name, scopes)
+	if err != nil {
+		http.Error(w, "Failed to create API key", http.StatusInternalServerError)
+		return
+	}
+
+	keys := client.Database("myapp").Collection("api_keys")
+	if _, err := keys.InsertOne(context.TODO(), record); err != nil {
+		http.Error(w, "Failed to create API key", http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"apiKey": record,
+		"key":    key,
+	}
+	if rotated != nil {
+		expiresAt := time.Now().UTC().Add(apiKeyRotationGrace)
+		if rotated.ExpiresAt != nil && rotated.ExpiresAt.Before(expiresAt) {
+			expiresAt = *rotated.ExpiresAt
+		}
+		_, err := keys.UpdateOne(context.TODO(), bson.M{"_id": rotated.ID}, bson.M{"$set": bson.M{
+			"expiresAt": expiresAt,
+			"rotatedTo": record.ID,
+		}})
+		if err != nil {
+			http.Error(w, "Failed to expire the rotated key", http.StatusInternalServerError)
+			return
+		}
+		response["previousKeyExpiresAt"] = expiresAt
+	}
+
+	action := "api_key.created"
+	if rotated != nil {
+		action = "api_key.rotated"
+	}
+	recordAudit(r, AuditEntry{
+		Actor:        merchantID.Hex(),
+		ActorRole:    "merchant",
+		Action:       action,
+		ResourceType: "api_key",
+		ResourceID:   record.ID.Hex(),
+		Changes:      auditDiff(rotated, record),
+		Outcome:      auditSuccess,
+	})
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+func CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	merchantID, err := merchantSession(r)
+	if err != nil {
+		writeAccountError(w, err)
+		return
+	}
+
+	var request struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if !validScopes(request.Scopes) {
+		http.Error(w, "Scopes must be one or more of "+strings.Join(apiKeyScopes, ", "), http.StatusBadRequest)
+		return
+	}
+
+	issueAPIKey(w, r, merchantID, request.Name, request.Scopes, nil)
+}
+
+func GetAPIKeys(w http.ResponseWriter, r *http.Request) {
+	merchantID, err := merchantSession(r)
+	if err != nil {
+		writeAccountError(w, err)
+		return
+	}
+
+	cursor, err := client.Database("myapp").Collection("api_keys").Find(context.TODO(), bson.M{"merchantId": merchantID})
+	if err != nil {
+		http.Error(w, "Failed to retrieve API keys", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.TODO())
+
+	keys := []APIKey{}
+	if err := cursor.All(context.TODO(), &keys); err != nil {
+		http.Error(w, "Failed to decode API keys", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+// RotateAPIKey issues a replacement with the same name and scopes. The old
+// key keeps working for the grace period and then expires.
+func RotateAPIKey(w http.ResponseWriter, r *http.Request) {
+	keyID, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid KeyID format", http.StatusBadRequest)
+		return
+	}
+	merchantID, err := merchantSession(r)
+	if err != nil {
+		writeAccountError(w, err)
+		return
+	}
+
+	var old APIKey
+	err = client.Database("myapp").Collection("api_keys").FindOne(context.TODO(), bson.M{
+		"_id":        keyID,
+		"merchantId": merchantID,
+		"revokedAt":  bson.M{"$exists": false},
+		"rotatedTo":  bson.M{"$exists": false},
+	}).Decode(&old)
+	if err != nil {
+		http.Error(w, "API key not found or already rotated", http.StatusNotFound)
+		return
+	}
+
+	issueAPIKey(w, r, merchantID, old.Name, old.Scopes, &old)
+}
+
+func RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	keyID, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid KeyID format", http.StatusBadRequest)
+		return
+	}
+	merchantID, err := merchantSession(r)
+	if err != nil {
+		writeAccountError(w, err)
+		return
+	}
+
+	result, err := client.Database("myapp").Collection("api_keys").UpdateOne(context.TODO(),
+		bson.M{"_id": keyID, "merchantId": merchantID, "revokedAt": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"revokedAt": time.Now().UTC()}},
+	)
+	if err != nil {
+		http.Error(w, "Failed to revoke API key", http.StatusInternalServerError)
+		return
+	}
+	if result.MatchedCount == 0 {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+	recordAudit(r, AuditEntry{
+		Actor:        merchantID.Hex(),
+		ActorRole:    "merchant",
+		Action:       "api_key.revoked",
+		ResourceType: "api_key",
+		ResourceID:   keyID.Hex(),
+		Outcome:      auditSuccess,
+	})
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode("API key revoked successfully")
+}
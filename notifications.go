@@ -0,0 +1,495 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	eventOrderAssigned     = "order_assigned"
+	eventCourierAssignment = "courier_assignment"
+	eventOrderAccepted     = "order_accepted"
+	eventOrderDelivered    = "order_delivered"
+	eventDropOffPin        = "dropoff_pin"
+
+	defaultLocale = "en"
+
+	notificationPending = "pending"
+	notificationSending = "sending"
+	notificationSent    = "sent"
+	notificationFailed  = "failed"
+
+	notificationRetryBase = 30 * time.Second
+	notificationRetryMax  = time.Hour
+)
+
+var maxNotificationAttempts = envInt("NOTIFY_MAX_ATTEMPTS", 6)
+
+type messageTemplate struct {
+	Subject string
+	Body    string
+}
+
+// messageTemplates holds the text of every event per locale. Each event
+// must have an English version, which is used for unknown locales.
+var messageTemplates = map[string]map[string]messageTemplate{
+	eventOrderAssigned: {
+		"en": {"A courier is on the way", "Hi {{.Name}},\n\n{{.CourierName}} will collect your order from {{.Pickup}}.\nTrack it at {{.TrackingURL}}"},
+		"es": {"Un repartidor va en camino", "Hola {{.Name}},\n\n{{.CourierName}} recogerá tu pedido en {{.Pickup}}.\nSíguelo en {{.TrackingURL}}"},
+	},
+	eventCourierAssignment: {
+		"en": {"New order assigned", "Hi {{.Name}},\n\nYou have been assigned order {{.OrderID}} from {{.Pickup}} to {{.DropOff}}. Please accept or decline it."},
+		"es": {"Nuevo pedido asignado", "Hola {{.Name}},\n\nSe te ha asignado el pedido {{.OrderID}} de {{.Pickup}} a {{.DropOff}}. Acéptalo o recházalo."},
+	},
+	eventOrderAccepted: {
+		"en": {"Your order was accepted", "Hi {{.Name}},\n\n{{.CourierName}} accepted your order and is heading to {{.Pickup}}.\nTrack it at {{.TrackingURL}}"},
+		"es": {"Tu pedido fue aceptado", "Hola {{.Name}},\n\n{{.CourierName}} aceptó tu pedido y va hacia {{.Pickup}}.\nSíguelo en {{.TrackingURL}}"},
+	},
+	eventOrderDelivered: {
+		"en": {"Your order was delivered", "Hi {{.Name}},\n\nYour order was delivered to {{.DropOff}}. Thank you for using our service."},
+		"es": {"Tu pedido fue entregado", "Hola {{.Name}},\n\nTu pedido fue entregado en {{.DropOff}}. Gracias por usar nuestro servicio."},
+	},
+	eventDropOffPin: {
+		"en": {"Your delivery code", "Hi {{.Name}},\n\nA parcel from {{.Pickup}} is on its way to {{.DropOff}}. Give the courier the code {{.Pin}} when it arrives.\nTrack it at {{.TrackingURL}}"},
+		"es": {"Tu código de entrega", "Hola {{.Name}},\n\nUn paquete de {{.Pickup}} va camino a {{.DropOff}}. Dale al repartidor el código {{.Pin}} cuando llegue.\nSíguelo en {{.TrackingURL}}"},
+	},
+}
+
+// Recipient is someone we can notify. Key identifies their preferences:
+// "user:<id>" for customers, "courier:<email>" for couriers and
+// "recipient:<order id>[:<stop id>]" for the people parcels are for.
+type Recipient struct {
+	Key   string
+	Name  string
+	Email string
+	Phone string
+}
+
+type NotificationPreferences struct {
+	Recipient   string          `json:"-" bson:"_id"`
+	Locale      string          `json:"locale" bson:"locale"`
+	Channels    map[string]bool `json:"channels" bson:"channels"`
+	MutedEvents []string        `json:"mutedEvents" bson:"mutedEvents"`
+	PushToken   string          `json:"pushToken,omitempty" bson:"pushToken,omitempty"`
+	UpdatedAt   time.Time       `json:"updatedAt" bson:"updatedAt"`
+}
+
+// Notification is one message queued for one channel. The worker retries
+// it with exponential backoff until it is sent or runs out of attempts.
+type Notification struct {
+	ID            primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	EventID       primitive.ObjectID `json:"eventId" bson:"eventId"`
+	Event         string             `json:"event" bson:"event"`
+	Recipient     string             `json:"recipient" bson:"recipient"`
+	Channel       string             `json:"channel" bson:"channel"`
+	To            string             `json:"to" bson:"to"`
+	Subject       string             `json:"subject" bson:"subject"`
+	Body          string             `json:"body" bson:"body"`
+	Status        string             `json:"status" bson:"status"`
+	Attempts      int                `json:"attempts" bson:"attempts"`
+	NextAttemptAt time.Time          `json:"nextAttemptAt" bson:"nextAttemptAt"`
+	LastError     string             `json:"lastError,omitempty" bson:"lastError,omitempty"`
+	CreatedAt     time.Time          `json:"createdAt" bson:"createdAt"`
+	SentAt        *time.Time         `json:"sentAt,omitempty" bson:"sentAt,omitempty"`
+}
+
+func defaultPreferences(key string) NotificationPreferences {
+	// Parcel recipients have no account to set preferences on and often
+	// only a phone number, so they get SMS as well.
+	return NotificationPreferences{
+		Recipient:   key,
+		Locale:      defaultLocale,
+		Channels:    map[string]bool{channelEmail: true, channelSMS: strings.HasPrefix(key, "recipient:"), channelPush: true},
+		MutedEvents: []string{},
+	}
+}
+
+func loadPreferences(ctx context.Context, key string) (NotificationPreferences, error) {
+	prefs := defaultPreferences(key)
+	err := client.Database("myapp").Collection("notification_preferences").FindOne(ctx, bson.M{"_id": key}).Decode(&prefs)
+	if err == mongo.ErrNoDocuments {
+		return prefs, nil
+	}
+	return prefs, err
+}
+
+func renderMessage(event, locale string, data interface{}) (string, string, error) {
+	byLocale, ok := messageTemplates[event]
+	if !ok {
+		return "", "", fmt.Errorf("no templates for event %q", event)
+	}
+	tmpl, ok := byLocale[locale]
+	if !ok {
+		tmpl = byLocale[defaultLocale]
+	}
+
+	render := func(text string) (string, error) {
+		t, err := template.New(event).Parse(text)
+		if err != nil {
+			return "", err
+		}
+		var b bytes.Buffer
+		if err := t.Execute(&b, data); err != nil {
+			return "", err
+		}
+		return b.String(), nil
+	}
+
+	subject, err := render(tmpl.Subject)
+	if err != nil {
+		return "", "", err
+	}
+	body, err := render(tmpl.Body)
+	return subject, body, err
+}
+
+// notify renders event for the recipient in their locale and queues it on
+// every channel they have enabled and can be reached on. eventID is the
+// outbox event that caused it; a redelivered event is queued only once.
+func notify(ctx context.Context, eventID primitive.ObjectID, event string, to Recipient, data map[string]string) error {
+	prefs, err := loadPreferences(ctx, to.Key)
+	if err != nil {
+		return err
+	}
+	if containsString(prefs.MutedEvents, event) {
+		return nil
+	}
+
+	data["Name"] = to.Name
+	subject, body, err := renderMessage(event, prefs.Locale, data)
+	if err != nil {
+		return err
+	}
+
+	addresses := map[string]string{channelEmail: to.Email, channelSMS: to.Phone, channelPush: prefs.PushToken}
+	now := time.Now().UTC()
+	notifications := client.Database("myapp").Collection("notifications")
+	for _, channel := range []string{channelEmail, channelSMS, channelPush} {
+		if !prefs.Channels[channel] || addresses[channel] == "" {
+			continue
+		}
+		n := Notification{
+			ID:            primitive.NewObjectID(),
+			EventID:       eventID,
+			Event:         event,
+			Recipient:     to.Key,
+			Channel:       channel,
+			To:            addresses[channel],
+			Subject:       subject,
+			Body:          body,
+			Status:        notificationPending,
+			NextAttemptAt: now,
+			CreatedAt:     now,
+		}
+		_, err := notifications.UpdateOne(ctx,
+			bson.M{"eventId": eventID, "recipient": to.Key, "channel": channel},
+			bson.M{"$setOnInsert": n},
+			options.Update().SetUpsert(true),
+		)
+		// Losing a race to queue the same notification leaves it queued.
+		if err != nil && !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func customerRecipient(ctx context.Context, userID primitive.ObjectID) (Recipient, error) {
+	user, err := findAccount(ctx, userID)
+	if err != nil {
+		return Recipient{}, err
+	}
+	return Recipient{Key: "user:" + userID.Hex(), Name: user.Name, Email: user.Email, Phone: user.Phone}, nil
+}
+
+func courierRecipient(ctx context.Context, email string) (Recipient, error) {
+	var courier Courier
+	err := client.Database("myapp").Collection("couriers").FindOne(ctx, bson.M{"email": email}).Decode(&courier)
+	if err != nil {
+		return Recipient{}, err
+	}
+	return Recipient{Key: "courier:" + courier.Email, Name: courier.Name, Email: courier.Email, Phone: courier.Phone}, nil
+}
+
+func orderMessageData(order Order) map[string]string {
+	return map[string]string{
+		"OrderID":     order.ID.Hex(),
+		"Pickup":      order.PickupLocation,
+		"DropOff":     order.DropOffLocation,
+		"CourierName": order.CourierName,
+		"TrackingURL": "/api/track/" + order.TrackingToken,
+	}
+}
+
+// notificationSubscriber turns order events from the outbox into messages
+// for the customer and, on assignment, the courier. A new order also sends
+// the drop-off PINs to recipients who can be reached. Recipients that no
+// longer exist are skipped.
+func notificationSubscriber(ctx context.Context, e OutboxEvent) error {
+	order := e.Order
+	type message struct {
+		event string
+		to    func() (Recipient, error)
+	}
+	customer := func() (Recipient, error) { return customerRecipient(ctx, order.UserID) }
+	courier := func() (Recipient, error) { return courierRecipient(ctx, order.CourierEmail) }
+
+	var messages []message
+	switch e.Event {
+	case statusEvent("Pending Acceptance"):
+		messages = []message{{eventOrderAssigned, customer}, {eventCourierAssignment, courier}}
+	case statusEvent("Accepted"):
+		messages = []message{{eventOrderAccepted, customer}}
+	case statusEvent("Delivered"), statusEvent("Partially delivered"):
+		messages = []message{{eventOrderDelivered, customer}}
+	}
+
+	if e.Event == eventOrderCreated {
+		for _, d := range recipientPins(order) {
+			data := orderMessageData(order)
+			data["DropOff"] = d.DropOff
+			data["Pin"] = d.PIN
+			if err := notify(ctx, e.ID, eventDropOffPin, d.To, data); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, m := range messages {
+		to, err := m.to()
+		if err == mongo.ErrNoDocuments {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := notify(ctx, e.ID, m.event, to, orderMessageData(order)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func notificationBackoff(attempts int) time.Duration {
+	d := notificationRetryBase
+	for i := 1; i < attempts && d < notificationRetryMax; i++ {
+		d *= 2
+	}
+	if d > notificationRetryMax {
+		d = notificationRetryMax
+	}
+	return d
+}
+
+// claimNotification takes the next due notification. Claimed messages are
+// leased for a minute so a crashed worker's messages are picked up again.
+func claimNotification(ctx context.Context, now time.Time) (*Notification, error) {
+	var n Notification
+	err := client.Database("myapp").Collection("notifications").FindOneAndUpdate(ctx,
+		bson.M{
+			"status":        bson.M{"$in": bson.A{notificationPending, notificationSending}},
+			"nextAttemptAt": bson.M{"$lte": now},
+		},
+		bson.M{"$set": bson.M{"status": notificationSending, "nextAttemptAt": now.Add(time.Minute)}},
+		options.FindOneAndUpdate().SetSort(bson.M{"nextAttemptAt": 1}).SetReturnDocument(options.After),
+	).Decode(&n)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &n, nil
+}
+
+func deliverNotification(ctx context.Context, n *Notification) error {
+	sender, ok := senders[n.Channel]
+	var err error
+	if !ok {
+		err = fmt.Errorf("no sender for channel %q", n.Channel)
+	} else {
+		err = sender.Send(ctx, Message{To: n.To, Subject: n.Subject, Body: n.Body})
+	}
+
+	now := time.Now().UTC()
+	set := bson.M{"attempts": n.Attempts + 1}
+	switch {
+	case err == nil:
+		set["status"] = notificationSent
+		set["sentAt"] = now
+	case n.Attempts+1 >= maxNotificationAttempts:
+		set["status"] = notificationFailed
+		set["lastError"] = err.Error()
+	default:
+		set["status"] = notificationPending
+		set["nextAttemptAt"] = now.Add(notificationBackoff(n.Attempts + 1))
+		set["lastError"] = err.Error()
+	}
+
+	_, uerr := client.Database("myapp").Collection("notifications").UpdateOne(ctx, bson.M{"_id": n.ID}, bson.M{"$set": set})
+	return uerr
+}
+
+func runNotifier(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for {
+			n, err := claimNotification(context.TODO(), time.Now().UTC())
+			if err != nil {
+				log.Println("Failed to claim notification:", err)
+				break
+			}
+			if n == nil {
+				break
+			}
+			if err := deliverNotification(context.TODO(), n); err != nil {
+				log.Println("Failed to record notification delivery:", err)
+			}
+		}
+	}
+}
+
+func GetNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	userID, err := primitive.ObjectIDFromHex(r.Header.Get("userId"))
+	if err != nil {
+		http.Error(w, "Invalid UserID format", http.StatusBadRequest)
+		return
+	}
+	writePreferences(w, "user:"+userID.Hex())
+}
+
+func UpdateNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	userID, err := primitive.ObjectIDFromHex(r.Header.Get("userId"))
+	if err != nil {
+		http.Error(w, "Invalid UserID format", http.StatusBadRequest)
+		return
+	}
+	savePreferences(w, r, "user:"+userID.Hex())
+}
+
+// courierPreferencesKey returns the preferences key of the courier named by
+// the email query parameter, writing an error when there is no such courier.
+func courierPreferencesKey(w http.ResponseWriter, r *http.Request) (string, bool) {
+	email := r.URL.Query().Get("email")
+	if email == "" {
+		http.Error(w, "Courier email is required", http.StatusBadRequest)
+		return "", false
+	}
+	to, err := courierRecipient(context.TODO(), email)
+	if err != nil {
+		http.Error(w, "Courier not found", http.StatusNotFound)
+		return "", false
+	}
+	return to.Key, true
+}
+
+func GetCourierNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	if key, ok := courierPreferencesKey(w, r); ok {
+		writePreferences(w, key)
+	}
+}
+
+func UpdateCourierNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	if key, ok := courierPreferencesKey(w, r); ok {
+		savePreferences(w, r, key)
+	}
+}
+
+func writePreferences(w http.ResponseWriter, key string) {
+	prefs, err := loadPreferences(context.TODO(), key)
+	if err != nil {
+		http.Error(w, "Failed to retrieve preferences", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prefs)
+}
+
+// savePreferences replaces the preferences stored under key with the ones in
+// the request body.
+func savePreferences(w http.ResponseWriter, r *http.Request, key string) {
+	var prefs NotificationPreferences
+	if err := json.NewDecoder(r.Body).Decode(&prefs); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if prefs.Locale == "" {
+		prefs.Locale = defaultLocale
+	}
+	if _, ok := messageTemplates[eventOrderDelivered][prefs.Locale]; !ok {
+		http.Error(w, "Unsupported locale", http.StatusBadRequest)
+		return
+	}
+	for channel := range prefs.Channels {
+		if channel != channelEmail && channel != channelSMS && channel != channelPush {
+			http.Error(w, "Unknown channel "+channel, http.StatusBadRequest)
+			return
+		}
+	}
+	for _, event := range prefs.MutedEvents {
+		if _, ok := messageTemplates[event]; !ok {
+			http.Error(w, "Unknown event "+event, http.StatusBadRequest)
+			return
+		}
+	}
+	if prefs.Channels == nil {
+		prefs.Channels = defaultPreferences("").Channels
+	}
+	if prefs.MutedEvents == nil {
+		prefs.MutedEvents = []string{}
+	}
+
+	prefs.Recipient = key
+	prefs.UpdatedAt = time.Now().UTC()
+	_, err := client.Database("myapp").Collection("notification_preferences").ReplaceOne(context.TODO(),
+		bson.M{"_id": prefs.Recipient}, prefs, options.Replace().SetUpsert(true))
+	if err != nil {
+		http.Error(w, "Failed to save preferences", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(prefs)
+}
+
+func GetNotifications(w http.ResponseWriter, r *http.Request) {
+	filter := bson.M{}
+	if status := r.URL.Query().Get("status"); status != "" {
+		filter["status"] = status
+	}
+	if recipient := r.URL.Query().Get("recipient"); recipient != "" {
+		filter["recipient"] = recipient
+	}
+
+	opts := options.Find().SetSort(bson.M{"createdAt": -1}).SetLimit(500)
+	cursor, err := client.Database("myapp").Collection("notifications").Find(context.TODO(), filter, opts)
+	if err != nil {
+		http.Error(w, "Failed to retrieve notifications", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.TODO())
+
+	notifications := []Notification{}
+	if err := cursor.All(context.TODO(), &notifications); err != nil {
+		http.Error(w, "Failed to decode notifications", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(notifications)
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const outboxBatchSize = 100
+
+// OutboxEvent is a domain event written in the same transaction as the
+// order change it describes. The relay publishes entries in Seq order, at
+// least once; subscribers deduplicate on ID. Entries are never deleted once
+// published: they are the order history analytics are built from.
+type OutboxEvent struct {
+	ID          primitive.ObjectID `json:"id" bson:"_id"`
+	Seq         int64              `json:"seq" bson:"seq"`
+	Event       string             `json:"event" bson:"event"`
+	OrderID     primitive.ObjectID `json:"orderId" bson:"orderId"`
+	Order       Order              `json:"order" bson:"order"`
+	CreatedAt   time.Time          `json:"createdAt" bson:"createdAt"`
+	PublishedAt *time.Time         `json:"publishedAt,omitempty" bson:"publishedAt,omitempty"`
+	DeadAt      *time.Time         `json:"deadAt,omitempty" bson:"deadAt,omitempty"`
+	Attempts    int                `json:"attempts" bson:"attempts"`
+	LastError   string             `json:"lastError,omitempty" bson:"lastError,omitempty"`
+	// Backfilled marks events reconstructed by backfillOutbox.
+	Backfilled bool `json:"backfilled,omitempty" bson:"backfilled,omitempty"`
+}
+
+// maxOutboxAttempts is how often the relay tries an entry before parking it
+// with deadAt set, so one poisoned event cannot hold back the rest.
+// Unsetting deadAt puts the entry back in the queue.
+var maxOutboxAttempts = envInt("OUTBOX_MAX_ATTEMPTS", 10)
+
+// outboxSubscribers make up the internal event bus. Each must be
+// idempotent for a given event ID, since an entry is redelivered to all of
+// them when any one fails.
+var outboxSubscribers = []func(ctx context.Context, e OutboxEvent) error{
+	webhookSubscriber,
+	notificationSubscriber,
+}
+
+// transactionsSupported is false when development mode runs against a
+// standalone MongoDB; withTransaction then writes without a transaction.
+var transactionsSupported = true
+
+// checkTransactions fails unless MongoDB runs as a replica set or behind
+// mongos, which transactions need. Development mode falls back to
+// non-transactional writes instead.
+func checkTransactions(ctx context.Context) error {
+	var hello struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	if err := client.Database("admin").RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello); err != nil {
+		return err
+	}
+	if hello.SetName != "" || hello.Msg == "isdbgrid" {
+		return nil
+	}
+	if !developmentMode {
+		return errors.New("MongoDB must run as a replica set (a single node is enough, see README.md); set APP_ENV=development to run without transactions")
+	}
+	log.Println("MongoDB is not a replica set: writing without transactions, order changes and their events are not atomic")
+	transactionsSupported = false
+	return nil
+}
+
+// withTransaction runs fn in a multi-document transaction. Transactions
+// need MongoDB to run as a replica set, even a single-node one. Called with
+// the session context of a running transaction, fn joins that transaction.
+func withTransaction(ctx context.Context, fn func(sc mongo.SessionContext) error) error {
+	if sc, ok := ctx.(mongo.SessionContext); ok {
+		return fn(sc)
+	}
+	if !transactionsSupported {
+		return client.UseSession(ctx, fn)
+	}
+
+	session, err := client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sc)
+	})
+	return err
+}
+
+// recordOrderEvent adds event for order to the outbox. Call it with the
+// session context of the transaction that changes the order.
+func recordOrderEvent(ctx context.Context, order Order, event string) error {
+	seq, err := nextSequence(ctx, "outbox")
+	if err != nil {
+		return err
+	}
+	_, err = client.Database("myapp").Collection("outbox").InsertOne(ctx, OutboxEvent{
+		ID:        primitive.NewObjectID(),
+		Seq:       seq,
+		Event:     event,
+		OrderID:   order.ID,
+		Order:     order,
+		CreatedAt: time.Now().UTC(),
+	})
+	return err
+}
+
+// backfillOutbox reconstructs the history of orders placed before the
+// outbox existed, so analytics cover them too: order.created at the
+// order's creation time, and the pickup and delivery events the order's
+// timestamps record. The events are stored as already published, so no
+// webhook or notification goes out for them.
+func backfillOutbox(ctx context.Context) error {
+	cursor, err := client.Database("myapp").Collection("orders").Aggregate(ctx, []bson.M{
+		{"$lookup": bson.M{
+			"from": "outbox",
+			"let":  bson.M{"id": "$_id"},
+			"pipeline": bson.A{
+				bson.M{"$match": bson.M{"$expr": bson.M{"$and": bson.A{
+					bson.M{"$eq": bson.A{"$orderId", "$$id"}},
+					bson.M{"$eq": bson.A{"$event", eventOrderCreated}},
+				}}}},
+				bson.M{"$limit": 1},
+			},
+			"as": "created",
+		}},
+		{"$match": bson.M{"created": bson.M{"$size": 0}}},
+		{"$project": bson.M{"created": 0}},
+	})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	outbox := client.Database("myapp").Collection("outbox")
+	n := 0
+	for cursor.Next(ctx) {
+		var order Order
+		if err := cursor.Decode(&order); err != nil {
+			return err
+		}
+
+		type past struct {
+			event string
+			at    *time.Time
+		}
+		createdAt := order.ID.Timestamp().UTC()
+		history := []past{{eventOrderCreated, &createdAt}, {statusEvent("Picked up"), order.PickedUpAt}}
+		if order.Status == "Delivered" || order.Status == "Partially delivered" {
+			history = append(history, past{statusEvent(order.Status), order.DeliveredAt})
+		}
+		for _, h := range history {
+			if h.at == nil {
+				continue
+			}
+			seq, err := nextSequence(ctx, "outbox")
+			if err != nil {
+				return err
+			}
+			_, err = outbox.InsertOne(ctx, OutboxEvent{
+				ID:          primitive.NewObjectID(),
+				Seq:         seq,
+				Event:       h.event,
+				OrderID:     order.ID,
+				Order:       order,
+				CreatedAt:   *h.at,
+				PublishedAt: h.at,
+				Backfilled:  true,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		n++
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	if n > 0 {
+		log.Printf("Backfilled the outbox for %d orders", n)
+	}
+	return nil
+}
+
+// insertOrder stores a new order together with its order.created event.
+func insertOrder(ctx context.Context, order Order) error {
+	return withTransaction(ctx, func(sc mongo.SessionContext) error {
+		if _, err := client.Database("myapp").Collection("orders").InsertOne(sc, order); err != nil {
+			return err
+		}
+		return recordOrderEvent(sc, order, eventOrderCreated)
+	})
+}
+
+// updateOrder applies update to the order matched by filter and records
+// event for the updated order in the same transaction. An empty event is
+// derived from the order's new status. It returns mongo.ErrNoDocuments when
+// nothing matched.
+func updateOrder(ctx context.Context, filter, update bson.M, event string) (Order, error) {
+	var order Order
+	err := withTransaction(ctx, func(sc mongo.SessionContext) error {
+		err := client.Database("myapp").Collection("orders").FindOneAndUpdate(sc, filter, update,
+			options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&order)
+		if err != nil {
+			return err
+		}
+		if event == "" {
+			event = statusEvent(order.Status)
+		}
+		return recordOrderEvent(sc, order, event)
+	})
+	return order, err
+}
+
+// deleteOrder removes order and records event, carrying the order as it was
+// with status set to status, in the same transaction. It returns
+// mongo.ErrNoDocuments when the order was already gone.
+func deleteOrder(ctx context.Context, order Order, status, event string) error {
+	return withTransaction(ctx, func(sc mongo.SessionContext) error {
+		result, err := client.Database("myapp").Collection("orders").DeleteOne(sc, bson.M{"_id": order.ID})
+		if err != nil {
+			return err
+		}
+		if result.DeletedCount == 0 {
+			return mongo.ErrNoDocuments
+		}
+		order.Status = status
+		return recordOrderEvent(sc, order, event)
+	})
+}
+
+// relayOutbox publishes unpublished entries in order. It stops at the first
+// entry a subscriber fails on, so later events never overtake it, unless the
+// entry has used up maxOutboxAttempts and is parked instead.
+func relayOutbox(ctx context.Context) (int, error) {
+	outbox := client.Database("myapp").Collection("outbox")
+	opts := options.Find().SetSort(bson.M{"seq": 1}).SetLimit(outboxBatchSize)
+	cursor, err := outbox.Find(ctx, bson.M{
+		"publishedAt": bson.M{"$exists": false},
+		"deadAt":      bson.M{"$exists": false},
+	}, opts)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var pending []OutboxEvent
+	if err := cursor.All(ctx, &pending); err != nil {
+		return 0, err
+	}
+
+	published := 0
+	for _, e := range pending {
+		var failure error
+		for _, subscriber := range outboxSubscribers {
+			if err := subscriber(ctx, e); err != nil {
+				failure = err
+				break
+			}
+		}
+
+		if failure != nil {
+			set := bson.M{"lastError": failure.Error()}
+			dead := e.Attempts+1 >= maxOutboxAttempts
+			if dead {
+				set["deadAt"] = time.Now().UTC()
+			}
+			_, err := outbox.UpdateOne(ctx, bson.M{"_id": e.ID}, bson.M{
+				"$inc": bson.M{"attempts": 1},
+				"$set": set,
+			})
+			if !dead || err != nil {
+				return published, failure
+			}
+			log.Printf("Outbox event %d (%s) parked after %d attempts: %v", e.Seq, e.Event, e.Attempts+1, failure)
+			continue
+		}
+
+		_, err := outbox.UpdateOne(ctx, bson.M{"_id": e.ID}, bson.M{
+			"$inc": bson.M{"attempts": 1},
+			"$set": bson.M{"publishedAt": time.Now().UTC()},
+		})
+		if err != nil {
+			return published, err
+		}
+		published++
+	}
+	return published, nil
+}
+
+// outboxRelayLease is how long a process holds the relay without renewing
+// it. A batch is cut off at half of it, so the lease never runs out while
+// its holder is still publishing.
+const outboxRelayLease = time.Minute
+
+// claimOutboxRelay takes or renews the lease that lets one process relay
+// the outbox, claimed with a conditional upsert like withLedgerLock: while
+// another process holds it, the upsert collides on _id and it reports false.
+func claimOutboxRelay(ctx context.Context, token primitive.ObjectID) (bool, error) {
+	now := time.Now().UTC()
+	_, err := client.Database("myapp").Collection("ledger_locks").UpdateOne(ctx,
+		bson.M{"_id": "outbox-relay", "$or": bson.A{
+			bson.M{"token": token},
+			bson.M{"leaseUntil": bson.M{"$lt": now}},
+			bson.M{"leaseUntil": bson.M{"$exists": false}},
+		}},
+		bson.M{"$set": bson.M{"token": token, "leaseUntil": now.Add(outboxRelayLease)}},
+		options.Update().SetUpsert(true),
+	)
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// runOutboxRelay publishes the outbox while this process holds the relay
+// lease, so that with several instances running only one relays at a time
+// and entries are never published out of order.
+func runOutboxRelay(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	token := primitive.NewObjectID()
+	for range ticker.C {
+		for {
+			held, err := claimOutboxRelay(context.TODO(), token)
+			if err != nil {
+				log.Println("Failed to claim outbox relay:", err)
+				break
+			}
+			if !held {
+				break
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), outboxRelayLease/2)
+			n, err := relayOutbox(ctx)
+			cancel()
+			if err != nil {
+				log.Println("Failed to relay outbox:", err)
+				break
+			}
+			if n < outboxBatchSize {
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import "math"
+
+// All money amounts are stored as integer cents.
+const (
+	baseDeliveryFee  int64 = 500
+	deliveryFeePerKm int64 = 120
+
+	courierBasePay      int64 = 300
+	courierPayPerKm     int64 = 80
+	courierCommissionBp int64 = 2000 // basis points taken from base and distance pay; tips are not commissioned
+)
+
+func priceOrder(order Order) int64 {
+	return baseDeliveryFee + int64(math.Round(orderDistanceKm(order)*float64(deliveryFeePerKm)))
+}
+
+// orderTotal is what the customer pays: the delivery price plus any tip.
+func orderTotal(order Order) int64 {
+	return order.Price + order.Tip
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const maxProofUploadBytes = 10 << 20
+
+var errUnsupportedImage = errors.New("only JPEG and PNG images are accepted")
+
+type ProofOfDelivery struct {
+	RecipientName string    `json:"recipientName" bson:"recipientName"`
+	PhotoKey      string    `json:"-" bson:"photoKey,omitempty"`
+	SignatureKey  string    `json:"-" bson:"signatureKey,omitempty"`
+	PhotoURL      string    `json:"photoUrl,omitempty" bson:"-"`
+	SignatureURL  string    `json:"signatureUrl,omitempty" bson:"-"`
+	UploadedBy    string    `json:"uploadedBy" bson:"uploadedBy"`
+	UploadedAt    time.Time `json:"uploadedAt" bson:"uploadedAt"`
+}
+
+func (p *ProofOfDelivery) complete() bool {
+	return p != nil && p.RecipientName != "" && (p.PhotoKey != "" || p.SignatureKey != "")
+}
+
+// setURLs points the URLs at the file endpoints under base, the API path of
+// the order or stop the proof belongs to.
+func (p *ProofOfDelivery) setURLs(base string) {
+	if p == nil {
+		return
+	}
+	if p.PhotoKey != "" {
+		p.PhotoURL = base + "/proof/photo"
+	}
+	if p.SignatureKey != "" {
+		p.SignatureURL = base + "/proof/signature"
+	}
+}
+
+func orderPath(orderID primitive.ObjectID) string {
+	return "/api/orders/" + orderID.Hex()
+}
+
+// readProofImage returns nil data when the form has no file for field.
+func readProofImage(r *http.Request, field string) ([]byte, string, string, error) {
+	file, _, err := r.FormFile(field)
+	if err == http.ErrMissingFile {
+		return nil, "", "", nil
+	}
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxProofUploadBytes+1))
+	if err != nil {
+		return nil, "", "", err
+	}
+	if len(data) > maxProofUploadBytes {
+		return nil, "", "", &orderError{http.StatusRequestEntityTooLarge, "The " + field + " image is too large"}
+	}
+
+	contentType := http.DetectContentType(data)
+	switch contentType {
+	case "image/jpeg":
+		return data, contentType, ".jpg", nil
+	case "image/png":
+		return data, contentType, ".png", nil
+	}
+	return nil, "", "", errUnsupportedImage
+}
+
+// storeProof saves the photo and signature images of the multipart request
+// under prefix in the blob store.
+func storeProof(r *http.Request, prefix, email, recipientName string) (ProofOfDelivery, error) {
+	proof := ProofOfDelivery{
+		RecipientName: recipientName,
+		UploadedBy:    email,
+		UploadedAt:    time.Now().UTC(),
+	}
+
+	photo, photoType, photoExt, err := readProofImage(r, "photo")
+	if _, ok := err.(*orderError); ok {
+		return proof, err
+	}
+	if err != nil {
+		return proof, &orderError{http.StatusBadRequest, "Invalid photo: " + err.Error()}
+	}
+	signature, signatureType, signatureExt, err := readProofImage(r, "signature")
+	if _, ok := err.(*orderError); ok {
+		return proof, err
+	}
+	if err != nil {
+		return proof, &orderError{http.StatusBadRequest, "Invalid signature: " + err.Error()}
+	}
+	if photo == nil && signature == nil {
+		return proof, &orderError{http.StatusBadRequest, "A photo or a signature is required"}
+	}
+
+	ctx := r.Context()
+	if photo != nil {
+		proof.PhotoKey = prefix + "photo" + photoExt
+		if err := blobs.Put(ctx, proof.PhotoKey, bytes.NewReader(photo), int64(len(photo)), photoType); err != nil {
+			return proof, err
+		}
+	}
+	if signature != nil {
+		proof.SignatureKey = prefix + "signature" + signatureExt
+		if err := blobs.Put(ctx, proof.SignatureKey, bytes.NewReader(signature), int64(len(signature)), signatureType); err != nil {
+			return proof, err
+		}
+	}
+	return proof, nil
+}
+
+// UploadProofOfDelivery takes a multipart form with email, recipientName
+// and a photo and/or signature image. It must be called before the courier
+// marks the order Delivered.
+func UploadProofOfDelivery(w http.ResponseWriter, r *http.Request) {
+	orderID, err := primitive.ObjectIDFromHex(mux.Vars(r)["orderId"])
+	if err != nil {
+		http.Error(w, "Invalid OrderID format", http.StatusBadRequest)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 2*maxProofUploadBytes+1<<20)
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	email := r.FormValue("email")
+	recipientName := r.FormValue("recipientName")
+	if recipientName == "" {
+		http.Error(w, "Recipient name is required", http.StatusBadRequest)
+		return
+	}
+
+	orderCollection := client.Database("myapp").Collection("orders")
+	var order Order
+	err = orderCollection.FindOne(context.TODO(), bson.M{"_id": orderID}).Decode(&order)
+	if err != nil {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+
+	if order.CourierEmail == "" || order.CourierEmail != email {
+		http.Error(w, "You are not assigned to this order", http.StatusForbidden)
+		return
+	}
+
+	if order.Status == "Delivered" {
+		http.Error(w, "Order is already delivered", http.StatusConflict)
+		return
+	}
+
+	proof, err := storeProof(r, "proof/"+orderID.Hex()+"/", email, recipientName)
+	if oerr, ok := err.(*orderError); ok {
+		http.Error(w, oerr.Message, oerr.Status)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to store proof of delivery", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = orderCollection.UpdateOne(context.TODO(), bson.M{"_id": orderID}, bson.M{"$set": bson.M{"proofOfDelivery": proof}})
+	if err != nil {
+		http.Error(w, "Failed to save proof of delivery", http.StatusInternalServerError)
+		return
+	}
+
+	proof.setURLs(orderPath(orderID))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(proof)
+}
+
+func GetProofOfDeliveryFile(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	orderID, err := primitive.ObjectIDFromHex(vars["id"])
+	if err != nil {
+		http.Error(w, "Invalid OrderID format", http.StatusBadRequest)
+		return
+	}
+
+	var order Order
+	err = client.Database("myapp").Collection("orders").FindOne(context.TODO(), bson.M{"_id": orderID}).Decode(&order)
+	if err != nil {
+		http.Error(w, "Proof of delivery not found", http.StatusNotFound)
+		return
+	}
+
+	proof := order.ProofOfDelivery
+	if stopID, ok := vars["stopId"]; ok {
+		proof = nil
+		if stop := order.findStop(stopID); stop != nil {
+			proof = stop.ProofOfDelivery
+		}
+	}
+	if proof == nil {
+		http.Error(w, "Proof of delivery not found", http.StatusNotFound)
+		return
+	}
+
+	var key string
+	switch vars["kind"] {
+	case "photo":
+		key = proof.PhotoKey
+	case "signature":
+		key = proof.SignatureKey
+	}
+	if key == "" {
+		http.Error(w, "Proof of delivery not found", http.StatusNotFound)
+		return
+	}
+
+	body, contentType, err := blobs.Get(r.Context(), key)
+	if err == errBlobNotFound {
+		http.Error(w, "Proof of delivery not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to read proof of delivery", http.StatusInternalServerError)
+		return
+	}
+	defer body.Close()
+
+	w.Header().Set("Content-Type", contentType)
+	io.Copy(w, body)
+}
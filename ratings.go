@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// ratingCourier is a customer's rating of the courier, ratingCustomer
+	// the courier's rating of the customer.
+	ratingCourier  = "courier"
+	ratingCustomer = "customer"
+
+	maxRatingComment = 1000
+
+	// Scores are smoothed towards ratingPrior as if each subject started
+	// with ratingPriorWeight ratings of that value, so one bad rating does
+	// not sink a new courier.
+	ratingPrior       = 4.5
+	ratingPriorWeight = 5
+)
+
+var (
+	ratingWindow = time.Duration(envInt("RATING_WINDOW_DAYS", 14)) * 24 * time.Hour
+	// ratingPenaltyKm is how much further away, for dispatch, each star
+	// below five makes a courier look.
+	ratingPenaltyKm = float64(envInt("RATING_PENALTY_KM", 1))
+)
+
+var ratingTags = map[string][]string{
+	ratingCourier:  {"friendly", "on_time", "careful_handling", "professional", "late", "rude", "damaged_package"},
+	ratingCustomer: {"ready_on_time", "clear_instructions", "polite", "not_available", "wrong_address", "rude"},
+}
+
+// Rating is one side's feedback on the other for a completed order. There
+// is at most one per order and side.
+type Rating struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	OrderID   primitive.ObjectID `json:"orderId" bson:"orderId"`
+	Kind      string             `json:"kind" bson:"kind"`
+	Subject   string             `json:"subject" bson:"subject"`
+	RatedBy   string             `json:"ratedBy" bson:"ratedBy"`
+	Stars     int                `json:"stars" bson:"stars"`
+	Tags      []string           `json:"tags" bson:"tags"`
+	Comment   string             `json:"comment,omitempty" bson:"comment,omitempty"`
+	CreatedAt time.Time          `json:"createdAt" bson:"createdAt"`
+
+	Hidden         bool       `json:"hidden" bson:"hidden"`
+	ModeratedBy    string     `json:"moderatedBy,omitempty" bson:"moderatedBy,omitempty"`
+	ModerationNote string     `json:"moderationNote,omitempty" bson:"moderationNote,omitempty"`
+	ModeratedAt    *time.Time `json:"moderatedAt,omitempty" bson:"moderatedAt,omitempty"`
+}
+
+// RatingSummary is kept on the rated courier or user. Hidden ratings are
+// left out.
+type RatingSummary struct {
+	Average float64        `json:"average" bson:"average"`
+	Count   int            `json:"count" bson:"count"`
+	Stars   map[string]int `json:"stars" bson:"stars"`
+	Tags    map[string]int `json:"tags,omitempty" bson:"tags,omitempty"`
+}
+
+// score is the smoothed average used for ranking.
+func (s *RatingSummary) score() float64 {
+	if s == nil {
+		return ratingPrior
+	}
+	return (s.Average*float64(s.Count) + ratingPrior*ratingPriorWeight) / float64(s.Count+ratingPriorWeight)
+}
+
+// summarizeRatings recomputes the summary for a subject and stores it on
+// the subject's profile.
+func summarizeRatings(ctx context.Context, kind, subject string) error {
+	cursor, err := client.Database("myapp").Collection("ratings").Find(ctx, bson.M{"kind": kind, "subject": subject, "hidden": false})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	summary := RatingSummary{Stars: map[string]int{}, Tags: map[string]int{}}
+	total := 0
+	for cursor.Next(ctx) {
+		var rating Rating
+		if err := cursor.Decode(&rating); err != nil {
+			return err
+		}
+		summary.Count++
+		total += rating.Stars
+		summary.Stars[strconv.Itoa(rating.Stars)]++
+		for _, tag := range rating.Tags {
+			summary.Tags[tag]++
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	if summary.Count > 0 {
+		summary.Average = float64(total) / float64(summary.Count)
+	}
+
+	if kind == ratingCourier {
+		_, err = client.Database("myapp").Collection("couriers").UpdateOne(ctx, bson.M{"email": subject}, bson.M{"$set": bson.M{"rating": summary}})
+		return err
+	}
+	userID, err := primitive.ObjectIDFromHex(subject)
+	if err != nil {
+		return err
+	}
+	for _, collection := range []string{"users", "merchants"} {
+		_, err = client.Database("myapp").Collection(collection).UpdateOne(ctx, bson.M{"_id": userID}, bson.M{"$set": bson.M{"rating": summary}})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type ratingRequest struct {
+	Email   string   `json:"email"`
+	Stars   int      `json:"stars"`
+	Tags    []string `json:"tags"`
+	Comment string   `json:"comment"`
+}
+
+func (req ratingRequest) validate(kind string) string {
+	if req.Stars < 1 || req.Stars > 5 {
+		return "Stars must be between 1 and 5"
+	}
+	for _, tag := range req.Tags {
+		if !containsString(ratingTags[kind], tag) {
+			return "Unknown tag " + tag
+		}
+	}
+	if len(req.Comment) > maxRatingComment {
+		return "Comment is too long"
+	}
+	return ""
+}
+
+// rateOrder stores rating unless that side already rated the order.
+func rateOrder(ctx context.Context, w http.ResponseWriter, order Order, rating Rating) {
+	if order.Status != "Delivered" && order.Status != "Partially delivered" {
+		http.Error(w, "Only completed orders can be rated", http.StatusConflict)
+		return
+	}
+	if order.DeliveredAt != nil && time.Since(*order.DeliveredAt) > ratingWindow {
+		http.Error(w, "The rating period for this order has ended", http.StatusConflict)
+		return
+	}
+
+	rating.ID = primitive.NewObjectID()
+	rating.OrderID = order.ID
+	rating.CreatedAt = time.Now().UTC()
+	if rating.Tags == nil {
+		rating.Tags = []string{}
+	}
+
+	result, err := client.Database("myapp").Collection("ratings").UpdateOne(ctx,
+		bson.M{"orderId": order.ID, "kind": rating.Kind},
+		bson.M{"$setOnInsert": rating},
+		options.Update().SetUpsert(true),
+	)
+	if mongo.IsDuplicateKeyError(err) {
+		http.Error(w, "This order has already been rated", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to save rating", http.StatusInternalServerError)
+		return
+	}
+	if result.UpsertedCount == 0 {
+		http.Error(w, "This order has already been rated", http.StatusConflict)
+		return
+	}
+
+	if err := summarizeRatings(ctx, rating.Kind, rating.Subject); err != nil {
+		http.Error(w, "Failed to update rating summary", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(rating)
+}
+
+// RateCourier is the customer rating the courier who delivered the order.
+func RateCourier(w http.ResponseWriter, r *http.Request) {
+	orderID, err := primitive.ObjectIDFromHex(mux.Vars(r)["orderId"])
+	if err != nil {
+		http.Error(w, "Invalid OrderID format", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	accountID, _, err := requestAccount(ctx, r, scopeOrdersRead)
+	if err != nil {
+		writeAccountError(w, err)
+		return
+	}
+
+	var request ratingRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if msg := request.validate(ratingCourier); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	var order Order
+	err = client.Database("myapp").Collection("orders").FindOne(ctx, bson.M{"_id": orderID, "userId": accountID}).Decode(&order)
+	if err != nil {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if order.CourierEmail == "" {
+		http.Error(w, "Order has no courier to rate", http.StatusConflict)
+		return
+	}
+
+	rateOrder(ctx, w, order, Rating{
+		Kind:    ratingCourier,
+		Subject: order.CourierEmail,
+		RatedBy: accountID.Hex(),
+		Stars:   request.Stars,
+		Tags:    request.Tags,
+		Comment: request.Comment,
+	})
+}
+
+// RateCustomer is the courier rating the customer of an order they
+// delivered.
+func RateCustomer(w http.ResponseWriter, r *http.Request) {
+	orderID, err := primitive.ObjectIDFromHex(mux.Vars(r)["orderId"])
+	if err != nil {
+		http.Error(w, "Invalid OrderID format", http.StatusBadRequest)
+		return
+	}
+
+	var request ratingRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if msg := request.validate(ratingCustomer); msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var order Order
+	err = client.Database("myapp").Collection("orders").FindOne(ctx, bson.M{"_id": orderID}).Decode(&order)
+	if err != nil {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	if order.CourierEmail == "" || order.CourierEmail != request.Email {
+		http.Error(w, "You are not assigned to this order", http.StatusForbidden)
+		return
+	}
+
+	rateOrder(ctx, w, order, Rating{
+		Kind:    ratingCustomer,
+		Subject: order.UserID.Hex(),
+		RatedBy: request.Email,
+		Stars:   request.Stars,
+		Tags:    request.Tags,
+		Comment: request.Comment,
+	})
+}
+
+func findRatings(ctx context.Context, filter bson.M) ([]Rating, error) {
+	opts := options.Find().SetSort(bson.M{"createdAt": -1}).SetLimit(200)
+	cursor, err := client.Database("myapp").Collection("ratings").Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	ratings := []Rating{}
+	if err := cursor.All(ctx, &ratings); err != nil {
+		return nil, err
+	}
+	return ratings, nil
+}
+
+// GetCourierRatings shows couriers their own summary and visible ratings.
+// Who rated is left out.
+func GetCourierRatings(w http.ResponseWriter, r *http.Request) {
+	email := r.URL.Query().Get("email")
+	if email == "" {
+		http.Error(w, "Email is required", http.StatusBadRequest)
+		return
+	}
+
+	var courier Courier
+	err := client.Database("myapp").Collection("couriers").FindOne(context.TODO(), bson.M{"email": email}).Decode(&courier)
+	if err != nil {
+		http.Error(w, "Courier not found", http.StatusNotFound)
+		return
+	}
+
+	ratings, err := findRatings(context.TODO(), bson.M{"kind": ratingCourier, "subject": email, "hidden": false})
+	if err != nil {
+		http.Error(w, "Failed to retrieve ratings", http.StatusInternalServerError)
+		return
+	}
+	for i := range ratings {
+		ratings[i].RatedBy = ""
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"summary": courier.Rating,
+		"ratings": ratings,
+	})
+}
+
+// GetRatings is the admin moderation queue, filtered by kind, subject,
+// hidden and maximum stars.
+func GetRatings(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := bson.M{}
+	if s := q.Get("kind"); s != "" {
+		filter["kind"] = s
+	}
+	if s := q.Get("subject"); s != "" {
+		filter["subject"] = s
+	}
+	if s := q.Get("hidden"); s != "" {
+		filter["hidden"] = s == "true"
+	}
+	if s := q.Get("maxStars"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			http.Error(w, "Invalid maxStars", http.StatusBadRequest)
+			return
+		}
+		filter["stars"] = bson.M{"$lte": n}
+	}
+
+	ratings, err := findRatings(context.TODO(), filter)
+	if err != nil {
+		http.Error(w, "Failed to retrieve ratings", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ratings)
+}
+
+// ModerateRating hides or restores a rating. Hidden ratings stop counting
+// towards the subject's score.
+func ModerateRating(w http.ResponseWriter, r *http.Request) {
+	ratingID, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid RatingID format", http.StatusBadRequest)
+		return
+	}
+
+	var request struct {
+		Hidden  bool   `json:"hidden"`
+		Note    string `json:"note"`
+		AdminID string `json:"adminId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if request.Note == "" {
+		http.Error(w, "Note is required", http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.TODO()
+	if _, err := findAdmin(ctx, request.AdminID); err != nil {
+		writeAccountError(w, err)
+		return
+	}
+
+	var rating Rating
+	err = client.Database("myapp").Collection("ratings").FindOneAndUpdate(ctx,
+		bson.M{"_id": ratingID},
+		bson.M{"$set": bson.M{
+			"hidden":         request.Hidden,
+			"moderatedBy":    request.AdminID,
+			"moderationNote": request.Note,
+			"moderatedAt":    time.Now().UTC(),
+		}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&rating)
+	if err != nil {
+		http.Error(w, "Rating not found", http.StatusNotFound)
+		return
+	}
+
+	if err := summarizeRatings(ctx, rating.Kind, rating.Subject); err != nil {
+		http.Error(w, "Failed to update rating summary", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rating)
+}
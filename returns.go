@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var deliveryFailureReasons = map[string]bool{
+	"recipient_unavailable": true,
+	"address_not_found":     true,
+	"access_denied":         true,
+	"refused":               true,
+	"damaged":               true,
+	"other":                 true,
+}
+
+// maxDeliveryAttempts is how many failed attempts an order may have before
+// it is sent back to the sender.
+var maxDeliveryAttempts = envInt("MAX_DELIVERY_ATTEMPTS", 3)
+
+const reattemptDelay = 24 * time.Hour
+
+type DeliveryAttempt struct {
+	Reason       string    `json:"reason" bson:"reason"`
+	Note         string    `json:"note,omitempty" bson:"note,omitempty"`
+	CourierEmail string    `json:"courierEmail" bson:"courierEmail"`
+	At           time.Time `json:"at" bson:"at"`
+}
+
+// recordFailedAttempt stores the attempt and either schedules another one or,
+// once maxDeliveryAttempts is reached, starts the return to the sender. The
+// return order is stored and linked from the original in one transaction. It
+// returns the order's new status.
+func recordFailedAttempt(ctx context.Context, order Order, attempt DeliveryAttempt) (string, *Order, error) {
+	if len(order.DeliveryAttempts)+1 < maxDeliveryAttempts {
+		next := attempt.At.Add(reattemptDelay)
+		_, err := updateOrder(ctx, bson.M{"_id": order.ID}, bson.M{
+			"$push": bson.M{"deliveryAttempts": attempt},
+			"$set":  bson.M{"status": "Reattempt scheduled", "nextAttemptAt": next},
+		}, "")
+		return "Reattempt scheduled", nil, err
+	}
+
+	returnOrder, err := createReturnOrder(ctx, order)
+	if err != nil {
+		return "", nil, err
+	}
+
+	err = withTransaction(ctx, func(sc mongo.SessionContext) error {
+		if err := insertOrder(sc, returnOrder); err != nil {
+			return err
+		}
+		_, err := updateOrder(sc, bson.M{"_id": order.ID, "returnOrderId": bson.M{"$exists": false}}, bson.M{
+			"$push":  bson.M{"deliveryAttempts": attempt},
+			"$set":   bson.M{"status": "Returned to sender", "returnOrderId": returnOrder.ID},
+			"$unset": bson.M{"nextAttemptAt": ""},
+		}, "")
+		return err
+	})
+	if err != nil {
+		if rerr := refundOrQueue(ctx, returnOrder, "Return order creation failed"); rerr != nil {
+			log.Println("Failed to refund return fee:", rerr)
+		}
+		return "", nil, err
+	}
+	return "Returned to sender", &returnOrder, nil
+}
+
+// createReturnOrder prepares the reverse leg as an order of its own, so it
+// gets its own tracking, PINs, fee, invoice and courier earning, and charges
+// its fee. The courier already holds the parcel, so the pickup handover is
+// pre-verified. The caller stores the order and refunds the fee if that
+// fails.
+func createReturnOrder(ctx context.Context, order Order) (Order, error) {
+	ret := Order{
+		ID:                 primitive.NewObjectID(),
+		PickupLocation:     order.DropOffLocation,
+		DropOffLocation:    order.PickupLocation,
+		PickupCoordinates:  order.DropOffCoordinates,
+		DropOffCoordinates: order.PickupCoordinates,
+		PackageDetails:     order.PackageDetails,
+		Status:             "In transit",
+		UserID:             order.UserID,
+		CourierEmail:       order.CourierEmail,
+		CourierPhone:       order.CourierPhone,
+		CourierName:        order.CourierName,
+		ReturnOf:           &order.ID,
+	}
+	ret.Price = priceOrder(ret)
+
+	handover, err := newHandover()
+	if err != nil {
+		return ret, err
+	}
+	now := time.Now().UTC()
+	handover.Pickup.VerifiedAt = &now
+	ret.Handover = handover
+
+	ret.TrackingToken, err = newTrackingToken()
+	if err != nil {
+		return ret, err
+	}
+
+	var courier Courier
+	if err := client.Database("myapp").Collection("couriers").FindOne(ctx, bson.M{"email": order.CourierEmail}).Decode(&courier); err != nil {
+		return ret, err
+	}
+	ret.CourierID = &courier.ID
+
+	// The parcel has to go back either way, so a wallet that cannot cover
+	// the fee moves the return onto the monthly invoice rather than blocking
+	// it. Any other charge failure is an error.
+	if order.PaymentMethod == paymentMethodWallet {
+		switch err := chargeWallet(ctx, order.UserID, ret.ID, ret.Price); err {
+		case nil:
+			ret.PaymentMethod = paymentMethodWallet
+		case errInsufficientFunds:
+			log.Printf("Return %s of order %s billed on invoice: %v", ret.ID.Hex(), order.ID.Hex(), err)
+			ret.PaymentMethod = paymentMethodInvoice
+		default:
+			return ret, err
+		}
+	}
+
+	return ret, nil
+}
+
+// releaseReattempts puts orders whose next delivery attempt is due back out
+// for delivery with the courier who holds the parcel.
+func releaseReattempts(ctx context.Context, now time.Time) (int64, error) {
+	orders := client.Database("myapp").Collection("orders")
+	cursor, err := orders.Find(ctx, bson.M{"status": "Reattempt scheduled", "nextAttemptAt": bson.M{"$lte": now}})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var due []Order
+	if err := cursor.All(ctx, &due); err != nil {
+		return 0, err
+	}
+
+	var released int64
+	for _, order := range due {
+		_, err := updateOrder(ctx,
+			bson.M{"_id": order.ID, "status": "Reattempt scheduled"},
+			bson.M{"$set": bson.M{"status": "In transit"}, "$unset": bson.M{"nextAttemptAt": ""}},
+			"",
+		)
+		if err == mongo.ErrNoDocuments {
+			continue
+		}
+		if err != nil {
+			return released, err
+		}
+		released++
+	}
+	return released, nil
+}
+
+// RescheduleDelivery lets the sender pick the date of the next attempt
+// after a failed delivery.
+func RescheduleDelivery(w http.ResponseWriter, r *http.Request) {
+	orderID, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid OrderID format", http.StatusBadRequest)
+		return
+	}
+
+	userID, err := primitive.ObjectIDFromHex(r.Header.Get("userId"))
+	if err != nil {
+		http.Error(w, "Invalid UserID format", http.StatusBadRequest)
+		return
+	}
+
+	var request struct {
+		NextAttemptAt time.Time `json:"nextAttemptAt"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if !request.NextAttemptAt.After(time.Now()) {
+		http.Error(w, "Next attempt must be in the future", http.StatusBadRequest)
+		return
+	}
+
+	result, err := client.Database("myapp").Collection("orders").UpdateOne(context.TODO(),
+		bson.M{"_id": orderID, "userId": userID, "status": "Reattempt scheduled"},
+		bson.M{"$set": bson.M{"nextAttemptAt": request.NextAttemptAt.UTC()}},
+	)
+	if err != nil {
+		http.Error(w, "Failed to reschedule delivery", http.StatusInternalServerError)
+		return
+	}
+	if result.MatchedCount == 0 {
+		http.Error(w, "Order not found or not awaiting a reattempt", http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode("Delivery rescheduled successfully")
+}
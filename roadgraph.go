@@ -0,0 +1,172 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+)
+
+// RoadGraph is a local road network loaded from ROAD_GRAPH_FILE. Points off
+// the network are snapped to their nearest node.
+type RoadGraph struct {
+	Nodes []RoadNode `json:"nodes"`
+	Edges []RoadEdge `json:"edges"`
+
+	index map[string]int
+	adj   [][]roadArc
+}
+
+type RoadNode struct {
+	ID  string  `json:"id"`
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+type RoadEdge struct {
+	From   string  `json:"from"`
+	To     string  `json:"to"`
+	Km     float64 `json:"km"`
+	OneWay bool    `json:"oneway"`
+}
+
+type roadArc struct {
+	to int
+	km float64
+}
+
+var roadGraph *RoadGraph
+
+func loadRoadGraph(path string) (*RoadGraph, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var g RoadGraph
+	if err := json.Unmarshal(data, &g); err != nil {
+		return nil, err
+	}
+	if len(g.Nodes) == 0 {
+		return nil, fmt.Errorf("road graph %s has no nodes", path)
+	}
+
+	g.index = make(map[string]int, len(g.Nodes))
+	for i, n := range g.Nodes {
+		g.index[n.ID] = i
+	}
+	g.adj = make([][]roadArc, len(g.Nodes))
+	for _, e := range g.Edges {
+		from, ok1 := g.index[e.From]
+		to, ok2 := g.index[e.To]
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("road graph edge %s-%s references an unknown node", e.From, e.To)
+		}
+		km := e.Km
+		if km <= 0 {
+			km = haversineKm(g.point(from), g.point(to))
+		}
+		g.adj[from] = append(g.adj[from], roadArc{to, km})
+		if !e.OneWay {
+			g.adj[to] = append(g.adj[to], roadArc{from, km})
+		}
+	}
+	return &g, nil
+}
+
+func (g *RoadGraph) point(i int) GeoPoint {
+	return GeoPoint{Lat: g.Nodes[i].Lat, Lng: g.Nodes[i].Lng}
+}
+
+func (g *RoadGraph) nearest(p GeoPoint) (int, float64) {
+	best, bestKm := 0, math.Inf(1)
+	for i := range g.Nodes {
+		if km := haversineKm(p, g.point(i)); km < bestKm {
+			best, bestKm = i, km
+		}
+	}
+	return best, bestKm
+}
+
+// shortestFrom runs Dijkstra from src and returns the distance to every node.
+func (g *RoadGraph) shortestFrom(src int) []float64 {
+	dist := make([]float64, len(g.Nodes))
+	for i := range dist {
+		dist[i] = math.Inf(1)
+	}
+	dist[src] = 0
+
+	pq := &distQueue{{node: src}}
+	for pq.Len() > 0 {
+		cur := heap.Pop(pq).(distItem)
+		if cur.km > dist[cur.node] {
+			continue
+		}
+		for _, a := range g.adj[cur.node] {
+			if d := cur.km + a.km; d < dist[a.to] {
+				dist[a.to] = d
+				heap.Push(pq, distItem{a.to, d})
+			}
+		}
+	}
+	return dist
+}
+
+type distItem struct {
+	node int
+	km   float64
+}
+
+type distQueue []distItem
+
+func (q distQueue) Len() int            { return len(q) }
+func (q distQueue) Less(i, j int) bool  { return q[i].km < q[j].km }
+func (q distQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *distQueue) Push(x interface{}) { *q = append(*q, x.(distItem)) }
+func (q *distQueue) Pop() interface{} {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
+
+// distanceMatrix returns pairwise road distances between points, falling
+// back to haversine when no road graph is loaded or two points are not
+// connected on it.
+func distanceMatrix(points []GeoPoint) [][]float64 {
+	n := len(points)
+	m := make([][]float64, n)
+	for i := range m {
+		m[i] = make([]float64, n)
+	}
+
+	if roadGraph == nil {
+		for i := 0; i < n; i++ {
+			for j := 0; j < n; j++ {
+				m[i][j] = haversineKm(points[i], points[j])
+			}
+		}
+		return m
+	}
+
+	snapped := make([]int, n)
+	snapKm := make([]float64, n)
+	for i, p := range points {
+		snapped[i], snapKm[i] = roadGraph.nearest(p)
+	}
+	for i := 0; i < n; i++ {
+		dist := roadGraph.shortestFrom(snapped[i])
+		for j := 0; j < n; j++ {
+			switch {
+			case i == j:
+				m[i][j] = 0
+			case math.IsInf(dist[snapped[j]], 1):
+				m[i][j] = haversineKm(points[i], points[j])
+			default:
+				m[i][j] = snapKm[i] + dist[snapped[j]] + snapKm[j]
+			}
+		}
+	}
+	return m
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeRoadGraph(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "roads.json")
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestShortestFrom(t *testing.T) {
+	// A-B-C is shorter than the direct A-C road, and C-D is one way.
+	g, err := loadRoadGraph(writeRoadGraph(t, `{
+		"nodes": [
+			{"id": "A", "lat": 0, "lng": 0},
+			{"id": "B", "lat": 0, "lng": 0.01},
+			{"id": "C", "lat": 0, "lng": 0.02},
+			{"id": "D", "lat": 0, "lng": 0.03},
+			{"id": "E", "lat": 1, "lng": 1}
+		],
+		"edges": [
+			{"from": "A", "to": "B", "km": 1},
+			{"from": "B", "to": "C", "km": 1.5},
+			{"from": "A", "to": "C", "km": 5},
+			{"from": "C", "to": "D", "km": 2, "oneway": true}
+		]
+	}`))
+	if err != nil {
+		t.Fatalf("loadRoadGraph: %v", err)
+	}
+
+	inf := math.Inf(1)
+	tests := []struct {
+		src  string
+		want []float64
+	}{
+		{"A", []float64{0, 1, 2.5, 4.5, inf}},
+		{"C", []float64{2.5, 1.5, 0, 2, inf}},
+		{"D", []float64{inf, inf, inf, 0, inf}},
+		{"E", []float64{inf, inf, inf, inf, 0}},
+	}
+	for _, tt := range tests {
+		got := g.shortestFrom(g.index[tt.src])
+		for i := range tt.want {
+			if got[i] != tt.want[i] && math.Abs(got[i]-tt.want[i]) > 1e-9 {
+				t.Errorf("shortestFrom(%s) = %v, want %v", tt.src, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestLoadRoadGraph(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr bool
+	}{
+		{"no nodes", `{"nodes": [], "edges": []}`, true},
+		{"unknown node", `{"nodes": [{"id": "A"}], "edges": [{"from": "A", "to": "B", "km": 1}]}`, true},
+		{"bad json", `{"nodes": [`, true},
+		{"valid", `{"nodes": [{"id": "A"}, {"id": "B", "lng": 0.01}], "edges": [{"from": "A", "to": "B"}]}`, false},
+	}
+	for _, tt := range tests {
+		_, err := loadRoadGraph(writeRoadGraph(t, tt.data))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+
+	// An edge without a length is as long as the straight line.
+	g, err := loadRoadGraph(writeRoadGraph(t, tests[3].data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := haversineKm(GeoPoint{}, GeoPoint{Lng: 0.01})
+	if got := g.shortestFrom(0)[1]; math.Abs(got-want) > 1e-9 {
+		t.Errorf("edge without km = %v, want %v", got, want)
+	}
+}
+
+func TestDistanceMatrixSnapsToRoads(t *testing.T) {
+	g, err := loadRoadGraph(writeRoadGraph(t, `{
+		"nodes": [{"id": "A", "lat": 0, "lng": 0}, {"id": "B", "lat": 0, "lng": 0.1}],
+		"edges": [{"from": "A", "to": "B", "km": 20}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := roadGraph
+	roadGraph = g
+	defer func() { roadGraph = saved }()
+
+	// Each point is 0.001 degrees of latitude off its node.
+	points := []GeoPoint{{Lat: 0.001, Lng: 0}, {Lat: 0.001, Lng: 0.1}}
+	snap := haversineKm(points[0], GeoPoint{})
+	m := distanceMatrix(points)
+	if want := snap + 20 + snap; math.Abs(m[0][1]-want) > 1e-9 || math.Abs(m[1][0]-want) > 1e-9 {
+		t.Errorf("distance = %v, %v; want %v", m[0][1], m[1][0], want)
+	}
+	if m[0][0] != 0 || m[1][1] != 0 {
+		t.Errorf("distance to self = %v, %v; want 0", m[0][0], m[1][1])
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	stopServiceTime = 5 * time.Minute
+
+	// latenessWeight makes one minute late cost as much as this many
+	// minutes of driving when comparing routes.
+	latenessWeight = 10
+)
+
+var activeCourierStatuses = bson.A{"Accepted", "Picked up", "In transit"}
+
+type routeNode struct {
+	OrderID  primitive.ObjectID
+	StopID   *primitive.ObjectID
+	Kind     string
+	Location string
+	Point    GeoPoint
+	Window   *TimeWindow
+	// after is the index of the node that must be visited first, or -1.
+	after int
+}
+
+type RouteStop struct {
+	Sequence       int                 `json:"sequence"`
+	OrderID        primitive.ObjectID  `json:"orderId"`
+	StopID         *primitive.ObjectID `json:"stopId,omitempty"`
+	Kind           string              `json:"kind"`
+	Location       string              `json:"location"`
+	Coordinates    GeoPoint            `json:"coordinates"`
+	DistanceKm     float64             `json:"distanceKm"`
+	ETA            time.Time           `json:"eta"`
+	WindowEarliest *time.Time          `json:"windowEarliest,omitempty"`
+	WindowLatest   *time.Time          `json:"windowLatest,omitempty"`
+	Late           bool                `json:"late"`
+}
+
+type RoutePlan struct {
+	CourierEmail    string               `json:"courierEmail"`
+	StartsAt        time.Time            `json:"startsAt"`
+	SpeedKmh        float64              `json:"speedKmh"`
+	TotalDistanceKm float64              `json:"totalDistanceKm"`
+	FinishesAt      time.Time            `json:"finishesAt"`
+	Stops           []RouteStop          `json:"stops"`
+	Unrouted        []primitive.ObjectID `json:"unrouted"`
+}
+
+func pickedUp(o Order) bool {
+	return o.Status == "Picked up" || o.Status == "In transit"
+}
+
+// routeNodes turns the courier's active orders into the stops still to be
+// visited. Orders missing coordinates are returned as unrouted.
+func routeNodes(orders []Order) ([]routeNode, []primitive.ObjectID) {
+	var nodes []routeNode
+	unrouted := []primitive.ObjectID{}
+
+	for _, o := range orders {
+		if len(o.Stops) > 0 {
+			var pending []routeNode
+			ok := true
+			for _, s := range o.Stops {
+				if s.finished() {
+					continue
+				}
+				if s.Coordinates == nil {
+					ok = false
+					break
+				}
+				stopID := s.ID
+				n := routeNode{OrderID: o.ID, StopID: &stopID, Kind: s.Kind, Location: s.Location, Point: *s.Coordinates, after: -1}
+				if s.Kind == stopPickup && s.Sequence == 1 {
+					n.Window = o.PickupWindow
+				} else if s.Kind == stopDropOff {
+					n.Window = o.DeliveryWindow
+				}
+				pending = append(pending, n)
+			}
+			if !ok {
+				unrouted = append(unrouted, o.ID)
+				continue
+			}
+			for i := range pending {
+				if i > 0 {
+					pending[i].after = len(nodes) + i - 1
+				}
+			}
+			nodes = append(nodes, pending...)
+			continue
+		}
+
+		if o.DropOffCoordinates == nil || (!pickedUp(o) && o.PickupCoordinates == nil) {
+			unrouted = append(unrouted, o.ID)
+			continue
+		}
+		after := -1
+		if !pickedUp(o) {
+			nodes = append(nodes, routeNode{OrderID: o.ID, Kind: stopPickup, Location: o.PickupLocation, Point: *o.PickupCoordinates, Window: o.PickupWindow, after: -1})
+			after = len(nodes) - 1
+		}
+		nodes = append(nodes, routeNode{OrderID: o.ID, Kind: stopDropOff, Location: o.DropOffLocation, Point: *o.DropOffCoordinates, Window: o.DeliveryWindow, after: after})
+	}
+	return nodes, unrouted
+}
+
+type routePlanner struct {
+	nodes []routeNode
+	// dist is indexed by node index + 1; index 0 is the courier's position.
+	dist     [][]float64
+	hasStart bool
+	start    time.Time
+	speedKmh float64
+}
+
+func (p *routePlanner) legKm(from, to int) float64 {
+	if from < 0 && !p.hasStart {
+		return 0
+	}
+	return p.dist[from+1][to+1]
+}
+
+// simulate walks seq from the courier's position and returns its cost, the
+// arrival time at each node and the leg distances.
+func (p *routePlanner) simulate(seq []int) (float64, []time.Time, []float64) {
+	now := p.start
+	prev := -1
+	var late float64
+	etas := make([]time.Time, len(seq))
+	legs := make([]float64, len(seq))
+
+	for i, n := range seq {
+		legs[i] = p.legKm(prev, n)
+		now = now.Add(time.Duration(legs[i] / p.speedKmh * float64(time.Hour)))
+		if w := p.nodes[n].Window; w != nil {
+			if now.Before(w.Earliest) {
+				now = w.Earliest
+			}
+			if now.After(w.Latest) {
+				late += now.Sub(w.Latest).Minutes()
+			}
+		}
+		etas[i] = now
+		now = now.Add(stopServiceTime)
+		prev = n
+	}
+	return now.Sub(p.start).Minutes() + latenessWeight*late, etas, legs
+}
+
+func (p *routePlanner) valid(seq []int) bool {
+	pos := make([]int, len(p.nodes))
+	for i, n := range seq {
+		pos[n] = i
+	}
+	for i, n := range p.nodes {
+		if n.after >= 0 && pos[n.after] > pos[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// plan builds a route greedily, always going to the reachable stop that can
+// be served soonest, then improves it by moving single stops while that
+// lowers the cost.
+func (p *routePlanner) plan() []int {
+	visited := make([]bool, len(p.nodes))
+	seq := make([]int, 0, len(p.nodes))
+	for len(seq) < len(p.nodes) {
+		best, bestCost := -1, 0.0
+		for i, n := range p.nodes {
+			if visited[i] || (n.after >= 0 && !visited[n.after]) {
+				continue
+			}
+			cost, _, _ := p.simulate(append(seq, i))
+			if best < 0 || cost < bestCost {
+				best, bestCost = i, cost
+			}
+		}
+		visited[best] = true
+		seq = append(seq, best)
+	}
+
+	cost, _, _ := p.simulate(seq)
+	for improved := true; improved; {
+		improved = false
+		for from := range seq {
+			for to := range seq {
+				if from == to {
+					continue
+				}
+				cand := make([]int, 0, len(seq))
+				cand = append(cand, seq[:from]...)
+				cand = append(cand, seq[from+1:]...)
+				cand = append(cand[:to], append([]int{seq[from]}, cand[to:]...)...)
+				if !p.valid(cand) {
+					continue
+				}
+				if c, _, _ := p.simulate(cand); c < cost-1e-9 {
+					seq, cost, improved = cand, c, true
+				}
+			}
+		}
+	}
+	return seq
+}
+
+func planCourierRoute(orders []Order, start *GeoPoint, startAt time.Time, speedKmh float64) RoutePlan {
+	nodes, unrouted := routeNodes(orders)
+
+	points := make([]GeoPoint, len(nodes)+1)
+	if start != nil {
+		points[0] = *start
+	}
+	for i, n := range nodes {
+		points[i+1] = n.Point
+	}
+
+	p := &routePlanner{nodes: nodes, dist: distanceMatrix(points), hasStart: start != nil, start: startAt, speedKmh: speedKmh}
+	seq := p.plan()
+	_, etas, legs := p.simulate(seq)
+
+	plan := RoutePlan{StartsAt: startAt, SpeedKmh: speedKmh, FinishesAt: startAt, Stops: []RouteStop{}, Unrouted: unrouted}
+	for i, n := range seq {
+		node := nodes[n]
+		stop := RouteStop{
+			Sequence:    i + 1,
+			OrderID:     node.OrderID,
+			StopID:      node.StopID,
+			Kind:        node.Kind,
+			Location:    node.Location,
+			Coordinates: node.Point,
+			DistanceKm:  legs[i],
+			ETA:         etas[i],
+		}
+		if node.Window != nil {
+			stop.WindowEarliest = &node.Window.Earliest
+			stop.WindowLatest = &node.Window.Latest
+			stop.Late = etas[i].After(node.Window.Latest)
+		}
+		plan.TotalDistanceKm += legs[i]
+		plan.FinishesAt = etas[i].Add(stopServiceTime)
+		plan.Stops = append(plan.Stops, stop)
+	}
+	return plan
+}
+
+// GetCourierRoute plans the courier's accepted orders. lat and lng give the
+// courier's current position; without them the last reported location is
+// used, or the route starts at its first stop.
+func GetCourierRoute(w http.ResponseWriter, r *http.Request) {
+	email := r.URL.Query().Get("email")
+	if email == "" {
+		http.Error(w, "Courier email is required", http.StatusBadRequest)
+		return
+	}
+
+	var start *GeoPoint
+	if lat, lng := r.URL.Query().Get("lat"), r.URL.Query().Get("lng"); lat != "" || lng != "" {
+		la, err1 := strconv.ParseFloat(lat, 64)
+		ln, err2 := strconv.ParseFloat(lng, 64)
+		if err1 != nil || err2 != nil {
+			http.Error(w, "Invalid lat/lng", http.StatusBadRequest)
+			return
+		}
+		start = &GeoPoint{Lat: la, Lng: ln}
+	}
+
+	now := time.Now().UTC()
+	if start == nil {
+		var courier Courier
+		if err := client.Database("myapp").Collection("couriers").FindOne(context.TODO(), bson.M{"email": email}).Decode(&courier); err == nil {
+			start = courierPosition(courier, now)
+		}
+	}
+
+	cursor, err := client.Database("myapp").Collection("orders").Find(context.TODO(), bson.M{
+		"courierEmail": email,
+		"status":       bson.M{"$in": activeCourierStatuses},
+	})
+	if err != nil {
+		http.Error(w, "Failed to retrieve assigned orders", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.TODO())
+
+	var orders []Order
+	if err := cursor.All(context.TODO(), &orders); err != nil {
+		http.Error(w, "Failed to decode orders", http.StatusInternalServerError)
+		return
+	}
+
+	plan := planCourierRoute(orders, start, now, courierHistoricalSpeed(context.TODO(), email))
+	plan.CourierEmail = email
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(plan)
+}
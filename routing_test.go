@@ -0,0 +1,178 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// at is a point on the equator lng degrees east, about 1.1 km per 0.01.
+func at(lng float64) *GeoPoint {
+	return &GeoPoint{Lat: 0, Lng: lng}
+}
+
+func TestPlanCourierRoute(t *testing.T) {
+	start := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+	ids := make([]primitive.ObjectID, 4)
+	for i := range ids {
+		ids[i] = primitive.NewObjectID()
+	}
+
+	type visit struct {
+		order int
+		kind  string
+	}
+	tests := []struct {
+		name     string
+		orders   []Order
+		want     []visit
+		unrouted int
+	}{
+		{
+			name: "pickups before drop-offs along the way",
+			orders: []Order{
+				{ID: ids[0], Status: "Accepted", PickupCoordinates: at(0.01), DropOffCoordinates: at(0.03)},
+				{ID: ids[1], Status: "Accepted", PickupCoordinates: at(0.02), DropOffCoordinates: at(0.04)},
+			},
+			want: []visit{{0, stopPickup}, {1, stopPickup}, {0, stopDropOff}, {1, stopDropOff}},
+		},
+		{
+			name: "drop-off never before its pickup",
+			orders: []Order{
+				{ID: ids[0], Status: "Accepted", PickupCoordinates: at(0.05), DropOffCoordinates: at(0.01)},
+			},
+			want: []visit{{0, stopPickup}, {0, stopDropOff}},
+		},
+		{
+			name: "picked up orders only need their drop-off",
+			orders: []Order{
+				{ID: ids[0], Status: "In transit", PickupCoordinates: at(0.05), DropOffCoordinates: at(0.02)},
+				{ID: ids[1], Status: "Picked up", DropOffCoordinates: at(0.01)},
+			},
+			want: []visit{{1, stopDropOff}, {0, stopDropOff}},
+		},
+		{
+			name: "a closing window goes first",
+			orders: []Order{
+				{ID: ids[0], Status: "In transit", DropOffCoordinates: at(0.01)},
+				{ID: ids[1], Status: "In transit", DropOffCoordinates: at(0.03),
+					DeliveryWindow: &TimeWindow{Earliest: start, Latest: start.Add(12 * time.Minute)}},
+			},
+			want: []visit{{1, stopDropOff}, {0, stopDropOff}},
+		},
+		{
+			name: "multi-stop orders keep their stop order",
+			orders: []Order{
+				{ID: ids[0], Status: "Accepted", Stops: []Stop{
+					{Sequence: 1, Kind: stopPickup, Coordinates: at(0.04), Status: "Pending"},
+					{Sequence: 2, Kind: stopDropOff, Coordinates: at(0.01), Status: "Pending"},
+					{Sequence: 3, Kind: stopDropOff, Coordinates: at(0.02), Status: "Pending"},
+				}},
+			},
+			want: []visit{{0, stopPickup}, {0, stopDropOff}, {0, stopDropOff}},
+		},
+		{
+			name: "finished stops are skipped",
+			orders: []Order{
+				{ID: ids[0], Status: "In transit", Stops: []Stop{
+					{Sequence: 1, Kind: stopPickup, Coordinates: at(0.04), Status: "Completed"},
+					{Sequence: 2, Kind: stopDropOff, Coordinates: at(0.01), Status: "Failed"},
+					{Sequence: 3, Kind: stopDropOff, Coordinates: at(0.02), Status: "Pending"},
+				}},
+			},
+			want: []visit{{0, stopDropOff}},
+		},
+		{
+			name: "orders without coordinates are unrouted",
+			orders: []Order{
+				{ID: ids[0], Status: "Accepted", PickupCoordinates: at(0.01)},
+				{ID: ids[1], Status: "In transit", DropOffCoordinates: at(0.02)},
+				{ID: ids[2], Status: "Accepted", Stops: []Stop{
+					{Sequence: 1, Kind: stopPickup, Status: "Pending"},
+					{Sequence: 2, Kind: stopDropOff, Coordinates: at(0.01), Status: "Pending"},
+				}},
+			},
+			want:     []visit{{1, stopDropOff}},
+			unrouted: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan := planCourierRoute(tt.orders, at(0), start, 20)
+
+			if len(plan.Unrouted) != tt.unrouted {
+				t.Errorf("unrouted = %v, want %d orders", plan.Unrouted, tt.unrouted)
+			}
+			if len(plan.Stops) != len(tt.want) {
+				t.Fatalf("got %d stops, want %d: %+v", len(plan.Stops), len(tt.want), plan.Stops)
+			}
+			var total float64
+			for i, s := range plan.Stops {
+				want := tt.want[i]
+				if s.OrderID != tt.orders[want.order].ID || s.Kind != want.kind {
+					t.Errorf("stop %d is the %s of order %s, want the %s of order %d", i+1, s.Kind, s.OrderID.Hex(), want.kind, want.order)
+				}
+				if s.Sequence != i+1 {
+					t.Errorf("stop %d has sequence %d", i+1, s.Sequence)
+				}
+				if s.Late {
+					t.Errorf("stop %d is late", i+1)
+				}
+				if i > 0 && !s.ETA.After(plan.Stops[i-1].ETA) {
+					t.Errorf("stop %d ETA %v is not after the previous stop's %v", i+1, s.ETA, plan.Stops[i-1].ETA)
+				}
+				total += s.DistanceKm
+			}
+			if total != plan.TotalDistanceKm {
+				t.Errorf("total distance %v, legs add up to %v", plan.TotalDistanceKm, total)
+			}
+		})
+	}
+}
+
+func TestRoutePlannerSimulate(t *testing.T) {
+	start := time.Date(2026, 3, 2, 9, 0, 0, 0, time.UTC)
+	p := &routePlanner{
+		nodes: []routeNode{
+			{Window: &TimeWindow{Earliest: start.Add(30 * time.Minute), Latest: start.Add(time.Hour)}, after: -1},
+			{Window: &TimeWindow{Earliest: start, Latest: start.Add(10 * time.Minute)}, after: -1},
+		},
+		// 10 km from the start to each node and between them.
+		dist:     [][]float64{{0, 10, 10}, {10, 0, 10}, {10, 10, 0}},
+		hasStart: true,
+		start:    start,
+		speedKmh: 60,
+	}
+
+	tests := []struct {
+		seq      []int
+		wantCost float64
+		wantETAs []time.Duration
+	}{
+		// Node 0 is reached after 10 minutes and waits for its window to
+		// open at 30; node 1 is then reached at 45, 35 minutes late.
+		{[]int{0, 1}, 50 + latenessWeight*35, []time.Duration{30 * time.Minute, 45 * time.Minute}},
+		// Node 1 is reached on time at 10 and node 0 at 25, waiting until 30.
+		{[]int{1, 0}, 35, []time.Duration{10 * time.Minute, 30 * time.Minute}},
+	}
+	for _, tt := range tests {
+		cost, etas, legs := p.simulate(tt.seq)
+		if cost != tt.wantCost {
+			t.Errorf("simulate(%v) cost = %v, want %v", tt.seq, cost, tt.wantCost)
+		}
+		for i, want := range tt.wantETAs {
+			if got := etas[i].Sub(start); got != want {
+				t.Errorf("simulate(%v) ETA %d = %v, want %v", tt.seq, i, got, want)
+			}
+			if legs[i] != 10 {
+				t.Errorf("simulate(%v) leg %d = %v km, want 10", tt.seq, i, legs[i])
+			}
+		}
+	}
+
+	if best := p.plan(); len(best) != 2 || best[0] != 1 {
+		t.Errorf("plan() = %v, want node 1 first", best)
+	}
+}
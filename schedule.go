@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+	_ "time/tzdata"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var (
+	serviceOpenHour  = envInt("SERVICE_OPEN_HOUR", 8)
+	serviceCloseHour = envInt("SERVICE_CLOSE_HOUR", 20)
+
+	// dispatchLead is how long before the pickup window opens a scheduled
+	// order is released to dispatch.
+	dispatchLead = time.Duration(envInt("DISPATCH_LEAD_MINUTES", 60)) * time.Minute
+
+	courierSpeedKmh = float64(envInt("COURIER_SPEED_KMH", 25))
+
+	// courierCapacity is how many windowed orders a courier may hold whose
+	// pickup-to-delivery spans overlap.
+	courierCapacity = envInt("COURIER_CAPACITY", 3)
+)
+
+const minWindowLength = 30 * time.Minute
+
+// TimeWindow bounds are stored in UTC; Timezone is the IANA zone of the
+// address and is used to check service hours.
+type TimeWindow struct {
+	Earliest time.Time `json:"earliest" bson:"earliest"`
+	Latest   time.Time `json:"latest" bson:"latest"`
+	Timezone string    `json:"timezone" bson:"timezone"`
+}
+
+func (tw TimeWindow) validate(now time.Time) error {
+	loc, err := time.LoadLocation(tw.Timezone)
+	if err != nil || tw.Timezone == "" {
+		return fmt.Errorf("unknown timezone %q", tw.Timezone)
+	}
+	if !tw.Latest.After(tw.Earliest) {
+		return errors.New("window must end after it starts")
+	}
+	if tw.Latest.Sub(tw.Earliest) < minWindowLength {
+		return fmt.Errorf("window must be at least %s long", minWindowLength)
+	}
+	if !tw.Latest.After(now) {
+		return errors.New("window is in the past")
+	}
+
+	start := tw.Earliest.In(loc)
+	end := tw.Latest.In(loc)
+	open := time.Date(start.Year(), start.Month(), start.Day(), serviceOpenHour, 0, 0, 0, loc)
+	closing := time.Date(start.Year(), start.Month(), start.Day(), serviceCloseHour, 0, 0, 0, loc)
+	if start.Before(open) || end.After(closing) {
+		return fmt.Errorf("window must fall within service hours %02d:00-%02d:00 %s on a single day", serviceOpenHour, serviceCloseHour, tw.Timezone)
+	}
+	return nil
+}
+
+func travelTime(order Order) time.Duration {
+	return time.Duration(orderDistanceKm(order) / courierSpeedKmh * float64(time.Hour))
+}
+
+// validateOrderWindows normalises the windows to UTC and checks they can be
+// met by a courier riding straight from pickup to drop-off.
+func validateOrderWindows(order *Order, now time.Time) error {
+	if order.PickupWindow != nil {
+		if err := order.PickupWindow.validate(now); err != nil {
+			return fmt.Errorf("pickup %v", err)
+		}
+		order.PickupWindow.Earliest = order.PickupWindow.Earliest.UTC()
+		order.PickupWindow.Latest = order.PickupWindow.Latest.UTC()
+	}
+	if order.DeliveryWindow != nil {
+		if err := order.DeliveryWindow.validate(now); err != nil {
+			return fmt.Errorf("delivery %v", err)
+		}
+		order.DeliveryWindow.Earliest = order.DeliveryWindow.Earliest.UTC()
+		order.DeliveryWindow.Latest = order.DeliveryWindow.Latest.UTC()
+	}
+	if order.PickupWindow != nil && order.DeliveryWindow != nil {
+		if order.PickupWindow.Earliest.Add(travelTime(*order)).After(order.DeliveryWindow.Latest) {
+			return errors.New("delivery window cannot be reached from the pickup window")
+		}
+	}
+	return nil
+}
+
+// orderSpan is the period a courier is committed to the order, or false when
+// the order has no windows.
+func orderSpan(order Order) (time.Time, time.Time, bool) {
+	switch {
+	case order.PickupWindow != nil && order.DeliveryWindow != nil:
+		return order.PickupWindow.Earliest, order.DeliveryWindow.Latest, true
+	case order.PickupWindow != nil:
+		return order.PickupWindow.Earliest, order.PickupWindow.Latest.Add(travelTime(order)), true
+	case order.DeliveryWindow != nil:
+		return order.DeliveryWindow.Earliest.Add(-travelTime(order)), order.DeliveryWindow.Latest, true
+	}
+	return time.Time{}, time.Time{}, false
+}
+
+// courierCanMeetWindow refuses a courier who cannot ride from their last
+// known position to the pickup before the pickup window closes or on to the
+// drop-off before the delivery window closes, or who already holds
+// courierCapacity active orders overlapping the order's windows. The
+// returned string explains a refusal.
+func courierCanMeetWindow(ctx context.Context, courier Courier, order Order) (bool, string, error) {
+	start, end, ok := orderSpan(order)
+	if !ok {
+		return true, "", nil
+	}
+	now := time.Now()
+	if end.Before(now) {
+		return false, "the order's delivery window has already passed", nil
+	}
+
+	// The courier rides from their last known position to the pickup, waits
+	// for the pickup window to open and rides on to the drop-off.
+	speed := courierHistoricalSpeed(ctx, courier.Email)
+	pickupAt := now
+	if order.PickupCoordinates != nil {
+		if pos := courierPosition(courier, now); pos != nil {
+			km := haversineKm(*pos, *order.PickupCoordinates)
+			pickupAt = now.Add(time.Duration(km / speed * float64(time.Hour)))
+			if order.PickupWindow != nil && pickupAt.After(order.PickupWindow.Latest) {
+				return false, fmt.Sprintf("courier is %.1f km away and cannot reach the pickup before its window closes", km), nil
+			}
+		}
+	}
+	if order.PickupWindow != nil && pickupAt.Before(order.PickupWindow.Earliest) {
+		pickupAt = order.PickupWindow.Earliest
+	}
+	if order.DeliveryWindow != nil {
+		dropOffAt := pickupAt.Add(time.Duration(orderDistanceKm(order) / speed * float64(time.Hour)))
+		if dropOffAt.After(order.DeliveryWindow.Latest) {
+			return false, "courier cannot reach the drop-off before the delivery window closes", nil
+		}
+	}
+
+	cursor, err := client.Database("myapp").Collection("orders").Find(ctx, bson.M{
+		"courierEmail": courier.Email,
+		"_id":          bson.M{"$ne": order.ID},
+		"status":       bson.M{"$in": bson.A{"Pending Acceptance", "Accepted", "Picked up", "In transit"}},
+	})
+	if err != nil {
+		return false, "", err
+	}
+	defer cursor.Close(ctx)
+
+	var active []Order
+	if err := cursor.All(ctx, &active); err != nil {
+		return false, "", err
+	}
+
+	overlapping := 0
+	for _, o := range active {
+		s, e, ok := orderSpan(o)
+		if ok && s.Before(end) && start.Before(e) {
+			overlapping++
+		}
+	}
+	if overlapping >= courierCapacity {
+		return false, fmt.Sprintf("courier already has %d orders during this window", overlapping), nil
+	}
+	return true, "", nil
+}
+
+// releaseScheduledOrders moves scheduled orders whose pickup window opens
+// within dispatchLead into the normal Pending queue.
+func releaseScheduledOrders(ctx context.Context, now time.Time) (int64, error) {
+	orders := client.Database("myapp").Collection("orders")
+	cursor, err := orders.Find(ctx, bson.M{"status": "Scheduled", "pickupWindow.earliest": bson.M{"$lte": now.Add(dispatchLead)}})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var due []Order
+	if err := cursor.All(ctx, &due); err != nil {
+		return 0, err
+	}
+
+	var released int64
+	for _, order := range due {
+		_, err := updateOrder(ctx,
+			bson.M{"_id": order.ID, "status": "Scheduled"},
+			bson.M{"$set": bson.M{"status": "Pending"}},
+			"",
+		)
+		if err == mongo.ErrNoDocuments {
+			continue
+		}
+		if err != nil {
+			return released, err
+		}
+		released++
+	}
+	return released, nil
+}
+
+func runScheduler(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := materializeTemplates(context.TODO(), time.Now()); err != nil {
+			log.Println("Failed to materialize order templates:", err)
+		}
+
+		if err := checkSLAs(context.TODO(), time.Now().UTC()); err != nil {
+			log.Println("Failed to check SLAs:", err)
+		}
+
+		n, err := releaseScheduledOrders(context.TODO(), time.Now())
+		if err != nil {
+			log.Println("Failed to release scheduled orders:", err)
+			continue
+		}
+		if n > 0 {
+			log.Printf("Released %d scheduled orders to dispatch", n)
+		}
+
+		n, err = releaseReattempts(context.TODO(), time.Now().UTC())
+		if err != nil {
+			log.Println("Failed to release delivery reattempts:", err)
+			continue
+		}
+		if n > 0 {
+			log.Printf("Put %d orders back out for delivery", n)
+		}
+	}
+}
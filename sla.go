@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	// slaDeliveryTarget is the promised delivery time for orders without a
+	// delivery window, counted from creation or the pickup window.
+	slaDeliveryTarget = time.Duration(envInt("SLA_DELIVERY_MINUTES", 120)) * time.Minute
+
+	// slaAtRiskMargin flags orders whose ETA comes this close to the deadline.
+	slaAtRiskMargin = time.Duration(envInt("SLA_AT_RISK_MINUTES", 10)) * time.Minute
+)
+
+const (
+	slaOnTrack  = "on_track"
+	slaAtRisk   = "at_risk"
+	slaBreached = "breached"
+)
+
+type SLAStatus struct {
+	Deadline  time.Time `json:"deadline" bson:"deadline"`
+	State     string    `json:"state" bson:"state"`
+	CheckedAt time.Time `json:"checkedAt" bson:"checkedAt"`
+}
+
+// SLAEvent is raised when an order becomes at risk or breaches its SLA, for
+// admins to follow up and acknowledge.
+type SLAEvent struct {
+	ID             primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	OrderID        primitive.ObjectID `json:"orderId" bson:"orderId"`
+	State          string             `json:"state" bson:"state"`
+	Deadline       time.Time          `json:"deadline" bson:"deadline"`
+	ETA            *time.Time         `json:"eta,omitempty" bson:"eta,omitempty"`
+	CourierEmail   string             `json:"courierEmail,omitempty" bson:"courierEmail,omitempty"`
+	CreatedAt      time.Time          `json:"createdAt" bson:"createdAt"`
+	AcknowledgedBy string             `json:"acknowledgedBy,omitempty" bson:"acknowledgedBy,omitempty"`
+	AcknowledgedAt *time.Time         `json:"acknowledgedAt,omitempty" bson:"acknowledgedAt,omitempty"`
+}
+
+func slaDeadline(order Order) time.Time {
+	switch {
+	case order.DeliveryWindow != nil:
+		return order.DeliveryWindow.Latest
+	case order.Status == "Reattempt scheduled" && order.NextAttemptAt != nil:
+		return order.NextAttemptAt.Add(slaDeliveryTarget)
+	case order.PickupWindow != nil:
+		return order.PickupWindow.Latest.Add(slaDeliveryTarget)
+	}
+	return order.ID.Timestamp().Add(slaDeliveryTarget)
+}
+
+func evaluateSLA(order Order, eta *OrderETA, now time.Time) *SLAStatus {
+	sla := &SLAStatus{Deadline: slaDeadline(order), State: slaOnTrack, CheckedAt: now}
+	switch {
+	case now.After(sla.Deadline):
+		sla.State = slaBreached
+	case eta != nil && eta.Delivery != nil && eta.Delivery.After(sla.Deadline.Add(-slaAtRiskMargin)):
+		sla.State = slaAtRisk
+	}
+	return sla
+}
+
+// checkSLAs refreshes the ETA and SLA state of every open order and raises
+// an event whenever an order moves into at risk or breached.
+func checkSLAs(ctx context.Context, now time.Time) error {
+	orders := client.Database("myapp").Collection("orders")
+	cursor, err := orders.Find(ctx, bson.M{"status": bson.M{"$in": etaStatuses}})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	var open []Order
+	if err := cursor.All(ctx, &open); err != nil {
+		return err
+	}
+
+	estimator := newETAEstimator(now)
+	for _, order := range open {
+		eta, err := estimator.estimate(ctx, order)
+		if err != nil {
+			log.Printf("Failed to estimate ETA for order %s: %v", order.ID.Hex(), err)
+			continue
+		}
+		sla := evaluateSLA(order, eta, now)
+
+		_, err = orders.UpdateOne(ctx, bson.M{"_id": order.ID}, bson.M{"$set": bson.M{"eta": eta, "sla": sla}})
+		if err != nil {
+			return err
+		}
+
+		previous := slaOnTrack
+		if order.SLA != nil {
+			previous = order.SLA.State
+		}
+		if sla.State != previous && sla.State != slaOnTrack {
+			if err := raiseSLAEvent(ctx, order, eta, sla); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func raiseSLAEvent(ctx context.Context, order Order, eta *OrderETA, sla *SLAStatus) error {
+	event := SLAEvent{
+		ID:           primitive.NewObjectID(),
+		OrderID:      order.ID,
+		State:        sla.State,
+		Deadline:     sla.Deadline,
+		CourierEmail: order.CourierEmail,
+		CreatedAt:    sla.CheckedAt,
+	}
+	if eta != nil {
+		event.ETA = eta.Delivery
+	}
+
+	if _, err := client.Database("myapp").Collection("sla_events").InsertOne(ctx, event); err != nil {
+		return err
+	}
+	log.Printf("SLA alert: order %s is %s (deadline %s)", order.ID.Hex(), sla.State, sla.Deadline.Format(time.RFC3339))
+	return nil
+}
+
+// GetSLAOrders lists open orders that are at risk or breached, optionally
+// narrowed to one state.
+func GetSLAOrders(w http.ResponseWriter, r *http.Request) {
+	filter := bson.M{
+		"status":    bson.M{"$in": etaStatuses},
+		"sla.state": bson.M{"$in": bson.A{slaAtRisk, slaBreached}},
+	}
+	if state := r.URL.Query().Get("state"); state != "" {
+		filter["sla.state"] = state
+	}
+
+	opts := options.Find().SetSort(bson.M{"sla.deadline": 1})
+	cursor, err := client.Database("myapp").Collection("orders").Find(context.TODO(), filter, opts)
+	if err != nil {
+		http.Error(w, "Failed to retrieve orders", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.TODO())
+
+	orders := []Order{}
+	if err := cursor.All(context.TODO(), &orders); err != nil {
+		http.Error(w, "Failed to decode orders", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(orders)
+}
+
+func GetSLAEvents(w http.ResponseWriter, r *http.Request) {
+	filter := bson.M{}
+	if state := r.URL.Query().Get("state"); state != "" {
+		filter["state"] = state
+	}
+	switch r.URL.Query().Get("acknowledged") {
+	case "true":
+		filter["acknowledgedAt"] = bson.M{"$exists": true}
+	case "false":
+		filter["acknowledgedAt"] = bson.M{"$exists": false}
+	}
+
+	opts := options.Find().SetSort(bson.M{"createdAt": -1})
+	cursor, err := client.Database("myapp").Collection("sla_events").Find(context.TODO(), filter, opts)
+	if err != nil {
+		http.Error(w, "Failed to retrieve SLA events", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.TODO())
+
+	events := []SLAEvent{}
+	if err := cursor.All(context.TODO(), &events); err != nil {
+		http.Error(w, "Failed to decode SLA events", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+func AcknowledgeSLAEvent(w http.ResponseWriter, r *http.Request) {
+	eventID, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid EventID format", http.StatusBadRequest)
+		return
+	}
+
+	var request struct {
+		AdminID string `json:"adminId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	result, err := client.Database("myapp").Collection("sla_events").UpdateOne(context.TODO(),
+		bson.M{"_id": eventID, "acknowledgedAt": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"acknowledgedBy": request.AdminID, "acknowledgedAt": time.Now().UTC()}},
+	)
+	if err != nil {
+		http.Error(w, "Failed to acknowledge SLA event", http.StatusInternalServerError)
+		return
+	}
+	if result.MatchedCount == 0 {
+		http.Error(w, "SLA event not found or already acknowledged", http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode("SLA event acknowledged")
+}
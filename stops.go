@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	stopPickup  = "pickup"
+	stopDropOff = "dropoff"
+)
+
+type Parcel struct {
+	Reference   string  `json:"reference" bson:"reference"`
+	Description string  `json:"description,omitempty" bson:"description,omitempty"`
+	WeightKg    float64 `json:"weightKg,omitempty" bson:"weightKg,omitempty"`
+}
+
+// Stop is one leg of a multi-stop order. Pickup stops list the parcels
+// collected there and drop-off stops the parcels handed over.
+type Stop struct {
+	ID              primitive.ObjectID `json:"id" bson:"id"`
+	Sequence        int                `json:"sequence" bson:"sequence"`
+	Kind            string             `json:"kind" bson:"kind"`
+	Location        string             `json:"location" bson:"location"`
+	Coordinates     *GeoPoint          `json:"coordinates,omitempty" bson:"coordinates,omitempty"`
+	ContactName     string             `json:"contactName,omitempty" bson:"contactName,omitempty"`
+	ContactEmail    string             `json:"contactEmail,omitempty" bson:"contactEmail,omitempty"`
+	ContactPhone    string             `json:"contactPhone,omitempty" bson:"contactPhone,omitempty"`
+	Parcels         []Parcel           `json:"parcels" bson:"parcels"`
+	Status          string             `json:"status" bson:"status"`
+	FailureReason   string             `json:"failureReason,omitempty" bson:"failureReason,omitempty"`
+	CompletedAt     *time.Time         `json:"completedAt,omitempty" bson:"completedAt,omitempty"`
+	ProofOfDelivery *ProofOfDelivery   `json:"proofOfDelivery,omitempty" bson:"proofOfDelivery,omitempty"`
+	Handover        *HandoverStage     `json:"handover,omitempty" bson:"handover,omitempty"`
+}
+
+func (s Stop) finished() bool {
+	return s.Status == "Completed" || s.Status == "Failed"
+}
+
+func (o *Order) findStop(id string) *Stop {
+	for i := range o.Stops {
+		if o.Stops[i].ID.Hex() == id {
+			return &o.Stops[i]
+		}
+	}
+	return nil
+}
+
+func (o *Order) setProofURLs() {
+	o.ProofOfDelivery.setURLs(orderPath(o.ID))
+	for i := range o.Stops {
+		o.Stops[i].ProofOfDelivery.setURLs(orderPath(o.ID) + "/stops/" + o.Stops[i].ID.Hex())
+	}
+}
+
+// prepareStops validates the stops of a new order, assigns their ids and
+// drop-off PINs, and mirrors the first pickup and last drop-off onto the
+// order's single-stop fields.
+func prepareStops(order *Order) error {
+	if len(order.Stops) == 0 {
+		return nil
+	}
+	if len(order.Stops) < 2 {
+		return errors.New("a multi-stop order needs at least one pickup and one drop-off")
+	}
+	if order.Stops[0].Kind != stopPickup {
+		return errors.New("the first stop must be a pickup")
+	}
+
+	onBoard := map[string]bool{}
+	for i := range order.Stops {
+		stop := &order.Stops[i]
+		if stop.Location == "" {
+			return fmt.Errorf("stop %d has no location", i+1)
+		}
+		if len(stop.Parcels) == 0 {
+			return fmt.Errorf("stop %d has no parcels", i+1)
+		}
+
+		switch stop.Kind {
+		case stopPickup:
+			for _, p := range stop.Parcels {
+				if p.Reference == "" || onBoard[p.Reference] {
+					return fmt.Errorf("stop %d has a missing or duplicate parcel reference %q", i+1, p.Reference)
+				}
+				onBoard[p.Reference] = true
+			}
+		case stopDropOff:
+			for _, p := range stop.Parcels {
+				if !onBoard[p.Reference] {
+					return fmt.Errorf("stop %d drops parcel %q that was not picked up before", i+1, p.Reference)
+				}
+				delete(onBoard, p.Reference)
+			}
+			pin, err := generatePin()
+			if err != nil {
+				return err
+			}
+			stop.Handover = &HandoverStage{PIN: pin}
+		default:
+			return fmt.Errorf("stop %d must be a pickup or dropoff", i+1)
+		}
+
+		stop.ID = primitive.NewObjectID()
+		stop.Sequence = i + 1
+		stop.Status = "Pending"
+		stop.FailureReason = ""
+		stop.CompletedAt = nil
+		stop.ProofOfDelivery = nil
+	}
+	if len(onBoard) > 0 {
+		return errors.New("every picked up parcel must be dropped off")
+	}
+
+	first := order.Stops[0]
+	last := order.Stops[len(order.Stops)-1]
+	if last.Kind != stopDropOff {
+		return errors.New("the last stop must be a drop-off")
+	}
+	order.PickupLocation = first.Location
+	order.PickupCoordinates = first.Coordinates
+	order.DropOffLocation = last.Location
+	order.DropOffCoordinates = last.Coordinates
+	return nil
+}
+
+// eventOrderStopUpdated is recorded for every change to a stop's status.
+const eventOrderStopUpdated = "order.stop_updated"
+
+// stopPins lists by stop id the drop-off PINs the order owner hands out,
+// those of stops whose recipient has no contact details to send them to.
+func stopPins(order Order) map[string]string {
+	pins := map[string]string{}
+	for _, s := range order.Stops {
+		if s.Handover != nil && s.ContactEmail == "" && s.ContactPhone == "" {
+			pins[s.ID.Hex()] = s.Handover.PIN
+		}
+	}
+	return pins
+}
+
+// loadStopForCourier fetches the order and stop in the URL and checks the
+// courier is assigned to the order.
+func loadStopForCourier(r *http.Request, email string) (Order, *Stop, error) {
+	vars := mux.Vars(r)
+	var order Order
+
+	orderID, err := primitive.ObjectIDFromHex(vars["orderId"])
+	if err != nil {
+		return order, nil, &orderError{http.StatusBadRequest, "Invalid OrderID format"}
+	}
+
+	err = client.Database("myapp").Collection("orders").FindOne(context.TODO(), bson.M{"_id": orderID}).Decode(&order)
+	if err != nil {
+		return order, nil, &orderError{http.StatusNotFound, "Order not found"}
+	}
+	if order.CourierEmail == "" || order.CourierEmail != email {
+		return order, nil, &orderError{http.StatusForbidden, "You are not assigned to this order"}
+	}
+
+	stop := order.findStop(vars["stopId"])
+	if stop == nil {
+		return order, nil, &orderError{http.StatusNotFound, "Stop not found"}
+	}
+	if stop.finished() {
+		return order, nil, &orderError{http.StatusConflict, "Stop is already " + stop.Status}
+	}
+	return order, stop, nil
+}
+
+func UploadStopProofOfDelivery(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 2*maxProofUploadBytes+1<<20)
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	email := r.FormValue("email")
+	recipientName := r.FormValue("recipientName")
+	if recipientName == "" {
+		http.Error(w, "Recipient name is required", http.StatusBadRequest)
+		return
+	}
+
+	order, stop, err := loadStopForCourier(r, email)
+	if oerr, ok := err.(*orderError); ok {
+		http.Error(w, oerr.Message, oerr.Status)
+		return
+	}
+	if stop.Kind != stopDropOff {
+		http.Error(w, "Proof of delivery is only taken at drop-off stops", http.StatusBadRequest)
+		return
+	}
+
+	prefix := "proof/" + order.ID.Hex() + "/" + stop.ID.Hex() + "/"
+	proof, err := storeProof(r, prefix, email, recipientName)
+	if oerr, ok := err.(*orderError); ok {
+		http.Error(w, oerr.Message, oerr.Status)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to store proof of delivery", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = client.Database("myapp").Collection("orders").UpdateOne(context.TODO(),
+		bson.M{"_id": order.ID, "stops.id": stop.ID},
+		bson.M{"$set": bson.M{"stops.$.proofOfDelivery": proof}},
+	)
+	if err != nil {
+		http.Error(w, "Failed to save proof of delivery", http.StatusInternalServerError)
+		return
+	}
+
+	proof.setURLs(orderPath(order.ID) + "/stops/" + stop.ID.Hex())
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(proof)
+}
+
+// UpdateStopStatus completes or fails one stop. Drop-offs need proof of
+// delivery and the stop's PIN to complete. When the last stop finishes the
+// whole order is closed.
+func UpdateStopStatus(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Status string `json:"status"`
+		Email  string `json:"email"`
+		Pin    string `json:"pin"`
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	if request.Status != "Arrived" && request.Status != "Completed" && request.Status != "Failed" {
+		http.Error(w, "Invalid status", http.StatusBadRequest)
+		return
+	}
+	if request.Status == "Failed" && !deliveryFailureReasons[request.Reason] {
+		http.Error(w, "A valid failure reason is required", http.StatusBadRequest)
+		return
+	}
+
+	order, stop, err := loadStopForCourier(r, request.Email)
+	if oerr, ok := err.(*orderError); ok {
+		http.Error(w, oerr.Message, oerr.Status)
+		return
+	}
+
+	for _, s := range order.Stops {
+		if s.Sequence < stop.Sequence && !s.finished() && request.Status != "Arrived" {
+			http.Error(w, fmt.Sprintf("Stop %d must be finished first", s.Sequence), http.StatusConflict)
+			return
+		}
+	}
+
+	ctx := context.TODO()
+	if request.Status == "Completed" && stop.Sequence == 1 {
+		if writePinError(w, verifyHandoverPin(ctx, order, "Picked up", request.Pin)) {
+			return
+		}
+	}
+	if request.Status == "Completed" && stop.Kind == stopDropOff {
+		if !stop.ProofOfDelivery.complete() {
+			http.Error(w, "Proof of delivery is required before completing the stop", http.StatusConflict)
+			return
+		}
+		if stop.Handover != nil {
+			err := verifyStagePin(ctx, func(attempts bson.M) bson.M {
+				return bson.M{"_id": order.ID, "stops": bson.M{"$elemMatch": bson.M{"id": stop.ID, "handover.attempts": attempts}}}
+			}, "stops.$.handover", *stop.Handover, request.Pin)
+			if writePinError(w, err) {
+				return
+			}
+		}
+	}
+
+	set := bson.M{"stops.$.status": request.Status}
+	now := time.Now().UTC()
+	if request.Status != "Arrived" {
+		set["stops.$.completedAt"] = now
+	}
+	if request.Status == "Failed" {
+		set["stops.$.failureReason"] = request.Reason
+	}
+
+	// The stop and the order status it implies are written in one
+	// transaction, and the status is worked out from the stops as written,
+	// so the last two stops finishing together still complete the order.
+	var orderStatus string
+	var delivered bool
+	err = withTransaction(ctx, func(sc mongo.SessionContext) error {
+		updated, err := updateOrder(sc, bson.M{"_id": order.ID, "stops.id": stop.ID}, bson.M{"$set": set}, eventOrderStopUpdated)
+		if err != nil {
+			return err
+		}
+
+		orderStatus = updated.Status
+		orderSet := bson.M{}
+		allFinished, anyDelivered, anyFailed := true, false, false
+		for _, s := range updated.Stops {
+			allFinished = allFinished && s.finished()
+			anyDelivered = anyDelivered || (s.Kind == stopDropOff && s.Status == "Completed")
+			anyFailed = anyFailed || s.Status == "Failed"
+		}
+		switch {
+		case allFinished && anyDelivered:
+			orderStatus = "Delivered"
+			if anyFailed {
+				orderStatus = "Partially delivered"
+			}
+			orderSet["deliveredAt"] = now
+		case allFinished:
+			orderStatus = "Delivery failed"
+		case stop.Kind == stopPickup && request.Status == "Completed":
+			orderStatus = "In transit"
+			if stop.Sequence == 1 {
+				orderSet["pickedUpAt"] = now
+			}
+		}
+		delivered = false
+		if orderStatus == updated.Status {
+			order = updated
+			return nil
+		}
+		delivered = orderStatus == "Delivered" || orderStatus == "Partially delivered"
+
+		orderSet["status"] = orderStatus
+		order, err = updateOrder(sc, bson.M{"_id": order.ID}, bson.M{"$set": orderSet}, "")
+		return err
+	})
+	if err != nil {
+		http.Error(w, "Failed to update stop", http.StatusInternalServerError)
+		return
+	}
+	if delivered {
+		onOrderDelivered(ctx, order)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message":     "Stop updated successfully",
+		"stopStatus":  request.Status,
+		"orderStatus": orderStatus,
+	})
+}
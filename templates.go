@@ -0,0 +1,503 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// templateHorizon is how far ahead recurring orders are materialised.
+var templateHorizon = time.Duration(envInt("TEMPLATE_HORIZON_HOURS", 24)) * time.Hour
+
+const dateLayout = "2006-01-02"
+
+var rruleDays = map[string]time.Weekday{
+	"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+	"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday,
+}
+
+// Recurrence is the supported subset of an RFC 5545 RRULE: FREQ=DAILY or
+// FREQ=WEEKLY with INTERVAL, BYDAY and UNTIL.
+type Recurrence struct {
+	Freq     string
+	Interval int
+	ByDay    []time.Weekday
+	Until    time.Time
+}
+
+func parseRRule(rule string) (Recurrence, error) {
+	rec := Recurrence{Interval: 1}
+	rule = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(rule)), "RRULE:")
+
+	for _, part := range strings.Split(rule, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return rec, fmt.Errorf("invalid rule part %q", part)
+		}
+		switch kv[0] {
+		case "FREQ":
+			if kv[1] != "DAILY" && kv[1] != "WEEKLY" {
+				return rec, fmt.Errorf("unsupported FREQ %q", kv[1])
+			}
+			rec.Freq = kv[1]
+		case "INTERVAL":
+			n, err := strconv.Atoi(kv[1])
+			if err != nil || n < 1 {
+				return rec, fmt.Errorf("invalid INTERVAL %q", kv[1])
+			}
+			rec.Interval = n
+		case "BYDAY":
+			for _, d := range strings.Split(kv[1], ",") {
+				wd, ok := rruleDays[d]
+				if !ok {
+					return rec, fmt.Errorf("invalid BYDAY %q", d)
+				}
+				rec.ByDay = append(rec.ByDay, wd)
+			}
+		case "UNTIL":
+			v := kv[1]
+			if len(v) > 8 {
+				v = v[:8]
+			}
+			t, err := time.Parse("20060102", v)
+			if err != nil {
+				return rec, fmt.Errorf("invalid UNTIL %q", kv[1])
+			}
+			rec.Until = t
+		default:
+			return rec, fmt.Errorf("unsupported rule part %q", kv[0])
+		}
+	}
+
+	if rec.Freq == "" {
+		return rec, errors.New("FREQ is required")
+	}
+	return rec, nil
+}
+
+// occursOn reports whether the rule, anchored at start, has an occurrence on
+// day. Both are calendar dates at midnight UTC.
+func (rec Recurrence) occursOn(start, day time.Time) bool {
+	if day.Before(start) || (!rec.Until.IsZero() && day.After(rec.Until)) {
+		return false
+	}
+
+	days := int(day.Sub(start).Hours() / 24)
+	if rec.Freq == "DAILY" {
+		return days%rec.Interval == 0 && (len(rec.ByDay) == 0 || containsWeekday(rec.ByDay, day.Weekday()))
+	}
+
+	byDay := rec.ByDay
+	if len(byDay) == 0 {
+		byDay = []time.Weekday{start.Weekday()}
+	}
+	startWeek := start.AddDate(0, 0, -((int(start.Weekday()) + 6) % 7))
+	weeks := int(day.Sub(startWeek).Hours() / 24 / 7)
+	return weeks%rec.Interval == 0 && containsWeekday(byDay, day.Weekday())
+}
+
+func containsWeekday(days []time.Weekday, d time.Weekday) bool {
+	for _, x := range days {
+		if x == d {
+			return true
+		}
+	}
+	return false
+}
+
+// OrderTemplate produces a concrete order for every occurrence of Rule.
+// Window times are "HH:MM" in Timezone; Order carries the route and parcel.
+type OrderTemplate struct {
+	ID                  primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+	UserID              primitive.ObjectID `json:"userId" bson:"userId"`
+	Name                string             `json:"name" bson:"name"`
+	Order               Order              `json:"order" bson:"order"`
+	Rule                string             `json:"rule" bson:"rule"`
+	StartDate           string             `json:"startDate" bson:"startDate"`
+	Timezone            string             `json:"timezone" bson:"timezone"`
+	PickupWindowStart   string             `json:"pickupWindowStart,omitempty" bson:"pickupWindowStart,omitempty"`
+	PickupWindowEnd     string             `json:"pickupWindowEnd,omitempty" bson:"pickupWindowEnd,omitempty"`
+	DeliveryWindowStart string             `json:"deliveryWindowStart,omitempty" bson:"deliveryWindowStart,omitempty"`
+	DeliveryWindowEnd   string             `json:"deliveryWindowEnd,omitempty" bson:"deliveryWindowEnd,omitempty"`
+	Paused              bool               `json:"paused" bson:"paused"`
+	SkipDates           []string           `json:"skipDates" bson:"skipDates"`
+	MaterializedThrough string             `json:"materializedThrough,omitempty" bson:"materializedThrough,omitempty"`
+	LastError           string             `json:"lastError,omitempty" bson:"lastError,omitempty"`
+	CreatedAt           time.Time          `json:"createdAt" bson:"createdAt"`
+}
+
+func (t OrderTemplate) validate() error {
+	if _, err := parseRRule(t.Rule); err != nil {
+		return err
+	}
+	if _, err := time.Parse(dateLayout, t.StartDate); err != nil {
+		return errors.New("startDate must be YYYY-MM-DD")
+	}
+	if _, err := time.LoadLocation(t.Timezone); err != nil || t.Timezone == "" {
+		return fmt.Errorf("unknown timezone %q", t.Timezone)
+	}
+	if (t.PickupWindowStart == "") != (t.PickupWindowEnd == "") || (t.DeliveryWindowStart == "") != (t.DeliveryWindowEnd == "") {
+		return errors.New("window start and end must be given together")
+	}
+	for _, hm := range []string{t.PickupWindowStart, t.PickupWindowEnd, t.DeliveryWindowStart, t.DeliveryWindowEnd} {
+		if _, err := time.Parse("15:04", hm); hm != "" && err != nil {
+			return fmt.Errorf("invalid time %q, expected HH:MM", hm)
+		}
+	}
+	return nil
+}
+
+func windowOn(day time.Time, loc *time.Location, tz, start, end string) *TimeWindow {
+	if start == "" {
+		return nil
+	}
+	at := func(hm string) time.Time {
+		t, _ := time.Parse("15:04", hm)
+		return time.Date(day.Year(), day.Month(), day.Day(), t.Hour(), t.Minute(), 0, 0, loc)
+	}
+	return &TimeWindow{Earliest: at(start), Latest: at(end), Timezone: tz}
+}
+
+// orderFor builds the order for one occurrence of the template.
+func (t OrderTemplate) orderFor(day time.Time, loc *time.Location) Order {
+	order := t.Order
+	order.Status = "Pending"
+	order.TemplateID = &t.ID
+	order.Occurrence = day.Format(dateLayout)
+	order.PickupWindow = windowOn(day, loc, t.Timezone, t.PickupWindowStart, t.PickupWindowEnd)
+	order.DeliveryWindow = windowOn(day, loc, t.Timezone, t.DeliveryWindowStart, t.DeliveryWindowEnd)
+	return order
+}
+
+// materializeTemplate creates the orders for every occurrence between the
+// last materialised date and now+templateHorizon. Existing orders for an
+// occurrence are never recreated, so a run interrupted half way, or one
+// racing another, is safe.
+func materializeTemplate(ctx context.Context, t OrderTemplate, now time.Time) error {
+	rec, err := parseRRule(t.Rule)
+	if err != nil {
+		return err
+	}
+	loc, err := time.LoadLocation(t.Timezone)
+	if err != nil {
+		return err
+	}
+
+	start, _ := time.Parse(dateLayout, t.StartDate)
+	from := start
+	if t.MaterializedThrough != "" {
+		last, _ := time.Parse(dateLayout, t.MaterializedThrough)
+		from = last.AddDate(0, 0, 1)
+	}
+	today, _ := time.Parse(dateLayout, now.In(loc).Format(dateLayout))
+	if from.Before(today) {
+		from = today
+	}
+	horizon := now.Add(templateHorizon).In(loc)
+	through, _ := time.Parse(dateLayout, horizon.Format(dateLayout))
+
+	orders := client.Database("myapp").Collection("orders")
+	var lastErr string
+	for day := from; !day.After(through); day = day.AddDate(0, 0, 1) {
+		occurrence := day.Format(dateLayout)
+		if !rec.occursOn(start, day) || containsString(t.SkipDates, occurrence) {
+			continue
+		}
+
+		n, err := orders.CountDocuments(ctx, bson.M{"templateId": t.ID, "occurrence": occurrence})
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			continue
+		}
+
+		// The unique (templateId, occurrence) index makes the loser of two
+		// concurrent runs fail its insert, which refunds its charge.
+		_, err = createOrder(ctx, primitive.NewObjectID(), t.orderFor(day, loc), t.UserID)
+		if mongo.IsDuplicateKeyError(err) {
+			continue
+		}
+		if err != nil {
+			if _, ok := err.(*orderError); !ok {
+				return err
+			}
+			lastErr = occurrence + ": " + err.Error()
+			log.Printf("Template %s skipped %s: %v", t.ID.Hex(), occurrence, err)
+		}
+	}
+
+	if from.After(through) {
+		return nil
+	}
+	_, err = client.Database("myapp").Collection("order_templates").UpdateOne(ctx,
+		bson.M{"_id": t.ID},
+		bson.M{"$set": bson.M{"materializedThrough": through.Format(dateLayout), "lastError": lastErr}},
+	)
+	return err
+}
+
+func materializeTemplates(ctx context.Context, now time.Time) error {
+	cursor, err := client.Database("myapp").Collection("order_templates").Find(ctx, bson.M{"paused": false})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	var templates []OrderTemplate
+	if err := cursor.All(ctx, &templates); err != nil {
+		return err
+	}
+
+	for _, t := range templates {
+		if err := materializeTemplate(ctx, t, now); err != nil {
+			log.Printf("Failed to materialize template %s: %v", t.ID.Hex(), err)
+		}
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+func CreateOrderTemplate(w http.ResponseWriter, r *http.Request) {
+	userID, err := primitive.ObjectIDFromHex(r.Header.Get("userId"))
+	if err != nil {
+		http.Error(w, "Invalid UserID format", http.StatusBadRequest)
+		return
+	}
+
+	var t OrderTemplate
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if err := t.validate(); err != nil {
+		http.Error(w, "Invalid template: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	t.ID = primitive.NewObjectID()
+	t.UserID = userID
+	t.Paused = false
+	t.SkipDates = []string{}
+	t.MaterializedThrough = ""
+	t.LastError = ""
+	t.CreatedAt = time.Now().UTC()
+
+	_, err = client.Database("myapp").Collection("order_templates").InsertOne(context.TODO(), t)
+	if err != nil {
+		http.Error(w, "Failed to create template", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(t)
+}
+
+func GetOrderTemplates(w http.ResponseWriter, r *http.Request) {
+	userID, err := primitive.ObjectIDFromHex(r.Header.Get("userId"))
+	if err != nil {
+		http.Error(w, "Invalid UserID format", http.StatusBadRequest)
+		return
+	}
+
+	cursor, err := client.Database("myapp").Collection("order_templates").Find(context.TODO(), bson.M{"userId": userID})
+	if err != nil {
+		http.Error(w, "Failed to retrieve templates", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.TODO())
+
+	templates := []OrderTemplate{}
+	if err := cursor.All(context.TODO(), &templates); err != nil {
+		http.Error(w, "Failed to decode templates", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(templates)
+}
+
+// templateFilter matches the template in the URL only if it belongs to the
+// calling user.
+func templateFilter(r *http.Request) (bson.M, error) {
+	templateID, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		return nil, err
+	}
+	userID, err := primitive.ObjectIDFromHex(r.Header.Get("userId"))
+	if err != nil {
+		return nil, err
+	}
+	return bson.M{"_id": templateID, "userId": userID}, nil
+}
+
+func updateOrderTemplate(w http.ResponseWriter, r *http.Request, update bson.M, message string) {
+	filter, err := templateFilter(r)
+	if err != nil {
+		http.Error(w, "Invalid TemplateID or UserID format", http.StatusBadRequest)
+		return
+	}
+
+	result, err := client.Database("myapp").Collection("order_templates").UpdateOne(context.TODO(), filter, update)
+	if err != nil {
+		http.Error(w, "Failed to update template", http.StatusInternalServerError)
+		return
+	}
+	if result.MatchedCount == 0 {
+		http.Error(w, "Template not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(message)
+}
+
+// UpdateOrderTemplate changes the template for occurrences that have not
+// been materialised yet; orders already created are left as they are.
+func UpdateOrderTemplate(w http.ResponseWriter, r *http.Request) {
+	var t OrderTemplate
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if err := t.validate(); err != nil {
+		http.Error(w, "Invalid template: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	updateOrderTemplate(w, r, bson.M{"$set": bson.M{
+		"name":                t.Name,
+		"order":               t.Order,
+		"rule":                t.Rule,
+		"startDate":           t.StartDate,
+		"timezone":            t.Timezone,
+		"pickupWindowStart":   t.PickupWindowStart,
+		"pickupWindowEnd":     t.PickupWindowEnd,
+		"deliveryWindowStart": t.DeliveryWindowStart,
+		"deliveryWindowEnd":   t.DeliveryWindowEnd,
+	}}, "Template updated for future occurrences")
+}
+
+func PauseOrderTemplate(w http.ResponseWriter, r *http.Request) {
+	updateOrderTemplate(w, r, bson.M{"$set": bson.M{"paused": true}}, "Template paused")
+}
+
+// ResumeOrderTemplate does not backfill occurrences missed while paused:
+// it marks the template materialised through yesterday in its timezone.
+func ResumeOrderTemplate(w http.ResponseWriter, r *http.Request) {
+	filter, err := templateFilter(r)
+	if err != nil {
+		http.Error(w, "Invalid TemplateID or UserID format", http.StatusBadRequest)
+		return
+	}
+
+	var t OrderTemplate
+	if err := client.Database("myapp").Collection("order_templates").FindOne(context.TODO(), filter).Decode(&t); err != nil {
+		http.Error(w, "Template not found", http.StatusNotFound)
+		return
+	}
+	loc, err := time.LoadLocation(t.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+
+	yesterday := time.Now().In(loc).AddDate(0, 0, -1).Format(dateLayout)
+	updateOrderTemplate(w, r, bson.M{"$set": bson.M{"paused": false, "materializedThrough": yesterday}}, "Template resumed")
+}
+
+// SkipOrderTemplateOccurrence also cancels the occurrence's order if it was
+// already materialised and has not been dispatched.
+func SkipOrderTemplateOccurrence(w http.ResponseWriter, r *http.Request) {
+	filter, err := templateFilter(r)
+	if err != nil {
+		http.Error(w, "Invalid TemplateID or UserID format", http.StatusBadRequest)
+		return
+	}
+
+	var request struct {
+		Date string `json:"date"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if _, err := time.Parse(dateLayout, request.Date); err != nil {
+		http.Error(w, "Date must be YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.TODO()
+	result, err := client.Database("myapp").Collection("order_templates").UpdateOne(ctx, filter, bson.M{"$addToSet": bson.M{"skipDates": request.Date}})
+	if err != nil {
+		http.Error(w, "Failed to update template", http.StatusInternalServerError)
+		return
+	}
+	if result.MatchedCount == 0 {
+		http.Error(w, "Template not found", http.StatusNotFound)
+		return
+	}
+
+	orders := client.Database("myapp").Collection("orders")
+	var order Order
+	err = orders.FindOne(ctx, bson.M{
+		"templateId": filter["_id"],
+		"occurrence": request.Date,
+		"status":     bson.M{"$in": bson.A{"Pending", "Scheduled"}},
+	}).Decode(&order)
+	if err == nil {
+		err := deleteOrder(ctx, order, "Canceled", eventOrderCancelled)
+		if err != nil && err != mongo.ErrNoDocuments {
+			http.Error(w, "Failed to cancel the occurrence's order", http.StatusInternalServerError)
+			return
+		}
+		if err == nil {
+			if err := refundOrQueue(ctx, order, "Recurring occurrence skipped"); err != nil {
+				http.Error(w, "Occurrence skipped, but the refund failed; contact support", http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode("Occurrence skipped")
+}
+
+func DeleteOrderTemplate(w http.ResponseWriter, r *http.Request) {
+	filter, err := templateFilter(r)
+	if err != nil {
+		http.Error(w, "Invalid TemplateID or UserID format", http.StatusBadRequest)
+		return
+	}
+
+	result, err := client.Database("myapp").Collection("order_templates").DeleteOne(context.TODO(), filter)
+	if err != nil {
+		http.Error(w, "Failed to delete template", http.StatusInternalServerError)
+		return
+	}
+	if result.DeletedCount == 0 {
+		http.Error(w, "Template not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode("Template deleted successfully")
+}
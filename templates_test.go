@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOccursOn(t *testing.T) {
+	// 2026-01-05 is a Monday.
+	start := time.Date(2026, 1, 5, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		rule string
+		day  string
+		want bool
+	}{
+		{"FREQ=DAILY", "2026-01-05", true},
+		{"FREQ=DAILY", "2026-01-04", false},
+		{"FREQ=DAILY", "2026-01-06", true},
+		{"FREQ=DAILY;INTERVAL=2", "2026-01-06", false},
+		{"FREQ=DAILY;INTERVAL=2", "2026-01-07", true},
+		{"FREQ=DAILY;BYDAY=SA,SU", "2026-01-09", false},
+		{"FREQ=DAILY;BYDAY=SA,SU", "2026-01-10", true},
+		{"FREQ=DAILY;UNTIL=20260110", "2026-01-10", true},
+		{"FREQ=DAILY;UNTIL=20260110T235959Z", "2026-01-11", false},
+		{"FREQ=WEEKLY", "2026-01-12", true},
+		{"FREQ=WEEKLY", "2026-01-13", false},
+		{"RRULE:FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,TH", "2026-01-08", true},
+		{"RRULE:FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,TH", "2026-01-15", false},
+		{"RRULE:FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,TH", "2026-01-19", true},
+		{"RRULE:FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,TH", "2026-01-22", true},
+		// Weeks start on Monday, so the Sunday after start is in its first week.
+		{"FREQ=WEEKLY;INTERVAL=2;BYDAY=SU", "2026-01-11", true},
+		{"FREQ=WEEKLY;INTERVAL=2;BYDAY=SU", "2026-01-18", false},
+		{"FREQ=WEEKLY;INTERVAL=2;BYDAY=SU", "2026-01-25", true},
+	}
+	for _, tt := range tests {
+		rec, err := parseRRule(tt.rule)
+		if err != nil {
+			t.Fatalf("parseRRule(%q): %v", tt.rule, err)
+		}
+		day, _ := time.Parse(dateLayout, tt.day)
+		if got := rec.occursOn(start, day); got != tt.want {
+			t.Errorf("%s on %s = %v, want %v", tt.rule, tt.day, got, tt.want)
+		}
+	}
+}
+
+func TestParseRRuleRejects(t *testing.T) {
+	for _, rule := range []string{
+		"",
+		"FREQ=MONTHLY",
+		"FREQ=DAILY;INTERVAL=0",
+		"FREQ=WEEKLY;BYDAY=XX",
+		"FREQ=DAILY;UNTIL=tomorrow",
+		"FREQ=DAILY;COUNT=3",
+		"INTERVAL=2",
+	} {
+		if _, err := parseRRule(rule); err == nil {
+			t.Errorf("parseRRule(%q) succeeded, want an error", rule)
+		}
+	}
+}
@@ -0,0 +1,838 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	ticketOpen              = "open"
+	ticketInProgress        = "in_progress"
+	ticketWaitingOnCustomer = "waiting_on_customer"
+	ticketResolved          = "resolved"
+	ticketClosed            = "closed"
+
+	outcomeRefund     = "refund"
+	outcomeRedelivery = "redelivery"
+	outcomeNoAction   = "no_action"
+
+	eventOrderDisputeResolved = "order.dispute_resolved"
+
+	maxTicketAttachments     = 5
+	maxTicketAttachmentBytes = 10 << 20
+)
+
+var errTicketResolved = errors.New("ticket is already resolved")
+
+var ticketCategories = []string{"damaged", "missing", "late", "wrong_item", "courier_conduct", "billing", "other"}
+
+// ticketStatuses are the statuses an agent can set directly. A ticket only
+// becomes resolved through ResolveTicket.
+var ticketStatuses = []string{ticketOpen, ticketInProgress, ticketWaitingOnCustomer, ticketClosed}
+
+type TicketAttachment struct {
+	ID          primitive.ObjectID `json:"id" bson:"id"`
+	Name        string             `json:"name" bson:"name"`
+	Key         string             `json:"-" bson:"key"`
+	ContentType string             `json:"contentType" bson:"contentType"`
+	Size        int                `json:"size" bson:"size"`
+	URL         string             `json:"url,omitempty" bson:"-"`
+}
+
+// TicketComment is visible to the customer unless Internal is set.
+type TicketComment struct {
+	ID         primitive.ObjectID `json:"id" bson:"id"`
+	AuthorRole string             `json:"authorRole" bson:"authorRole"`
+	AuthorID   primitive.ObjectID `json:"authorId" bson:"authorId"`
+	Body       string             `json:"body" bson:"body"`
+	Internal   bool               `json:"internal,omitempty" bson:"internal,omitempty"`
+	CreatedAt  time.Time          `json:"createdAt" bson:"createdAt"`
+}
+
+// DisputeResolution is the outcome of a ticket. It is stored on the ticket
+// and appended to the order's disputes.
+type DisputeResolution struct {
+	TicketID            primitive.ObjectID  `json:"ticketId" bson:"ticketId"`
+	Outcome             string              `json:"outcome" bson:"outcome"`
+	RefundAmount        int64               `json:"refundAmount,omitempty" bson:"refundAmount,omitempty"`
+	RefundTransactionID *primitive.ObjectID `json:"refundTransactionId,omitempty" bson:"refundTransactionId,omitempty"`
+	RedeliveryOrderID   *primitive.ObjectID `json:"redeliveryOrderId,omitempty" bson:"redeliveryOrderId,omitempty"`
+	Note                string              `json:"note,omitempty" bson:"note,omitempty"`
+	ResolvedBy          primitive.ObjectID  `json:"resolvedBy" bson:"resolvedBy"`
+	ResolvedAt          time.Time           `json:"resolvedAt" bson:"resolvedAt"`
+}
+
+type Ticket struct {
+	ID          primitive.ObjectID  `json:"id" bson:"_id"`
+	OrderID     primitive.ObjectID  `json:"orderId" bson:"orderId"`
+	UserID      primitive.ObjectID  `json:"userId" bson:"userId"`
+	Category    string              `json:"category" bson:"category"`
+	Subject     string              `json:"subject" bson:"subject"`
+	Description string              `json:"description" bson:"description"`
+	Attachments []TicketAttachment  `json:"attachments" bson:"attachments"`
+	Status      string              `json:"status" bson:"status"`
+	AssigneeID  *primitive.ObjectID `json:"assigneeId,omitempty" bson:"assigneeId,omitempty"`
+	Comments    []TicketComment     `json:"comments" bson:"comments"`
+	Resolution  *DisputeResolution  `json:"resolution,omitempty" bson:"resolution,omitempty"`
+	CreatedAt   time.Time           `json:"createdAt" bson:"createdAt"`
+	UpdatedAt   time.Time           `json:"updatedAt" bson:"updatedAt"`
+}
+
+// forCustomer drops internal comments and points the attachment URLs at
+// the customer endpoints.
+func (t *Ticket) forCustomer() {
+	comments := []TicketComment{}
+	for _, c := range t.Comments {
+		if !c.Internal {
+			comments = append(comments, c)
+		}
+	}
+	t.Comments = comments
+	t.setAttachmentURLs("/api/tickets/" + t.ID.Hex())
+}
+
+func (t *Ticket) setAttachmentURLs(base string) {
+	for i := range t.Attachments {
+		t.Attachments[i].URL = base + "/attachments/" + t.Attachments[i].ID.Hex()
+	}
+}
+
+// readTicketAttachment returns the file's data and content type. Images and
+// PDFs are accepted.
+func readTicketAttachment(fh *multipart.FileHeader) ([]byte, string, error) {
+	file, err := fh.Open()
+	if err != nil {
+		return nil, "", err
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxTicketAttachmentBytes+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(data) > maxTicketAttachmentBytes {
+		return nil, "", &orderError{http.StatusRequestEntityTooLarge, "Attachment " + fh.Filename + " is too large"}
+	}
+
+	contentType := http.DetectContentType(data)
+	switch contentType {
+	case "image/jpeg", "image/png", "application/pdf":
+		return data, contentType, nil
+	}
+	return nil, "", &orderError{http.StatusBadRequest, "Attachment " + fh.Filename + " must be a JPEG, PNG or PDF"}
+}
+
+// storeTicketAttachments saves the files of the form's attachment field
+// under the ticket's prefix in the blob store.
+func storeTicketAttachments(ctx context.Context, ticketID primitive.ObjectID, files []*multipart.FileHeader) ([]TicketAttachment, error) {
+	if len(files) > maxTicketAttachments {
+		return nil, &orderError{http.StatusBadRequest, "Too many attachments"}
+	}
+
+	attachments := []TicketAttachment{}
+	for _, fh := range files {
+		data, contentType, err := readTicketAttachment(fh)
+		if err != nil {
+			return nil, err
+		}
+		a := TicketAttachment{
+			ID:          primitive.NewObjectID(),
+			Name:        filepath.Base(fh.Filename),
+			ContentType: contentType,
+			Size:        len(data),
+		}
+		a.Key = "tickets/" + ticketID.Hex() + "/" + a.ID.Hex() + filepath.Ext(a.Name)
+		if err := blobs.Put(ctx, a.Key, bytes.NewReader(data), int64(len(data)), contentType); err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, a)
+	}
+	return attachments, nil
+}
+
+// CreateTicket opens a ticket for one of the caller's orders. It takes a
+// multipart form with orderId, category, subject, description and up to
+// maxTicketAttachments files in the attachment field.
+func CreateTicket(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	accountID, _, err := requestAccount(ctx, r, scopeOrdersRead)
+	if err != nil {
+		writeAccountError(w, err)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxTicketAttachments*maxTicketAttachmentBytes+1<<20)
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+
+	orderID, err := primitive.ObjectIDFromHex(r.FormValue("orderId"))
+	if err != nil {
+		http.Error(w, "Invalid OrderID format", http.StatusBadRequest)
+		return
+	}
+	category := r.FormValue("category")
+	if !containsString(ticketCategories, category) {
+		http.Error(w, "Category must be one of: "+strings.Join(ticketCategories, ", "), http.StatusBadRequest)
+		return
+	}
+	subject := strings.TrimSpace(r.FormValue("subject"))
+	description := strings.TrimSpace(r.FormValue("description"))
+	if subject == "" || description == "" {
+		http.Error(w, "Subject and description are required", http.StatusBadRequest)
+		return
+	}
+
+	var order Order
+	err = client.Database("myapp").Collection("orders").FindOne(ctx, bson.M{"_id": orderID, "userId": accountID}).Decode(&order)
+	if err != nil {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+
+	now := time.Now().UTC()
+	ticket := Ticket{
+		ID:          primitive.NewObjectID(),
+		OrderID:     order.ID,
+		UserID:      accountID,
+		Category:    category,
+		Subject:     subject,
+		Description: description,
+		Status:      ticketOpen,
+		Comments:    []TicketComment{},
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+
+	var files []*multipart.FileHeader
+	if r.MultipartForm != nil {
+		files = r.MultipartForm.File["attachment"]
+	}
+	ticket.Attachments, err = storeTicketAttachments(ctx, ticket.ID, files)
+	if err != nil {
+		writeAccountError(w, err)
+		return
+	}
+
+	if _, err := client.Database("myapp").Collection("tickets").InsertOne(ctx, ticket); err != nil {
+		http.Error(w, "Failed to create ticket", http.StatusInternalServerError)
+		return
+	}
+
+	ticket.forCustomer()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(ticket)
+}
+
+// ticketFilter builds the list filter from the status, category, orderId
+// and assigneeId query parameters.
+func ticketFilter(r *http.Request) (bson.M, error) {
+	q := r.URL.Query()
+	filter := bson.M{}
+	if s := q.Get("status"); s != "" {
+		filter["status"] = s
+	}
+	if s := q.Get("category"); s != "" {
+		filter["category"] = s
+	}
+	for param, field := range map[string]string{"orderId": "orderId", "assigneeId": "assigneeId"} {
+		if s := q.Get(param); s != "" {
+			id, err := primitive.ObjectIDFromHex(s)
+			if err != nil {
+				return nil, &orderError{http.StatusBadRequest, "Invalid " + param}
+			}
+			filter[field] = id
+		}
+	}
+	return filter, nil
+}
+
+func findTickets(ctx context.Context, filter bson.M) ([]Ticket, error) {
+	cursor, err := client.Database("myapp").Collection("tickets").Find(ctx, filter,
+		options.Find().SetSort(bson.M{"updatedAt": -1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	tickets := []Ticket{}
+	err = cursor.All(ctx, &tickets)
+	return tickets, err
+}
+
+func GetTickets(w http.ResponseWriter, r *http.Request) {
+	accountID, _, err := requestAccount(r.Context(), r, scopeOrdersRead)
+	if err != nil {
+		writeAccountError(w, err)
+		return
+	}
+	filter, err := ticketFilter(r)
+	if err != nil {
+		writeAccountError(w, err)
+		return
+	}
+	filter["userId"] = accountID
+
+	tickets, err := findTickets(r.Context(), filter)
+	if err != nil {
+		http.Error(w, "Failed to fetch tickets", http.StatusInternalServerError)
+		return
+	}
+	for i := range tickets {
+		tickets[i].forCustomer()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tickets)
+}
+
+// GetAllTickets is the agents' triage queue.
+func GetAllTickets(w http.ResponseWriter, r *http.Request) {
+	filter, err := ticketFilter(r)
+	if err != nil {
+		writeAccountError(w, err)
+		return
+	}
+	if r.URL.Query().Get("unassigned") == "true" {
+		filter["assigneeId"] = bson.M{"$exists": false}
+	}
+
+	tickets, err := findTickets(r.Context(), filter)
+	if err != nil {
+		http.Error(w, "Failed to fetch tickets", http.StatusInternalServerError)
+		return
+	}
+	for i := range tickets {
+		tickets[i].setAttachmentURLs("/api/admin/tickets/" + tickets[i].ID.Hex())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tickets)
+}
+
+// customerTicket loads the ticket in the path if it belongs to the caller.
+func customerTicket(r *http.Request) (Ticket, error) {
+	var ticket Ticket
+	accountID, _, err := requestAccount(r.Context(), r, scopeOrdersRead)
+	if err != nil {
+		return ticket, err
+	}
+	ticketID, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		return ticket, &orderError{http.StatusBadRequest, "Invalid TicketID format"}
+	}
+	err = client.Database("myapp").Collection("tickets").FindOne(r.Context(), bson.M{"_id": ticketID, "userId": accountID}).Decode(&ticket)
+	if err != nil {
+		return ticket, &orderError{http.StatusNotFound, "Ticket not found"}
+	}
+	return ticket, nil
+}
+
+func adminTicket(r *http.Request) (Ticket, error) {
+	var ticket Ticket
+	ticketID, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		return ticket, &orderError{http.StatusBadRequest, "Invalid TicketID format"}
+	}
+	err = client.Database("myapp").Collection("tickets").FindOne(r.Context(), bson.M{"_id": ticketID}).Decode(&ticket)
+	if err != nil {
+		return ticket, &orderError{http.StatusNotFound, "Ticket not found"}
+	}
+	return ticket, nil
+}
+
+func GetTicket(w http.ResponseWriter, r *http.Request) {
+	ticket, err := customerTicket(r)
+	if err != nil {
+		writeAccountError(w, err)
+		return
+	}
+	ticket.forCustomer()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ticket)
+}
+
+func GetTicketAdmin(w http.ResponseWriter, r *http.Request) {
+	ticket, err := adminTicket(r)
+	if err != nil {
+		writeAccountError(w, err)
+		return
+	}
+	ticket.setAttachmentURLs("/api/admin/tickets/" + ticket.ID.Hex())
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ticket)
+}
+
+func GetTicketAttachment(w http.ResponseWriter, r *http.Request) {
+	ticket, err := customerTicket(r)
+	if err != nil {
+		writeAccountError(w, err)
+		return
+	}
+	writeTicketAttachment(w, r, ticket)
+}
+
+func GetTicketAttachmentAdmin(w http.ResponseWriter, r *http.Request) {
+	ticket, err := adminTicket(r)
+	if err != nil {
+		writeAccountError(w, err)
+		return
+	}
+	writeTicketAttachment(w, r, ticket)
+}
+
+func writeTicketAttachment(w http.ResponseWriter, r *http.Request, ticket Ticket) {
+	var attachment *TicketAttachment
+	for i := range ticket.Attachments {
+		if ticket.Attachments[i].ID.Hex() == mux.Vars(r)["attachmentId"] {
+			attachment = &ticket.Attachments[i]
+		}
+	}
+	if attachment == nil {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return
+	}
+
+	body, contentType, err := blobs.Get(r.Context(), attachment.Key)
+	if err == errBlobNotFound {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to read attachment", http.StatusInternalServerError)
+		return
+	}
+	defer body.Close()
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+strings.ReplaceAll(attachment.Name, `"`, "")+`"`)
+	io.Copy(w, body)
+}
+
+// AddTicketComment adds a customer reply. A reply to a ticket waiting on
+// the customer puts it back in the agents' queue.
+func AddTicketComment(w http.ResponseWriter, r *http.Request) {
+	ticket, err := customerTicket(r)
+	if err != nil {
+		writeAccountError(w, err)
+		return
+	}
+
+	var request struct {
+		Body string `json:"body"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || strings.TrimSpace(request.Body) == "" {
+		http.Error(w, "Comment body is required", http.StatusBadRequest)
+		return
+	}
+	if ticket.Status == ticketClosed {
+		http.Error(w, "Ticket is closed", http.StatusConflict)
+		return
+	}
+
+	now := time.Now().UTC()
+	set := bson.M{"updatedAt": now}
+	if ticket.Status == ticketWaitingOnCustomer {
+		set["status"] = ticketOpen
+	}
+	ticket, err = updateTicket(r.Context(), ticket.ID, bson.M{
+		"$push": bson.M{"comments": TicketComment{
+			ID:         primitive.NewObjectID(),
+			AuthorRole: "customer",
+			AuthorID:   ticket.UserID,
+			Body:       strings.TrimSpace(request.Body),
+			CreatedAt:  now,
+		}},
+		"$set": set,
+	})
+	if err != nil {
+		http.Error(w, "Failed to add comment", http.StatusInternalServerError)
+		return
+	}
+	ticket.forCustomer()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ticket)
+}
+
+func updateTicket(ctx context.Context, ticketID primitive.ObjectID, update bson.M) (Ticket, error) {
+	var ticket Ticket
+	err := client.Database("myapp").Collection("tickets").FindOneAndUpdate(ctx,
+		bson.M{"_id": ticketID}, update,
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&ticket)
+	return ticket, err
+}
+
+// findAdmin checks that id names an admin account. Support agents are
+// admins.
+func findAdmin(ctx context.Context, id string) (primitive.ObjectID, error) {
+	adminID, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return adminID, &orderError{http.StatusBadRequest, "Invalid AdminID format"}
+	}
+	var admin Admin
+	err = client.Database("myapp").Collection("users").FindOne(ctx, bson.M{"_id": adminID, "role": "admin"}).Decode(&admin)
+	if err == mongo.ErrNoDocuments {
+		return adminID, &orderError{http.StatusNotFound, "Admin not found"}
+	}
+	return adminID, err
+}
+
+// AssignTicket gives the ticket to an agent, or takes it off them when
+// assigneeId is empty.
+func AssignTicket(w http.ResponseWriter, r *http.Request) {
+	ticket, err := adminTicket(r)
+	if err != nil {
+		writeAccountError(w, err)
+		return
+	}
+
+	var request struct {
+		AdminID    string `json:"adminId"`
+		AssigneeID string `json:"assigneeId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if _, err := findAdmin(r.Context(), request.AdminID); err != nil {
+		writeAccountError(w, err)
+		return
+	}
+
+	update := bson.M{"$set": bson.M{"updatedAt": time.Now().UTC()}}
+	if request.AssigneeID == "" {
+		update["$unset"] = bson.M{"assigneeId": ""}
+	} else {
+		assigneeID, err := findAdmin(r.Context(), request.AssigneeID)
+		if err != nil {
+			writeAccountError(w, err)
+			return
+		}
+		update["$set"].(bson.M)["assigneeId"] = assigneeID
+		if ticket.Status == ticketOpen {
+			update["$set"].(bson.M)["status"] = ticketInProgress
+		}
+	}
+
+	ticket, err = updateTicket(r.Context(), ticket.ID, update)
+	if err != nil {
+		http.Error(w, "Failed to assign ticket", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ticket)
+}
+
+// AddTicketCommentAdmin adds an agent comment. Internal comments are never
+// shown to the customer.
+func AddTicketCommentAdmin(w http.ResponseWriter, r *http.Request) {
+	ticket, err := adminTicket(r)
+	if err != nil {
+		writeAccountError(w, err)
+		return
+	}
+
+	var request struct {
+		AdminID  string `json:"adminId"`
+		Body     string `json:"body"`
+		Internal bool   `json:"internal"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || strings.TrimSpace(request.Body) == "" {
+		http.Error(w, "Comment body is required", http.StatusBadRequest)
+		return
+	}
+	adminID, err := findAdmin(r.Context(), request.AdminID)
+	if err != nil {
+		writeAccountError(w, err)
+		return
+	}
+
+	ticket, err = updateTicket(r.Context(), ticket.ID, bson.M{
+		"$push": bson.M{"comments": TicketComment{
+			ID:         primitive.NewObjectID(),
+			AuthorRole: "agent",
+			AuthorID:   adminID,
+			Body:       strings.TrimSpace(request.Body),
+			Internal:   request.Internal,
+			CreatedAt:  time.Now().UTC(),
+		}},
+		"$set": bson.M{"updatedAt": time.Now().UTC()},
+	})
+	if err != nil {
+		http.Error(w, "Failed to add comment", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ticket)
+}
+
+// UpdateTicketStatus moves a ticket between the triage statuses. Only a
+// resolved ticket can be closed.
+func UpdateTicketStatus(w http.ResponseWriter, r *http.Request) {
+	ticket, err := adminTicket(r)
+	if err != nil {
+		writeAccountError(w, err)
+		return
+	}
+
+	var request struct {
+		AdminID string `json:"adminId"`
+		Status  string `json:"status"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if _, err := findAdmin(r.Context(), request.AdminID); err != nil {
+		writeAccountError(w, err)
+		return
+	}
+	if !containsString(ticketStatuses, request.Status) {
+		http.Error(w, "Status must be one of: "+strings.Join(ticketStatuses, ", "), http.StatusBadRequest)
+		return
+	}
+	if request.Status == ticketClosed && ticket.Status != ticketResolved {
+		http.Error(w, "Only a resolved ticket can be closed", http.StatusConflict)
+		return
+	}
+	if ticket.Status == ticketResolved && request.Status != ticketClosed || ticket.Status == ticketClosed {
+		http.Error(w, "Ticket is already "+ticket.Status, http.StatusConflict)
+		return
+	}
+
+	ticket, err = updateTicket(r.Context(), ticket.ID, bson.M{"$set": bson.M{
+		"status":    request.Status,
+		"updatedAt": time.Now().UTC(),
+	}})
+	if err != nil {
+		http.Error(w, "Failed to update ticket", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ticket)
+}
+
+// createRedeliveryOrder sends the original parcel again at no charge. It
+// goes to dispatch like any new order.
+func createRedeliveryOrder(ctx context.Context, original Order) (Order, error) {
+	order := Order{
+		PickupLocation:     original.PickupLocation,
+		DropOffLocation:    original.DropOffLocation,
+		PickupCoordinates:  original.PickupCoordinates,
+		DropOffCoordinates: original.DropOffCoordinates,
+		PackageDetails:     original.PackageDetails,
+		Stops:              append([]Stop(nil), original.Stops...),
+	}
+	for i := range order.Stops {
+		order.Stops[i].Handover = nil
+	}
+
+	order, err := prepareOrder(ctx, order, original.UserID)
+	if err != nil {
+		return order, err
+	}
+	order.Price = 0
+	order.Tip = 0
+	order.PaymentMethod = ""
+	order.MerchantID = original.MerchantID
+	order.RedeliveryOf = &original.ID
+
+	return order, insertOrder(ctx, order)
+}
+
+// ResolveTicket closes the dispute with an outcome. A refund is credited
+// to the customer's wallet and a redelivery opens a new order; either way
+// the resolution is added to the order's history.
+func ResolveTicket(w http.ResponseWriter, r *http.Request) {
+	ticket, err := adminTicket(r)
+	if err != nil {
+		writeAccountError(w, err)
+		return
+	}
+
+	var request struct {
+		AdminID string `json:"adminId"`
+		Outcome string `json:"outcome"`
+		Amount  int64  `json:"amount"`
+		Note    string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	ctx := r.Context()
+	adminID, err := findAdmin(ctx, request.AdminID)
+	if err != nil {
+		writeAccountError(w, err)
+		return
+	}
+	switch request.Outcome {
+	case outcomeRefund:
+		if request.Amount <= 0 {
+			http.Error(w, "A refund needs a positive amount", http.StatusBadRequest)
+			return
+		}
+	case outcomeRedelivery, outcomeNoAction:
+	default:
+		http.Error(w, "Outcome must be refund, redelivery or no_action", http.StatusBadRequest)
+		return
+	}
+
+	var order Order
+	if err := client.Database("myapp").Collection("orders").FindOne(ctx, bson.M{"_id": ticket.OrderID}).Decode(&order); err != nil {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+
+	// The ticket is marked resolved in the same transaction as the refund
+	// or redelivery, so a failed payout leaves it open and two agents
+	// cannot both pay out. The order's ledger lock keeps the refund check
+	// and posting together, as for any other refund.
+	resolution := DisputeResolution{
+		TicketID:   ticket.ID,
+		Outcome:    request.Outcome,
+		Note:       request.Note,
+		ResolvedBy: adminID,
+		ResolvedAt: time.Now().UTC(),
+	}
+	err = withLedgerLock(ctx, orderLedgerLock(order.ID), func() error {
+		return withTransaction(ctx, func(sc mongo.SessionContext) error {
+			resolution.RefundAmount = 0
+			resolution.RefundTransactionID = nil
+			resolution.RedeliveryOrderID = nil
+
+			switch request.Outcome {
+			case outcomeRefund:
+				tx, err := creditRefund(sc, order, request.Amount, "Dispute refund: "+ticket.Subject, adminID.Hex())
+				if err != nil {
+					return err
+				}
+				resolution.RefundAmount = request.Amount
+				resolution.RefundTransactionID = &tx.ID
+			case outcomeRedelivery:
+				redelivery, err := createRedeliveryOrder(sc, order)
+				if err != nil {
+					return err
+				}
+				resolution.RedeliveryOrderID = &redelivery.ID
+			}
+
+			err := client.Database("myapp").Collection("tickets").FindOneAndUpdate(sc,
+				bson.M{"_id": ticket.ID, "status": bson.M{"$nin": []string{ticketResolved, ticketClosed}}},
+				bson.M{"$set": bson.M{"status": ticketResolved, "resolution": resolution, "updatedAt": resolution.ResolvedAt}},
+			).Err()
+			if err == mongo.ErrNoDocuments {
+				return errTicketResolved
+			}
+			return err
+		})
+	})
+	switch {
+	case err == nil:
+	case err == errTicketResolved:
+		http.Error(w, "Ticket is already resolved", http.StatusConflict)
+		return
+	case err == errRefundExceedsTotal:
+		http.Error(w, "Refund exceeds what is left of the order total", http.StatusBadRequest)
+		return
+	case err == errLedgerBusy:
+		http.Error(w, "The order is busy, try again", http.StatusConflict)
+		return
+	default:
+		if _, ok := err.(*orderError); ok {
+			writeAccountError(w, err)
+			return
+		}
+		log.Println("Failed to resolve ticket", ticket.ID.Hex(), err)
+		http.Error(w, "Failed to resolve ticket", http.StatusInternalServerError)
+		return
+	}
+
+	// The payout is made, so a failure from here on is reported rather
+	// than rolled back.
+	historyErr := addDisputeToOrder(ctx, order.ID, resolution)
+	if historyErr != nil {
+		log.Println("Failed to add dispute to order history:", historyErr)
+	}
+
+	ticket, err = updateTicket(ctx, ticket.ID, bson.M{
+		"$set": bson.M{"resolution": resolution},
+		"$push": bson.M{"comments": TicketComment{
+			ID:         primitive.NewObjectID(),
+			AuthorRole: "agent",
+			AuthorID:   adminID,
+			Body:       resolutionMessage(resolution),
+			CreatedAt:  resolution.ResolvedAt,
+		}},
+	})
+	if err != nil {
+		http.Error(w, "Failed to resolve ticket", http.StatusInternalServerError)
+		return
+	}
+	if historyErr != nil {
+		http.Error(w, "Ticket resolved but the order history could not be updated", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ticket)
+}
+
+// addDisputeToOrder appends the resolution to the order's disputes, trying
+// a few times. It is keyed on the ticket, so it never adds one twice.
+func addDisputeToOrder(ctx context.Context, orderID primitive.ObjectID, resolution DisputeResolution) error {
+	var err error
+	for attempt := 1; attempt <= 3; attempt++ {
+		_, err = updateOrder(ctx,
+			bson.M{"_id": orderID, "disputes.ticketId": bson.M{"$ne": resolution.TicketID}},
+			bson.M{"$push": bson.M{"disputes": resolution}},
+			eventOrderDisputeResolved,
+		)
+		if err == nil || err == mongo.ErrNoDocuments {
+			return nil
+		}
+		time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+	}
+	return err
+}
+
+// resolutionMessage is the customer-visible comment added on resolution.
+func resolutionMessage(res DisputeResolution) string {
+	var msg string
+	switch res.Outcome {
+	case outcomeRefund:
+		msg = "We have refunded " + formatCents(res.RefundAmount) + " to your wallet."
+	case outcomeRedelivery:
+		msg = "We are sending your parcel again at no charge (order " + res.RedeliveryOrderID.Hex() + ")."
+	default:
+		msg = "We have looked into this and closed the ticket without further action."
+	}
+	if res.Note != "" {
+		msg += " " + res.Note
+	}
+	return msg
+}
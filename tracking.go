@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func newTrackingToken() (string, error) {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+type TrackingEvent struct {
+	Status string    `json:"status"`
+	At     time.Time `json:"at"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// TrackingView is what anyone holding the tracking link may see. It must
+// not carry ids, addresses, contact details or the customer's identity.
+type TrackingView struct {
+	Status          string          `json:"status"`
+	Timeline        []TrackingEvent `json:"timeline"`
+	ETA             *time.Time      `json:"eta,omitempty"`
+	DeliveryWindow  *TimeWindow     `json:"deliveryWindow,omitempty"`
+	CourierName     string          `json:"courierName,omitempty"`
+	CourierLocation *GeoPoint       `json:"courierLocation,omitempty"`
+	DeliveredAt     *time.Time      `json:"deliveredAt,omitempty"`
+}
+
+// trackingTimeline rebuilds the order's history from the timestamps it
+// keeps.
+func trackingTimeline(order Order) []TrackingEvent {
+	events := []TrackingEvent{{Status: "Order placed", At: order.ID.Timestamp().UTC()}}
+	if order.PickedUpAt != nil {
+		events = append(events, TrackingEvent{Status: "Picked up", At: *order.PickedUpAt})
+	}
+	for _, s := range order.Stops {
+		if s.CompletedAt == nil || s.Kind != stopDropOff {
+			continue
+		}
+		status := "Drop-off completed"
+		if s.Status == "Failed" {
+			status = "Drop-off failed"
+		}
+		events = append(events, TrackingEvent{Status: status, At: *s.CompletedAt})
+	}
+	for _, a := range order.DeliveryAttempts {
+		events = append(events, TrackingEvent{Status: "Delivery attempted", At: a.At, Detail: strings.ReplaceAll(a.Reason, "_", " ")})
+	}
+	if order.DeliveredAt != nil {
+		events = append(events, TrackingEvent{Status: order.Status, At: *order.DeliveredAt})
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].At.Before(events[j].At) })
+	return events
+}
+
+// approximate rounds a position to about a kilometre.
+func approximate(p GeoPoint) *GeoPoint {
+	return &GeoPoint{Lat: math.Round(p.Lat*100) / 100, Lng: math.Round(p.Lng*100) / 100}
+}
+
+// TrackOrder is the public tracking page for recipients. The token is the
+// only credential, so unknown tokens get the same 404 as malformed ones.
+func TrackOrder(w http.ResponseWriter, r *http.Request) {
+	token := mux.Vars(r)["token"]
+	if token == "" {
+		http.Error(w, "Tracking link not found", http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var order Order
+	err := client.Database("myapp").Collection("orders").FindOne(ctx, bson.M{"trackingToken": token}).Decode(&order)
+	if err != nil {
+		http.Error(w, "Tracking link not found", http.StatusNotFound)
+		return
+	}
+
+	view := TrackingView{
+		Status:         order.Status,
+		Timeline:       trackingTimeline(order),
+		DeliveryWindow: order.DeliveryWindow,
+		DeliveredAt:    order.DeliveredAt,
+	}
+	if fields := strings.Fields(order.CourierName); len(fields) > 0 {
+		view.CourierName = fields[0]
+	}
+
+	now := time.Now().UTC()
+	if eta, err := newETAEstimator(now).estimate(ctx, order); err != nil {
+		log.Println("Failed to estimate ETA:", err)
+	} else if eta != nil {
+		view.ETA = eta.Delivery
+	}
+
+	if order.CourierEmail != "" && containsStatus(activeCourierStatuses, order.Status) {
+		var courier Courier
+		if err := client.Database("myapp").Collection("couriers").FindOne(ctx, bson.M{"email": order.CourierEmail}).Decode(&courier); err == nil {
+			if pos := courierPosition(courier, now); pos != nil {
+				view.CourierLocation = approximate(*pos)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(view)
+}
@@ -0,0 +1,675 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	ledgerTopUp      = "topup"
+	ledgerCharge     = "charge"
+	ledgerRefund     = "refund"
+	ledgerAdjustment = "adjustment"
+
+	accountCash        = "system:cash"
+	accountRevenue     = "system:revenue"
+	accountAdjustments = "system:adjustments"
+
+	paymentMethodWallet = "wallet"
+	// paymentMethodInvoice marks return legs whose fee the wallet could not
+	// cover; they are billed on the monthly invoice instead.
+	paymentMethodInvoice = "invoice"
+
+	ledgerLockLease = 30 * time.Second
+	ledgerLockWait  = 5 * time.Second
+
+	refundRetryBase = time.Minute
+	refundRetryMax  = 6 * time.Hour
+)
+
+var maxRefundAttempts = envInt("REFUND_MAX_ATTEMPTS", 10)
+
+var (
+	errInsufficientFunds  = errors.New("insufficient wallet balance")
+	errRefundExceedsTotal = errors.New("refund exceeds what is left of the order total")
+	errLedgerBusy         = errors.New("ledger account is busy, try again")
+)
+
+// Posting moves Amount cents into Account; the postings of one
+// LedgerTransaction always sum to zero.
+type Posting struct {
+	Account string `json:"account" bson:"account"`
+	Amount  int64  `json:"amount" bson:"amount"`
+}
+
+// LedgerTransaction is written once and never updated. Corrections are
+// made by posting a new adjustment.
+type LedgerTransaction struct {
+	ID          primitive.ObjectID  `bson:"_id,omitempty" json:"id"`
+	Type        string              `json:"type" bson:"type"`
+	Postings    []Posting           `json:"postings" bson:"postings"`
+	OrderID     *primitive.ObjectID `json:"orderId,omitempty" bson:"orderId,omitempty"`
+	Description string              `json:"description,omitempty" bson:"description,omitempty"`
+	CreatedBy   string              `json:"createdBy,omitempty" bson:"createdBy,omitempty"`
+	CreatedAt   time.Time           `json:"createdAt" bson:"createdAt"`
+}
+
+type StatementLine struct {
+	TransactionID primitive.ObjectID  `json:"transactionId"`
+	Type          string              `json:"type"`
+	Amount        int64               `json:"amount"`
+	Balance       int64               `json:"balance"`
+	OrderID       *primitive.ObjectID `json:"orderId,omitempty"`
+	Description   string              `json:"description,omitempty"`
+	CreatedAt     time.Time           `json:"createdAt"`
+}
+
+type Statement struct {
+	UserID         primitive.ObjectID `json:"userId"`
+	From           *time.Time         `json:"from,omitempty"`
+	To             *time.Time         `json:"to,omitempty"`
+	OpeningBalance int64              `json:"openingBalance"`
+	ClosingBalance int64              `json:"closingBalance"`
+	Lines          []StatementLine    `json:"lines"`
+}
+
+func walletAccount(userID primitive.ObjectID) string {
+	return "user:" + userID.Hex()
+}
+
+func postLedgerTransaction(ctx context.Context, tx LedgerTransaction) (LedgerTransaction, error) {
+	var sum int64
+	for _, p := range tx.Postings {
+		sum += p.Amount
+	}
+	if sum != 0 || len(tx.Postings) < 2 {
+		return tx, errors.New("unbalanced ledger transaction")
+	}
+
+	tx.ID = primitive.NewObjectID()
+	tx.CreatedAt = time.Now().UTC()
+
+	collection := client.Database("myapp").Collection("ledger")
+	_, err := collection.InsertOne(ctx, tx)
+	return tx, err
+}
+
+// accountBalance sums every posting to account made strictly before the
+// given time; a zero time means all postings.
+func accountBalance(ctx context.Context, account string, before time.Time) (int64, error) {
+	match := bson.M{"postings.account": account}
+	if !before.IsZero() {
+		match["createdAt"] = bson.M{"$lt": before}
+	}
+
+	pipeline := []bson.M{
+		{"$match": match},
+		{"$unwind": "$postings"},
+		{"$match": bson.M{"postings.account": account}},
+		{"$group": bson.M{"_id": nil, "balance": bson.M{"$sum": "$postings.amount"}}},
+	}
+
+	collection := client.Database("myapp").Collection("ledger")
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var result []struct {
+		Balance int64 `bson:"balance"`
+	}
+	if err := cursor.All(ctx, &result); err != nil {
+		return 0, err
+	}
+	if len(result) == 0 {
+		return 0, nil
+	}
+	return result[0].Balance, nil
+}
+
+// withLedgerLock runs fn while holding the lease on key in ledger_locks,
+// so a balance check and the posting that relies on it cannot interleave
+// with another request doing the same. The lease is a plain document
+// claimed with a conditional upsert: a held lock makes the upsert collide
+// on _id. It works without transactions, and an expired lease from a
+// crashed request is taken over.
+func withLedgerLock(ctx context.Context, key string, fn func() error) error {
+	locks := client.Database("myapp").Collection("ledger_locks")
+	token := primitive.NewObjectID()
+	deadline := time.Now().Add(ledgerLockWait)
+
+	for {
+		now := time.Now().UTC()
+		_, err := locks.UpdateOne(ctx,
+			bson.M{"_id": key, "$or": bson.A{
+				bson.M{"leaseUntil": bson.M{"$lt": now}},
+				bson.M{"leaseUntil": bson.M{"$exists": false}},
+			}},
+			bson.M{"$set": bson.M{"token": token, "leaseUntil": now.Add(ledgerLockLease)}},
+			options.Update().SetUpsert(true),
+		)
+		if err == nil {
+			break
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return errLedgerBusy
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(25 * time.Millisecond):
+		}
+	}
+	defer locks.DeleteOne(context.Background(), bson.M{"_id": key, "token": token})
+
+	return fn()
+}
+
+// chargeWallet takes amount from the user's wallet, less whatever is
+// already charged for the order, so retrying a charge never takes it twice.
+// The wallet's lock is held from the balance check until the charge is
+// posted, so concurrent orders cannot overdraw it.
+func chargeWallet(ctx context.Context, userID, orderID primitive.ObjectID, amount int64) error {
+	return withLedgerLock(ctx, walletAccount(userID), func() error {
+		charged, err := walletChargedFor(ctx, userID, orderID)
+		if err != nil {
+			return err
+		}
+		amount -= charged
+		if amount <= 0 {
+			return nil
+		}
+
+		balance, err := accountBalance(ctx, walletAccount(userID), time.Time{})
+		if err != nil {
+			return err
+		}
+		if balance < amount {
+			return errInsufficientFunds
+		}
+
+		_, err = postLedgerTransaction(ctx, LedgerTransaction{
+			Type: ledgerCharge,
+			Postings: []Posting{
+				{Account: walletAccount(userID), Amount: -amount},
+				{Account: accountRevenue, Amount: amount},
+			},
+			OrderID:     &orderID,
+			Description: "Order charge",
+		})
+		return err
+	})
+}
+
+// refundOrderCharge returns whatever was charged to the wallet for the order
+// and has not been refunded yet. Orders not paid by wallet are left alone.
+// It holds the order's ledger lock, so running it twice never refunds twice.
+func refundOrderCharge(ctx context.Context, order Order, reason string) error {
+	if order.PaymentMethod != paymentMethodWallet {
+		return nil
+	}
+	return withLedgerLock(ctx, orderLedgerLock(order.ID), func() error {
+		return refundOutstanding(ctx, order, reason)
+	})
+}
+
+func orderLedgerLock(orderID primitive.ObjectID) string {
+	return "order:" + orderID.Hex()
+}
+
+// walletChargedFor is what the order has taken from the user's wallet so
+// far, net of refunds.
+func walletChargedFor(ctx context.Context, userID, orderID primitive.ObjectID) (int64, error) {
+	account := walletAccount(userID)
+	cursor, err := client.Database("myapp").Collection("ledger").Find(ctx, bson.M{"orderId": orderID, "postings.account": account})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var txs []LedgerTransaction
+	if err := cursor.All(ctx, &txs); err != nil {
+		return 0, err
+	}
+
+	var charged int64
+	for _, tx := range txs {
+		for _, p := range tx.Postings {
+			if p.Account == account {
+				charged -= p.Amount
+			}
+		}
+	}
+	return charged, nil
+}
+
+func refundOutstanding(ctx context.Context, order Order, reason string) error {
+	account := walletAccount(order.UserID)
+	outstanding, err := walletChargedFor(ctx, order.UserID, order.ID)
+	if err != nil {
+		return err
+	}
+	if outstanding <= 0 {
+		return nil
+	}
+
+	_, err = postLedgerTransaction(ctx, LedgerTransaction{
+		Type: ledgerRefund,
+		Postings: []Posting{
+			{Account: account, Amount: outstanding},
+			{Account: accountRevenue, Amount: -outstanding},
+		},
+		OrderID:     &order.ID,
+		Description: reason,
+	})
+	return err
+}
+
+// creditOrderRefund pays amount back to the customer's wallet for the
+// order, whatever the order was paid with. Refunds for one order never add
+// up to more than its total; the order's ledger lock is held from reading
+// past refunds until this one is posted.
+func creditOrderRefund(ctx context.Context, order Order, amount int64, reason, createdBy string) (LedgerTransaction, error) {
+	var tx LedgerTransaction
+	err := withLedgerLock(ctx, orderLedgerLock(order.ID), func() error {
+		var err error
+		tx, err = creditRefund(ctx, order, amount, reason, createdBy)
+		return err
+	})
+	return tx, err
+}
+
+func creditRefund(ctx context.Context, order Order, amount int64, reason, createdBy string) (LedgerTransaction, error) {
+	account := walletAccount(order.UserID)
+	collection := client.Database("myapp").Collection("ledger")
+	cursor, err := collection.Find(ctx, bson.M{"orderId": order.ID, "type": ledgerRefund, "postings.account": account})
+	if err != nil {
+		return LedgerTransaction{}, err
+	}
+	defer cursor.Close(ctx)
+
+	var txs []LedgerTransaction
+	if err := cursor.All(ctx, &txs); err != nil {
+		return LedgerTransaction{}, err
+	}
+
+	var refunded int64
+	for _, tx := range txs {
+		for _, p := range tx.Postings {
+			if p.Account == account {
+				refunded += p.Amount
+			}
+		}
+	}
+	if amount <= 0 || refunded+amount > orderTotal(order) {
+		return LedgerTransaction{}, errRefundExceedsTotal
+	}
+
+	return postLedgerTransaction(ctx, LedgerTransaction{
+		Type: ledgerRefund,
+		Postings: []Posting{
+			{Account: account, Amount: amount},
+			{Account: accountRevenue, Amount: -amount},
+		},
+		OrderID:     &order.ID,
+		Description: reason,
+		CreatedBy:   createdBy,
+	})
+}
+
+// RefundRetry is a refund that failed when the order was canceled or
+// deleted. The order is kept as it was, since it may no longer exist.
+type RefundRetry struct {
+	ID            primitive.ObjectID `json:"id" bson:"_id"`
+	Order         Order              `json:"order" bson:"order"`
+	Reason        string             `json:"reason" bson:"reason"`
+	Attempts      int                `json:"attempts" bson:"attempts"`
+	NextAttemptAt time.Time          `json:"nextAttemptAt" bson:"nextAttemptAt"`
+	LastError     string             `json:"lastError,omitempty" bson:"lastError,omitempty"`
+	Failed        bool               `json:"failed,omitempty" bson:"failed,omitempty"`
+}
+
+// refundOrQueue refunds the order's charge, or queues the refund for
+// runRefundRetries when it cannot be posted now. It only fails when the
+// refund could be neither posted nor queued.
+func refundOrQueue(ctx context.Context, order Order, reason string) error {
+	err := refundOrderCharge(ctx, order, reason)
+	if err == nil {
+		return nil
+	}
+	log.Println("Refund failed, queued for retry:", err)
+
+	_, qerr := client.Database("myapp").Collection("refund_retries").InsertOne(ctx, RefundRetry{
+		ID:            primitive.NewObjectID(),
+		Order:         order,
+		Reason:        reason,
+		NextAttemptAt: time.Now().UTC().Add(refundRetryBase),
+		LastError:     err.Error(),
+	})
+	return qerr
+}
+
+func refundBackoff(attempts int) time.Duration {
+	d := refundRetryBase
+	for i := 1; i < attempts && d < refundRetryMax; i++ {
+		d *= 2
+	}
+	if d > refundRetryMax {
+		d = refundRetryMax
+	}
+	return d
+}
+
+// runRefundRetries posts queued refunds. Retries that keep failing are
+// marked failed after maxRefundAttempts, for an admin to settle by hand.
+func runRefundRetries(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	collection := client.Database("myapp").Collection("refund_retries")
+	for range ticker.C {
+		for {
+			ctx := context.TODO()
+			now := time.Now().UTC()
+			var retry RefundRetry
+			err := collection.FindOneAndUpdate(ctx,
+				bson.M{"failed": bson.M{"$ne": true}, "nextAttemptAt": bson.M{"$lte": now}},
+				bson.M{"$set": bson.M{"nextAttemptAt": now.Add(time.Minute)}},
+				options.FindOneAndUpdate().SetSort(bson.M{"nextAttemptAt": 1}).SetReturnDocument(options.After),
+			).Decode(&retry)
+			if err == mongo.ErrNoDocuments {
+				break
+			}
+			if err != nil {
+				log.Println("Failed to claim refund retry:", err)
+				break
+			}
+
+			err = refundOrderCharge(ctx, retry.Order, retry.Reason)
+			if err == nil {
+				_, err = collection.DeleteOne(ctx, bson.M{"_id": retry.ID})
+			} else {
+				set := bson.M{"attempts": retry.Attempts + 1, "lastError": err.Error()}
+				if retry.Attempts+1 >= maxRefundAttempts {
+					set["failed"] = true
+					log.Printf("Refund for order %s failed for good: %v", retry.Order.ID.Hex(), err)
+				} else {
+					set["nextAttemptAt"] = now.Add(refundBackoff(retry.Attempts + 1))
+				}
+				_, err = collection.UpdateOne(ctx, bson.M{"_id": retry.ID}, bson.M{"$set": set})
+			}
+			if err != nil {
+				log.Println("Failed to record refund retry:", err)
+			}
+		}
+	}
+}
+
+func parseDateRange(r *http.Request) (from, to time.Time, err error) {
+	parse := func(s string) (time.Time, error) {
+		if t, err := time.Parse(time.RFC3339, s); err == nil {
+			return t, nil
+		}
+		return time.Parse("2006-01-02", s)
+	}
+
+	if s := r.URL.Query().Get("from"); s != "" {
+		if from, err = parse(s); err != nil {
+			return
+		}
+	}
+	if s := r.URL.Query().Get("to"); s != "" {
+		if to, err = parse(s); err != nil {
+			return
+		}
+		// A bare date includes the whole day.
+		if len(s) == len("2006-01-02") {
+			to = to.AddDate(0, 0, 1)
+		}
+	}
+	return
+}
+
+func buildStatement(ctx context.Context, userID primitive.ObjectID, from, to time.Time) (Statement, error) {
+	account := walletAccount(userID)
+	statement := Statement{UserID: userID, Lines: []StatementLine{}}
+
+	opening, err := accountBalance(ctx, account, from)
+	if err != nil {
+		return statement, err
+	}
+	statement.OpeningBalance = opening
+
+	filter := bson.M{"postings.account": account}
+	createdAt := bson.M{}
+	if !from.IsZero() {
+		statement.From = &from
+		createdAt["$gte"] = from
+	}
+	if !to.IsZero() {
+		statement.To = &to
+		createdAt["$lt"] = to
+	}
+	if len(createdAt) > 0 {
+		filter["createdAt"] = createdAt
+	}
+
+	collection := client.Database("myapp").Collection("ledger")
+	cursor, err := collection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}}))
+	if err != nil {
+		return statement, err
+	}
+	defer cursor.Close(ctx)
+
+	var txs []LedgerTransaction
+	if err := cursor.All(ctx, &txs); err != nil {
+		return statement, err
+	}
+
+	balance := opening
+	for _, tx := range txs {
+		var amount int64
+		for _, p := range tx.Postings {
+			if p.Account == account {
+				amount += p.Amount
+			}
+		}
+		balance += amount
+		statement.Lines = append(statement.Lines, StatementLine{
+			TransactionID: tx.ID,
+			Type:          tx.Type,
+			Amount:        amount,
+			Balance:       balance,
+			OrderID:       tx.OrderID,
+			Description:   tx.Description,
+			CreatedAt:     tx.CreatedAt,
+		})
+	}
+	statement.ClosingBalance = balance
+
+	return statement, nil
+}
+
+func GetWalletBalance(w http.ResponseWriter, r *http.Request) {
+	userID, err := primitive.ObjectIDFromHex(r.Header.Get("userId"))
+	if err != nil {
+		http.Error(w, "Invalid UserID format", http.StatusBadRequest)
+		return
+	}
+
+	balance, err := accountBalance(context.TODO(), walletAccount(userID), time.Time{})
+	if err != nil {
+		http.Error(w, "Failed to compute balance", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"userId":  userID,
+		"balance": balance,
+	})
+}
+
+func GetWalletStatement(w http.ResponseWriter, r *http.Request) {
+	userID, err := primitive.ObjectIDFromHex(r.Header.Get("userId"))
+	if err != nil {
+		http.Error(w, "Invalid UserID format", http.StatusBadRequest)
+		return
+	}
+	writeWalletStatement(w, r, userID)
+}
+
+func GetUserWalletStatement(w http.ResponseWriter, r *http.Request) {
+	userID, err := primitive.ObjectIDFromHex(mux.Vars(r)["userId"])
+	if err != nil {
+		http.Error(w, "Invalid UserID format", http.StatusBadRequest)
+		return
+	}
+	writeWalletStatement(w, r, userID)
+}
+
+func writeWalletStatement(w http.ResponseWriter, r *http.Request, userID primitive.ObjectID) {
+	from, to, err := parseDateRange(r)
+	if err != nil {
+		http.Error(w, "Invalid date range", http.StatusBadRequest)
+		return
+	}
+
+	statement, err := buildStatement(context.TODO(), userID, from, to)
+	if err != nil {
+		http.Error(w, "Failed to build statement", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statement)
+}
+
+func TopUpWallet(w http.ResponseWriter, r *http.Request) {
+	userID, err := primitive.ObjectIDFromHex(mux.Vars(r)["userId"])
+	if err != nil {
+		http.Error(w, "Invalid UserID format", http.StatusBadRequest)
+		return
+	}
+
+	var request struct {
+		Amount      int64  `json:"amount"`
+		Description string `json:"description"`
+		AdminID     string `json:"adminId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if request.Amount <= 0 {
+		http.Error(w, "Amount must be positive", http.StatusBadRequest)
+		return
+	}
+
+	// Merchants have wallets too.
+	if _, err := findAccount(context.TODO(), userID); err != nil {
+		http.Error(w, "Account not found", http.StatusNotFound)
+		return
+	}
+
+	tx, err := postLedgerTransaction(context.TODO(), LedgerTransaction{
+		Type: ledgerTopUp,
+		Postings: []Posting{
+			{Account: walletAccount(userID), Amount: request.Amount},
+			{Account: accountCash, Amount: -request.Amount},
+		},
+		Description: request.Description,
+		CreatedBy:   request.AdminID,
+	})
+	if err != nil {
+		http.Error(w, "Failed to top up wallet", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(tx)
+}
+
+func AdjustWallet(w http.ResponseWriter, r *http.Request) {
+	userID, err := primitive.ObjectIDFromHex(mux.Vars(r)["userId"])
+	if err != nil {
+		http.Error(w, "Invalid UserID format", http.StatusBadRequest)
+		return
+	}
+
+	var request struct {
+		Amount      int64  `json:"amount"`
+		Description string `json:"description"`
+		AdminID     string `json:"adminId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if request.Amount == 0 {
+		http.Error(w, "Amount must not be zero", http.StatusBadRequest)
+		return
+	}
+	if request.Description == "" {
+		http.Error(w, "Description is required for adjustments", http.StatusBadRequest)
+		return
+	}
+
+	// Merchants have wallets too.
+	if _, err := findAccount(context.TODO(), userID); err != nil {
+		http.Error(w, "Account not found", http.StatusNotFound)
+		return
+	}
+
+	// A debit is checked against the balance under the wallet's lock, like a
+	// charge, so it cannot race an order into overdrawing the wallet.
+	var tx LedgerTransaction
+	err = withLedgerLock(context.TODO(), walletAccount(userID), func() error {
+		if request.Amount < 0 {
+			balance, err := accountBalance(context.TODO(), walletAccount(userID), time.Time{})
+			if err != nil {
+				return err
+			}
+			if balance+request.Amount < 0 {
+				return errInsufficientFunds
+			}
+		}
+
+		var err error
+		tx, err = postLedgerTransaction(context.TODO(), LedgerTransaction{
+			Type: ledgerAdjustment,
+			Postings: []Posting{
+				{Account: walletAccount(userID), Amount: request.Amount},
+				{Account: accountAdjustments, Amount: -request.Amount},
+			},
+			Description: request.Description,
+			CreatedBy:   request.AdminID,
+		})
+		return err
+	})
+	if err == errInsufficientFunds {
+		http.Error(w, "Adjustment would overdraw the wallet", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to adjust wallet", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(tx)
+}
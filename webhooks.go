@@ -0,0 +1,604 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	eventOrderCreated   = "order.created"
+	eventOrderCancelled = "order.cancelled"
+	eventOrderDeleted   = "order.deleted"
+
+	webhookPending   = "pending"
+	webhookSending   = "sending"
+	webhookDelivered = "delivered"
+	webhookDead      = "dead"
+
+	webhookRetryBase = 30 * time.Second
+	webhookRetryMax  = 6 * time.Hour
+	webhookTimeout   = 10 * time.Second
+)
+
+var maxWebhookAttempts = envInt("WEBHOOK_MAX_ATTEMPTS", 8)
+
+// WebhookEndpoint is a merchant URL that receives the events it subscribes
+// to for the merchant's own orders. An empty Events list means all events.
+type WebhookEndpoint struct {
+	ID        primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	UserID    primitive.ObjectID `json:"userId" bson:"userId"`
+	URL       string             `json:"url" bson:"url"`
+	Events    []string           `json:"events" bson:"events"`
+	Secret    string             `json:"-" bson:"secret"`
+	Active    bool               `json:"active" bson:"active"`
+	CreatedAt time.Time          `json:"createdAt" bson:"createdAt"`
+}
+
+type WebhookAttempt struct {
+	At         time.Time `json:"at" bson:"at"`
+	StatusCode int       `json:"statusCode,omitempty" bson:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty" bson:"error,omitempty"`
+	DurationMs int64     `json:"durationMs" bson:"durationMs"`
+}
+
+// WebhookDelivery is one event queued for one endpoint, together with the
+// log of every attempt to deliver it. Deliveries that run out of attempts
+// are marked dead and stay there until an admin replays them.
+type WebhookDelivery struct {
+	ID            primitive.ObjectID  `json:"id" bson:"_id,omitempty"`
+	EndpointID    primitive.ObjectID  `json:"endpointId" bson:"endpointId"`
+	UserID        primitive.ObjectID  `json:"userId" bson:"userId"`
+	EventID       primitive.ObjectID  `json:"eventId" bson:"eventId"`
+	Event         string              `json:"event" bson:"event"`
+	OrderID       primitive.ObjectID  `json:"orderId" bson:"orderId"`
+	Payload       string              `json:"payload" bson:"payload"`
+	Status        string              `json:"status" bson:"status"`
+	Attempts      []WebhookAttempt    `json:"attempts" bson:"attempts"`
+	NextAttemptAt time.Time           `json:"nextAttemptAt" bson:"nextAttemptAt"`
+	CreatedAt     time.Time           `json:"createdAt" bson:"createdAt"`
+	DeliveredAt   *time.Time          `json:"deliveredAt,omitempty" bson:"deliveredAt,omitempty"`
+	ReplayOf      *primitive.ObjectID `json:"replayOf,omitempty" bson:"replayOf,omitempty"`
+	// Replay is stored alongside ReplayOf so the unique index on event and
+	// endpoint can leave replays out.
+	Replay bool `json:"-" bson:"replay"`
+	// Seq is the outbox event's and orders an order's deliveries.
+	Seq int64 `json:"seq" bson:"seq"`
+}
+
+// OrderEventPayload is the body posted to merchants. It carries the order as
+// the merchant sees it, without courier contact details or internal state.
+type OrderEventPayload struct {
+	ID         string    `json:"id"`
+	Event      string    `json:"event"`
+	OccurredAt time.Time `json:"occurredAt"`
+	Order      struct {
+		ID              primitive.ObjectID `json:"id"`
+		Status          string             `json:"status"`
+		PickupLocation  string             `json:"pickupLocation,omitempty"`
+		DropOffLocation string             `json:"dropOffLocation,omitempty"`
+		Price           int64              `json:"price"`
+		Tip             int64              `json:"tip,omitempty"`
+		CourierName     string             `json:"courierName,omitempty"`
+		PickedUpAt      *time.Time         `json:"pickedUpAt,omitempty"`
+		DeliveredAt     *time.Time         `json:"deliveredAt,omitempty"`
+		TrackingURL     string             `json:"trackingUrl,omitempty"`
+	} `json:"order"`
+}
+
+// statusEvent names the event for an order entering status, e.g.
+// "order.picked_up" for "Picked up".
+func statusEvent(status string) string {
+	return "order." + strings.ReplaceAll(strings.ToLower(status), " ", "_")
+}
+
+func newWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(b), nil
+}
+
+// signWebhook signs "<timestamp>.<body>" so receivers can reject replays of
+// old payloads as well as forged ones.
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookSubscriber queues an outbox event for every endpoint of the
+// order's owner that subscribes to it. Deliveries are keyed by event and
+// endpoint, so a redelivered event is queued only once.
+func webhookSubscriber(ctx context.Context, e OutboxEvent) error {
+	order := e.Order
+	cursor, err := client.Database("myapp").Collection("webhook_endpoints").Find(ctx, bson.M{
+		"userId": order.UserID,
+		"active": true,
+		"$or":    bson.A{bson.M{"events": bson.M{"$size": 0}}, bson.M{"events": e.Event}},
+	})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	var endpoints []WebhookEndpoint
+	if err := cursor.All(ctx, &endpoints); err != nil {
+		return err
+	}
+	if len(endpoints) == 0 {
+		return nil
+	}
+
+	payload := OrderEventPayload{ID: e.ID.Hex(), Event: e.Event, OccurredAt: e.CreatedAt}
+	payload.Order.ID = order.ID
+	payload.Order.Status = order.Status
+	payload.Order.PickupLocation = order.PickupLocation
+	payload.Order.DropOffLocation = order.DropOffLocation
+	payload.Order.Price = order.Price
+	payload.Order.Tip = order.Tip
+	payload.Order.CourierName = order.CourierName
+	payload.Order.PickedUpAt = order.PickedUpAt
+	payload.Order.DeliveredAt = order.DeliveredAt
+	if order.TrackingToken != "" {
+		payload.Order.TrackingURL = "/api/track/" + order.TrackingToken
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	deliveries := client.Database("myapp").Collection("webhook_deliveries")
+	for _, endpoint := range endpoints {
+		delivery := WebhookDelivery{
+			ID:            primitive.NewObjectID(),
+			EndpointID:    endpoint.ID,
+			UserID:        endpoint.UserID,
+			EventID:       e.ID,
+			Seq:           e.Seq,
+			Event:         e.Event,
+			OrderID:       order.ID,
+			Payload:       string(body),
+			Status:        webhookPending,
+			Attempts:      []WebhookAttempt{},
+			NextAttemptAt: now,
+			CreatedAt:     now,
+		}
+		_, err := deliveries.UpdateOne(ctx,
+			bson.M{"eventId": e.ID, "endpointId": endpoint.ID, "replayOf": bson.M{"$exists": false}},
+			bson.M{"$setOnInsert": delivery},
+			options.Update().SetUpsert(true),
+		)
+		// Losing a race to queue the same delivery leaves it queued.
+		if err != nil && !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func webhookBackoff(attempts int) time.Duration {
+	d := webhookRetryBase
+	for i := 1; i < attempts && d < webhookRetryMax; i++ {
+		d *= 2
+	}
+	if d > webhookRetryMax {
+		d = webhookRetryMax
+	}
+	return d
+}
+
+// claimWebhookDelivery leases the next due delivery like claimNotification.
+// An endpoint receives an order's events in the order they happened: a
+// delivery with an earlier event for the same order and endpoint still
+// pending is put back until that one is delivered or dead.
+func claimWebhookDelivery(ctx context.Context, now time.Time) (*WebhookDelivery, error) {
+	deliveries := client.Database("myapp").Collection("webhook_deliveries")
+	for {
+		var d WebhookDelivery
+		err := deliveries.FindOneAndUpdate(ctx,
+			bson.M{
+				"status":        bson.M{"$in": bson.A{webhookPending, webhookSending}},
+				"nextAttemptAt": bson.M{"$lte": now},
+			},
+			bson.M{"$set": bson.M{"status": webhookSending, "nextAttemptAt": now.Add(2 * webhookTimeout)}},
+			options.FindOneAndUpdate().SetSort(bson.D{{Key: "nextAttemptAt", Value: 1}, {Key: "seq", Value: 1}}).SetReturnDocument(options.After),
+		).Decode(&d)
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var earlier WebhookDelivery
+		err = deliveries.FindOne(ctx,
+			bson.M{
+				"_id":        bson.M{"$ne": d.ID},
+				"endpointId": d.EndpointID,
+				"orderId":    d.OrderID,
+				"seq":        bson.M{"$lt": d.Seq},
+				"status":     bson.M{"$in": bson.A{webhookPending, webhookSending}},
+			},
+			options.FindOne().SetSort(bson.M{"nextAttemptAt": 1}),
+		).Decode(&earlier)
+		if err == mongo.ErrNoDocuments {
+			return &d, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// Retry just after the earlier delivery's next attempt, and never
+		// within this pass, so it is claimed first.
+		next := earlier.NextAttemptAt
+		if next.Before(now) {
+			next = now
+		}
+		_, err = deliveries.UpdateOne(ctx,
+			bson.M{"_id": d.ID, "status": webhookSending},
+			bson.M{"$set": bson.M{"status": webhookPending, "nextAttemptAt": next.Add(time.Second)}},
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// webhookClient refuses to connect to non-public addresses, checked on the
+// resolved address of every connection, so neither DNS changes after
+// registration nor redirects can point deliveries at internal services.
+var webhookClient = &http.Client{
+	Timeout: webhookTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: webhookTimeout,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || !webhookAddressAllowed(ip) {
+					return fmt.Errorf("webhook address %s is not public", host)
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: webhookTimeout,
+	},
+}
+
+func postWebhook(ctx context.Context, endpoint WebhookEndpoint, d *WebhookDelivery) (int, error) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.URL, strings.NewReader(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	// The id is the outbox event's, the same across retries and replays, so
+	// receivers can deduplicate on it.
+	req.Header.Set("X-Webhook-Id", d.EventID.Hex())
+	req.Header.Set("X-Webhook-Event", d.Event)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", signWebhook(endpoint.Secret, timestamp, []byte(d.Payload)))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode/100 != 2 {
+		return resp.StatusCode, fmt.Errorf("endpoint answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+func deliverWebhook(ctx context.Context, d *WebhookDelivery) error {
+	start := time.Now()
+	attempt := WebhookAttempt{At: start.UTC()}
+
+	var endpoint WebhookEndpoint
+	err := client.Database("myapp").Collection("webhook_endpoints").FindOne(ctx, bson.M{"_id": d.EndpointID, "active": true}).Decode(&endpoint)
+	if err == mongo.ErrNoDocuments {
+		err = errors.New("endpoint was deleted or disabled")
+	}
+	if err == nil {
+		attempt.StatusCode, err = postWebhook(ctx, endpoint, d)
+	}
+	attempt.DurationMs = time.Since(start).Milliseconds()
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+
+	now := time.Now().UTC()
+	set := bson.M{}
+	switch {
+	case err == nil:
+		set["status"] = webhookDelivered
+		set["deliveredAt"] = now
+	case len(d.Attempts)+1 >= maxWebhookAttempts:
+		set["status"] = webhookDead
+	default:
+		set["status"] = webhookPending
+		set["nextAttemptAt"] = now.Add(webhookBackoff(len(d.Attempts) + 1))
+	}
+
+	_, uerr := client.Database("myapp").Collection("webhook_deliveries").UpdateOne(ctx,
+		bson.M{"_id": d.ID},
+		bson.M{"$set": set, "$push": bson.M{"attempts": attempt}},
+	)
+	return uerr
+}
+
+func runWebhookDispatcher(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for {
+			d, err := claimWebhookDelivery(context.TODO(), time.Now().UTC())
+			if err != nil {
+				log.Println("Failed to claim webhook delivery:", err)
+				break
+			}
+			if d == nil {
+				break
+			}
+			if err := deliverWebhook(context.TODO(), d); err != nil {
+				log.Println("Failed to record webhook delivery:", err)
+			}
+		}
+	}
+}
+
+// webhookEvents are the events endpoints can subscribe to.
+var webhookEvents = map[string]bool{
+	eventOrderCreated:         true,
+	eventOrderCancelled:       true,
+	eventOrderDeleted:         true,
+	eventOrderDisputeResolved: true,
+	eventOrderStopUpdated:     true,
+}
+
+func init() {
+	for _, status := range []string{
+		"Scheduled", "Pending", "Pending Acceptance", "Accepted", "Picked up", "In transit",
+		"Delivered", "Partially delivered", "Delivery failed", "Reattempt scheduled", "Returned to sender",
+	} {
+		webhookEvents[statusEvent(status)] = true
+	}
+}
+
+// webhookAddressAllowed rejects loopback, private, link-local and
+// unspecified addresses outside development mode.
+func webhookAddressAllowed(ip net.IP) bool {
+	if developmentMode {
+		return true
+	}
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast()
+}
+
+// validateWebhookURL requires an https URL whose host resolves only to
+// public addresses. Development mode also accepts http and local hosts.
+func validateWebhookURL(ctx context.Context, raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Hostname() == "" {
+		return &orderError{http.StatusBadRequest, "A valid URL is required"}
+	}
+	if u.Scheme != "https" && !(developmentMode && u.Scheme == "http") {
+		return &orderError{http.StatusBadRequest, "Webhook URLs must use https"}
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil || len(addrs) == 0 {
+		return &orderError{http.StatusBadRequest, "Webhook host could not be resolved"}
+	}
+	for _, a := range addrs {
+		if !webhookAddressAllowed(a.IP) {
+			return &orderError{http.StatusBadRequest, "Webhook host must resolve to a public address"}
+		}
+	}
+	return nil
+}
+
+func CreateWebhookEndpoint(w http.ResponseWriter, r *http.Request) {
+	userID, _, err := requestAccount(context.TODO(), r, scopeWebhooksManage)
+	if err != nil {
+		writeAccountError(w, err)
+		return
+	}
+
+	var endpoint WebhookEndpoint
+	if err := json.NewDecoder(r.Body).Decode(&endpoint); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if err := validateWebhookURL(r.Context(), endpoint.URL); err != nil {
+		writeAccountError(w, err)
+		return
+	}
+	for _, e := range endpoint.Events {
+		if !webhookEvents[e] {
+			http.Error(w, "Unknown event "+e, http.StatusBadRequest)
+			return
+		}
+	}
+	if endpoint.Events == nil {
+		endpoint.Events = []string{}
+	}
+
+	endpoint.Secret, err = newWebhookSecret()
+	if err != nil {
+		http.Error(w, "Failed to create webhook", http.StatusInternalServerError)
+		return
+	}
+	endpoint.ID = primitive.NewObjectID()
+	endpoint.UserID = userID
+	endpoint.Active = true
+	endpoint.CreatedAt = time.Now().UTC()
+
+	_, err = client.Database("myapp").Collection("webhook_endpoints").InsertOne(context.TODO(), endpoint)
+	if err != nil {
+		http.Error(w, "Failed to create webhook", http.StatusInternalServerError)
+		return
+	}
+
+	// The secret is only ever shown here.
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"endpoint": endpoint,
+		"secret":   endpoint.Secret,
+	})
+}
+
+func GetWebhookEndpoints(w http.ResponseWriter, r *http.Request) {
+	userID, _, err := requestAccount(context.TODO(), r, scopeWebhooksManage)
+	if err != nil {
+		writeAccountError(w, err)
+		return
+	}
+
+	cursor, err := client.Database("myapp").Collection("webhook_endpoints").Find(context.TODO(), bson.M{"userId": userID})
+	if err != nil {
+		http.Error(w, "Failed to retrieve webhooks", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.TODO())
+
+	endpoints := []WebhookEndpoint{}
+	if err := cursor.All(context.TODO(), &endpoints); err != nil {
+		http.Error(w, "Failed to decode webhooks", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(endpoints)
+}
+
+func DeleteWebhookEndpoint(w http.ResponseWriter, r *http.Request) {
+	endpointID, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid WebhookID format", http.StatusBadRequest)
+		return
+	}
+	userID, _, err := requestAccount(context.TODO(), r, scopeWebhooksManage)
+	if err != nil {
+		writeAccountError(w, err)
+		return
+	}
+
+	result, err := client.Database("myapp").Collection("webhook_endpoints").DeleteOne(context.TODO(), bson.M{"_id": endpointID, "userId": userID})
+	if err != nil {
+		http.Error(w, "Failed to delete webhook", http.StatusInternalServerError)
+		return
+	}
+	if result.DeletedCount == 0 {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode("Webhook deleted successfully")
+}
+
+// GetWebhookDeliveries is the admin delivery log. status=dead lists the
+// dead-letter queue.
+func GetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	filter := bson.M{}
+	query := r.URL.Query()
+	if status := query.Get("status"); status != "" {
+		filter["status"] = status
+	}
+	for param, field := range map[string]string{"endpointId": "endpointId", "orderId": "orderId", "userId": "userId"} {
+		if v := query.Get(param); v != "" {
+			id, err := primitive.ObjectIDFromHex(v)
+			if err != nil {
+				http.Error(w, "Invalid "+param, http.StatusBadRequest)
+				return
+			}
+			filter[field] = id
+		}
+	}
+
+	opts := options.Find().SetSort(bson.M{"createdAt": -1}).SetLimit(500)
+	cursor, err := client.Database("myapp").Collection("webhook_deliveries").Find(context.TODO(), filter, opts)
+	if err != nil {
+		http.Error(w, "Failed to retrieve deliveries", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.TODO())
+
+	deliveries := []WebhookDelivery{}
+	if err := cursor.All(context.TODO(), &deliveries); err != nil {
+		http.Error(w, "Failed to decode deliveries", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+// ReplayWebhookDelivery queues a fresh copy of a delivery with the same
+// payload, keeping the original and its attempt log untouched.
+func ReplayWebhookDelivery(w http.ResponseWriter, r *http.Request) {
+	deliveryID, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid DeliveryID format", http.StatusBadRequest)
+		return
+	}
+
+	collection := client.Database("myapp").Collection("webhook_deliveries")
+	var original WebhookDelivery
+	if err := collection.FindOne(context.TODO(), bson.M{"_id": deliveryID}).Decode(&original); err != nil {
+		http.Error(w, "Delivery not found", http.StatusNotFound)
+		return
+	}
+
+	now := time.Now().UTC()
+	replay := original
+	replay.ID = primitive.NewObjectID()
+	replay.Status = webhookPending
+	replay.Attempts = []WebhookAttempt{}
+	replay.NextAttemptAt = now
+	replay.CreatedAt = now
+	replay.DeliveredAt = nil
+	replay.ReplayOf = &original.ID
+	replay.Replay = true
+
+	if _, err := collection.InsertOne(context.TODO(), replay); err != nil {
+		http.Error(w, "Failed to replay delivery", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":    "Delivery queued for replay",
+		"deliveryId": replay.ID,
+	})
+}
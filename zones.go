@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ZoneArea is a GeoJSON Polygon: an outer ring followed by optional holes,
+// each a closed ring of [lng, lat] positions.
+type ZoneArea struct {
+	Type        string        `json:"type" bson:"type"`
+	Coordinates [][][]float64 `json:"coordinates" bson:"coordinates"`
+}
+
+// ServiceZone is an area we operate in. Orders are priced with the pickup
+// zone's multiplier and accepted only during its operating hours.
+type ServiceZone struct {
+	ID              primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Name            string             `json:"name" bson:"name"`
+	Area            ZoneArea           `json:"area" bson:"area"`
+	PriceMultiplier float64            `json:"priceMultiplier" bson:"priceMultiplier"`
+	Timezone        string             `json:"timezone" bson:"timezone"`
+	OpenHour        int                `json:"openHour" bson:"openHour"`
+	CloseHour       int                `json:"closeHour" bson:"closeHour"`
+	Days            []string           `json:"days,omitempty" bson:"days,omitempty"` // MO..SU, empty for every day
+	CourierEmails   []string           `json:"courierEmails" bson:"courierEmails"`
+	Active          bool               `json:"active" bson:"active"`
+	CreatedAt       time.Time          `json:"createdAt" bson:"createdAt"`
+}
+
+func (a ZoneArea) validate() error {
+	if a.Type != "Polygon" {
+		return errors.New("area must be a GeoJSON Polygon")
+	}
+	if len(a.Coordinates) == 0 {
+		return errors.New("area has no rings")
+	}
+	for i, ring := range a.Coordinates {
+		if len(ring) < 4 {
+			return fmt.Errorf("ring %d needs at least 4 positions", i+1)
+		}
+		for _, pos := range ring {
+			if len(pos) != 2 || pos[0] < -180 || pos[0] > 180 || pos[1] < -90 || pos[1] > 90 {
+				return fmt.Errorf("ring %d has an invalid [lng, lat] position", i+1)
+			}
+		}
+		first, last := ring[0], ring[len(ring)-1]
+		if first[0] != last[0] || first[1] != last[1] {
+			return fmt.Errorf("ring %d is not closed", i+1)
+		}
+	}
+	return nil
+}
+
+// ringContains is the even-odd ray casting test with lng as x and lat as y.
+func ringContains(ring [][]float64, p GeoPoint) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		xi, yi := ring[i][0], ring[i][1]
+		xj, yj := ring[j][0], ring[j][1]
+		if (yi > p.Lat) != (yj > p.Lat) && p.Lng < (xj-xi)*(p.Lat-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+func (a ZoneArea) contains(p GeoPoint) bool {
+	if len(a.Coordinates) == 0 || !ringContains(a.Coordinates[0], p) {
+		return false
+	}
+	for _, hole := range a.Coordinates[1:] {
+		if ringContains(hole, p) {
+			return false
+		}
+	}
+	return true
+}
+
+func (z *ServiceZone) validate() error {
+	if strings.TrimSpace(z.Name) == "" {
+		return errors.New("name is required")
+	}
+	if err := z.Area.validate(); err != nil {
+		return err
+	}
+	if z.PriceMultiplier == 0 {
+		z.PriceMultiplier = 1
+	}
+	if z.PriceMultiplier < 0 {
+		return errors.New("price multiplier cannot be negative")
+	}
+	if _, err := time.LoadLocation(z.Timezone); err != nil || z.Timezone == "" {
+		return fmt.Errorf("unknown timezone %q", z.Timezone)
+	}
+	if z.OpenHour < 0 || z.CloseHour > 24 || z.OpenHour >= z.CloseHour {
+		return errors.New("opening hours must satisfy 0 <= openHour < closeHour <= 24")
+	}
+	for _, d := range z.Days {
+		if _, ok := rruleDays[d]; !ok {
+			return fmt.Errorf("unknown day %q", d)
+		}
+	}
+	if z.CourierEmails == nil {
+		z.CourierEmails = []string{}
+	}
+	return nil
+}
+
+func (z ServiceZone) openAt(t time.Time) bool {
+	loc, err := time.LoadLocation(z.Timezone)
+	if err != nil {
+		return false
+	}
+	local := t.In(loc)
+
+	if len(z.Days) > 0 {
+		open := false
+		for _, d := range z.Days {
+			open = open || rruleDays[d] == local.Weekday()
+		}
+		if !open {
+			return false
+		}
+	}
+	minute := local.Hour()*60 + local.Minute()
+	return minute >= z.OpenHour*60 && minute < z.CloseHour*60
+}
+
+func (z ServiceZone) price(base int64) int64 {
+	return int64(math.Round(float64(base) * z.PriceMultiplier))
+}
+
+func (z ServiceZone) inPool(email string) bool {
+	return containsString(z.CourierEmails, email)
+}
+
+func activeZones(ctx context.Context) ([]ServiceZone, error) {
+	opts := options.Find().SetSort(bson.M{"_id": 1})
+	cursor, err := client.Database("myapp").Collection("service_zones").Find(ctx, bson.M{"active": true}, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var zones []ServiceZone
+	if err := cursor.All(ctx, &zones); err != nil {
+		return nil, err
+	}
+	return zones, nil
+}
+
+// zoneAt returns the first zone containing p, oldest first.
+func zoneAt(zones []ServiceZone, p GeoPoint) *ServiceZone {
+	for i := range zones {
+		if zones[i].Area.contains(p) {
+			return &zones[i]
+		}
+	}
+	return nil
+}
+
+// zoneForOrder checks every address of the order lies in an active zone and
+// that the pickup zone is open at the time the order is dispatched. It
+// returns the pickup zone, or nil when no zones are configured.
+func zoneForOrder(ctx context.Context, order Order, at time.Time) (*ServiceZone, error) {
+	zones, err := activeZones(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(zones) == 0 {
+		return nil, nil
+	}
+
+	type address struct {
+		name  string
+		point *GeoPoint
+	}
+	addresses := []address{{"Pickup", order.PickupCoordinates}, {"Drop-off", order.DropOffCoordinates}}
+	if len(order.Stops) > 0 {
+		addresses = nil
+		for _, s := range order.Stops {
+			addresses = append(addresses, address{fmt.Sprintf("Stop %d", s.Sequence), s.Coordinates})
+		}
+	}
+
+	var pickupZone *ServiceZone
+	for i, a := range addresses {
+		if a.point == nil {
+			return nil, &orderError{http.StatusBadRequest, a.name + " coordinates are required to check the service area"}
+		}
+		zone := zoneAt(zones, *a.point)
+		if zone == nil {
+			return nil, &orderError{http.StatusBadRequest, a.name + " address is outside our service area"}
+		}
+		if i == 0 {
+			pickupZone = zone
+		}
+	}
+
+	if !pickupZone.openAt(at) {
+		return nil, &orderError{http.StatusBadRequest, fmt.Sprintf("Service zone %s is closed at that time", pickupZone.Name)}
+	}
+	return pickupZone, nil
+}
+
+type CourierSuggestion struct {
+	Name       string   `json:"name"`
+	Email      string   `json:"email"`
+	Phone      string   `json:"phone"`
+	InZonePool bool     `json:"inZonePool"`
+	DistanceKm *float64 `json:"distanceKm,omitempty"`
+	Rating     float64  `json:"rating"`
+	// RankKm is the distance after the rating penalty.
+	RankKm *float64 `json:"rankKm,omitempty"`
+}
+
+// suggestCouriers ranks the couriers able to take order: couriers in the
+// pickup zone's pool first, then by distance from their last known position
+// to the pickup, lengthened for lower rated couriers. Couriers without a
+// known position come last, best rated first.
+func suggestCouriers(ctx context.Context, order Order) ([]CourierSuggestion, error) {
+	var zone ServiceZone
+	if order.ZoneID != nil {
+		// A zone deleted since the order was placed leaves no pool to prefer.
+		err := client.Database("myapp").Collection("service_zones").FindOne(ctx, bson.M{"_id": order.ZoneID}).Decode(&zone)
+		if err != nil && err != mongo.ErrNoDocuments {
+			return nil, err
+		}
+	}
+
+	cursor, err := client.Database("myapp").Collection("couriers").Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var couriers []Courier
+	if err := cursor.All(ctx, &couriers); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	suggestions := []CourierSuggestion{}
+	for _, c := range couriers {
+		ok, _, err := courierCanMeetWindow(ctx, c, order)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+
+		s := CourierSuggestion{Name: c.Name, Email: c.Email, Phone: c.Phone, InZonePool: zone.inPool(c.Email), Rating: c.Rating.score()}
+		if pos := courierPosition(c, now); pos != nil && order.PickupCoordinates != nil {
+			km := haversineKm(*pos, *order.PickupCoordinates)
+			rank := km + (5-s.Rating)*ratingPenaltyKm
+			s.DistanceKm, s.RankKm = &km, &rank
+		}
+		suggestions = append(suggestions, s)
+	}
+
+	sort.SliceStable(suggestions, func(i, j int) bool {
+		a, b := suggestions[i], suggestions[j]
+		if a.InZonePool != b.InZonePool {
+			return a.InZonePool
+		}
+		if (a.RankKm == nil) != (b.RankKm == nil) {
+			return a.RankKm != nil
+		}
+		if a.RankKm == nil {
+			return a.Rating > b.Rating
+		}
+		return *a.RankKm < *b.RankKm
+	})
+	return suggestions, nil
+}
+
+func GetCourierSuggestions(w http.ResponseWriter, r *http.Request) {
+	orderID, err := primitive.ObjectIDFromHex(mux.Vars(r)["orderId"])
+	if err != nil {
+		http.Error(w, "Invalid OrderID format", http.StatusBadRequest)
+		return
+	}
+
+	var order Order
+	err = client.Database("myapp").Collection("orders").FindOne(context.TODO(), bson.M{"_id": orderID}).Decode(&order)
+	if err != nil {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+
+	suggestions, err := suggestCouriers(context.TODO(), order)
+	if err != nil {
+		http.Error(w, "Failed to rank couriers", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(suggestions)
+}
+
+func CreateServiceZone(w http.ResponseWriter, r *http.Request) {
+	var zone ServiceZone
+	if err := json.NewDecoder(r.Body).Decode(&zone); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if err := zone.validate(); err != nil {
+		http.Error(w, "Invalid zone: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	zone.ID = primitive.NewObjectID()
+	zone.CreatedAt = time.Now().UTC()
+
+	_, err := client.Database("myapp").Collection("service_zones").InsertOne(context.TODO(), zone)
+	if err != nil {
+		http.Error(w, "Failed to create zone", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(zone)
+}
+
+func GetServiceZones(w http.ResponseWriter, r *http.Request) {
+	cursor, err := client.Database("myapp").Collection("service_zones").Find(context.TODO(), bson.M{})
+	if err != nil {
+		http.Error(w, "Failed to retrieve zones", http.StatusInternalServerError)
+		return
+	}
+	defer cursor.Close(context.TODO())
+
+	zones := []ServiceZone{}
+	if err := cursor.All(context.TODO(), &zones); err != nil {
+		http.Error(w, "Failed to decode zones", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(zones)
+}
+
+// UpdateServiceZone replaces the zone's settings. Orders already created keep
+// the price they were quoted.
+func UpdateServiceZone(w http.ResponseWriter, r *http.Request) {
+	zoneID, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ZoneID format", http.StatusBadRequest)
+		return
+	}
+
+	var zone ServiceZone
+	if err := json.NewDecoder(r.Body).Decode(&zone); err != nil {
+		http.Error(w, "Invalid input", http.StatusBadRequest)
+		return
+	}
+	if err := zone.validate(); err != nil {
+		http.Error(w, "Invalid zone: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := client.Database("myapp").Collection("service_zones").UpdateOne(context.TODO(),
+		bson.M{"_id": zoneID},
+		bson.M{"$set": bson.M{
+			"name":            zone.Name,
+			"area":            zone.Area,
+			"priceMultiplier": zone.PriceMultiplier,
+			"timezone":        zone.Timezone,
+			"openHour":        zone.OpenHour,
+			"closeHour":       zone.CloseHour,
+			"days":            zone.Days,
+			"courierEmails":   zone.CourierEmails,
+			"active":          zone.Active,
+		}},
+	)
+	if err != nil {
+		http.Error(w, "Failed to update zone", http.StatusInternalServerError)
+		return
+	}
+	if result.MatchedCount == 0 {
+		http.Error(w, "Zone not found", http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode("Zone updated successfully")
+}
+
+func DeleteServiceZone(w http.ResponseWriter, r *http.Request) {
+	zoneID, err := primitive.ObjectIDFromHex(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Invalid ZoneID format", http.StatusBadRequest)
+		return
+	}
+
+	result, err := client.Database("myapp").Collection("service_zones").DeleteOne(context.TODO(), bson.M{"_id": zoneID})
+	if err != nil {
+		http.Error(w, "Failed to delete zone", http.StatusInternalServerError)
+		return
+	}
+	if result.DeletedCount == 0 {
+		http.Error(w, "Zone not found", http.StatusNotFound)
+		return
+	}
+
+	_, err = client.Database("myapp").Collection("orders").UpdateMany(context.TODO(), bson.M{"zoneId": zoneID}, bson.M{"$unset": bson.M{"zoneId": ""}})
+	if err != nil {
+		http.Error(w, "Zone deleted but failed to unlink its orders", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode("Zone deleted successfully")
+}
@@ -0,0 +1,65 @@
+package main
+
+import "testing"
+
+func TestRingContains(t *testing.T) {
+	square := [][]float64{{0, 0}, {10, 0}, {10, 10}, {0, 10}, {0, 0}}
+	// A "U" open to the north: the notch between x=4 and x=6 above y=4 is
+	// outside.
+	u := [][]float64{{0, 0}, {10, 0}, {10, 10}, {6, 10}, {6, 4}, {4, 4}, {4, 10}, {0, 10}, {0, 0}}
+	// The same square wound the other way.
+	clockwise := [][]float64{{0, 0}, {0, 10}, {10, 10}, {10, 0}, {0, 0}}
+
+	tests := []struct {
+		name string
+		ring [][]float64
+		p    GeoPoint
+		want bool
+	}{
+		{"centre", square, GeoPoint{Lat: 5, Lng: 5}, true},
+		{"east of it", square, GeoPoint{Lat: 5, Lng: 11}, false},
+		{"west of it", square, GeoPoint{Lat: 5, Lng: -1}, false},
+		{"north of it", square, GeoPoint{Lat: 11, Lng: 5}, false},
+		{"south of it", square, GeoPoint{Lat: -1, Lng: 5}, false},
+		{"level with a vertex", square, GeoPoint{Lat: 10, Lng: -5}, false},
+		{"clockwise centre", clockwise, GeoPoint{Lat: 5, Lng: 5}, true},
+		{"clockwise outside", clockwise, GeoPoint{Lat: 5, Lng: 15}, false},
+		{"left arm of the U", u, GeoPoint{Lat: 8, Lng: 2}, true},
+		{"right arm of the U", u, GeoPoint{Lat: 8, Lng: 8}, true},
+		{"base of the U", u, GeoPoint{Lat: 2, Lng: 5}, true},
+		{"inside the notch", u, GeoPoint{Lat: 8, Lng: 5}, false},
+		{"empty ring", nil, GeoPoint{Lat: 0, Lng: 0}, false},
+	}
+	for _, tt := range tests {
+		if got := ringContains(tt.ring, tt.p); got != tt.want {
+			t.Errorf("%s: ringContains(%v) = %v, want %v", tt.name, tt.p, got, tt.want)
+		}
+	}
+}
+
+func TestZoneAreaContains(t *testing.T) {
+	area := ZoneArea{Type: "Polygon", Coordinates: [][][]float64{
+		{{0, 0}, {10, 0}, {10, 10}, {0, 10}, {0, 0}},
+		{{4, 4}, {6, 4}, {6, 6}, {4, 6}, {4, 4}},
+	}}
+	if err := area.validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+
+	tests := []struct {
+		p    GeoPoint
+		want bool
+	}{
+		{GeoPoint{Lat: 2, Lng: 2}, true},
+		{GeoPoint{Lat: 5, Lng: 5}, false}, // in the hole
+		{GeoPoint{Lat: 5, Lng: 12}, false},
+	}
+	for _, tt := range tests {
+		if got := area.contains(tt.p); got != tt.want {
+			t.Errorf("contains(%v) = %v, want %v", tt.p, got, tt.want)
+		}
+	}
+	if (ZoneArea{Type: "Polygon"}).contains(GeoPoint{}) {
+		t.Error("an area without rings contains nothing")
+	}
+}